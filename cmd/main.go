@@ -2,64 +2,57 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"github.com/xiaorui77/goutils/fileutils"
+	"flag"
 	"github.com/xiaorui77/goutils/logx"
 	"github.com/xiaorui77/goutils/logx/hooks"
 	"github.com/xiaorui77/goutils/math"
 	"github.com/xiaorui77/monker-king/internal/config"
 	"github.com/xiaorui77/monker-king/internal/engine/collector"
-	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/rule"
 	"github.com/xiaorui77/monker-king/internal/manager"
 	"github.com/xiaorui77/monker-king/internal/utils/logx_hooks"
-	"math/rand"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
-var (
-	girlRe   = `body > div:nth-child(6) > div > div.pic img`
-	pageRe   = `body > div:nth-child(6) > div > div.row.col6.clearfix > dl > dt > a`
-	pagingRe = `body > div:nth-child(8) > div > div.pc_pagination > a:nth-last-child(2)`
-)
-
-var basePath = "./data"
-
 func main() {
+	conf, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		logx.Fatalf("[engine] load config failed: %v", err)
+		return
+	}
 	stopCtx, _ := signal.NotifyContext(context.Background(), []os.Signal{os.Interrupt, syscall.SIGTERM}...)
 
 	// option
-	logx.Init("monkey-king", logx.WithInstance("monkey-king-"+math.RandomStr(5, 36)),
-		logx.WithLevel(logx.DebugLevel), logx.WithReportCaller(true),
-		logx.WithHook(hooks.NewEsHook("http://192.168.17.1:9200")),
-		logx.WithHook(logx_hooks.NewPostFormat()))
+	opts := []logx.Option{logx.WithInstance("monkey-king-" + math.RandomStr(5, 36)),
+		logx.WithLevel(logx.ParseLevel(conf.Log.Level)), logx.WithReportCaller(true)}
+	if conf.Log.EsURL != "" {
+		opts = append(opts, logx.WithHook(hooks.NewEsHook(conf.Log.EsURL)))
+	}
+	opts = append(opts, logx.WithHook(logx_hooks.NewPostFormat()))
+	logx.Init("monkey-king", opts...)
 
-	conf := config.InitConfig()
 	engine, err := collector.NewCollector(conf)
 	if err != nil {
 		logx.Fatalf("[engine] create collector failed: %v", err)
 		return
 	}
 
-	// 每个单元下所有元素
-	engine.OnHTMLAny(girlRe, func(t *task.Task, e *collector.HTMLElement) {
-		name := e.GetText("body > div:nth-child(6) > div > h1", "girl-"+string(rand.Int31n(1000)))
-		name = fileutils.WindowsName(name)
-		file := fmt.Sprintf("%v-%03d", name, e.Index)
-		path := fmt.Sprintf("%v/%v", basePath, name)
-		_ = engine.Download(t, file, path, e.Attr[0].Val)
-	})
-
-	// 每页内所有单元
-	engine.OnHTMLAny(pageRe, func(t *task.Task, ele *collector.HTMLElement) {
-		_ = ele.Visit(ele.Attr[1].Val, ele.Attr[0].Val, false)
-	})
-
-	// 下个页
-	engine.OnHTMLAny(pagingRe, func(t *task.Task, ele *collector.HTMLElement) {
-		_ = ele.Visit(ele.Attr[0].Val, ele.Attr[0].Val, true)
-	})
+	// 加载规则文件
+	for _, path := range conf.Rules {
+		f, err := rule.Load(path, conf.Output)
+		if err != nil {
+			logx.Fatalf("[engine] load rule failed: %v", err)
+			return
+		}
+		if err := rule.Apply(engine, f); err != nil {
+			logx.Fatalf("[engine] apply rule %s failed: %v", f.Name, err)
+			return
+		}
+	}
 
 	// ui
 	// ui := view.NewUI(collector)
@@ -68,7 +61,7 @@ func main() {
 	// go ui.Run(stopCtx)
 
 	// manager
-	go manager.NewManager(engine).Run(stopCtx)
+	go manager.NewManager(conf.Manager, engine).Run(stopCtx)
 
 	engine.Run(stopCtx)
 	logx.Infof("main has been exit")
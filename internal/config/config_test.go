@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad_Priority(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mk.yaml")
+	data := `
+manager:
+  addr: ":9000"
+scheduler:
+  parallelism: 2
+  maxDepth: 5
+  taskInterval: 500ms
+storage:
+  driver: memory
+`
+	_ = os.WriteFile(path, []byte(data), 0644)
+	t.Setenv("MK_SCHEDULER_PARALLELISM", "6")
+	t.Setenv("MK_MANAGER_ADDR", ":9001")
+
+	c, err := Load([]string{"-config", path, "-manager.addr=:9002", "-resume", "-rule", "a.yaml, b.json"})
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	// 默认值
+	if c.Scheduler.DefaultTimeout != time.Second*15 {
+		t.Errorf("default value lost: %v", c.Scheduler.DefaultTimeout)
+	}
+	// 文件
+	if c.Scheduler.MaxDepth != 5 || c.Scheduler.TaskInterval != time.Millisecond*500 || c.Storage.Driver != "memory" {
+		t.Errorf("file value not applied: %+v", c.Scheduler)
+	}
+	// 环境变量覆盖文件
+	if c.Scheduler.Parallelism != 6 {
+		t.Errorf("env value not applied: %d", c.Scheduler.Parallelism)
+	}
+	// 命令行覆盖环境变量
+	if c.Manager.Addr != ":9002" || !c.Resume || len(c.Rules) != 2 || c.Rules[1] != "b.json" {
+		t.Errorf("flag value not applied: %+v", c)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	cases := [][]string{
+		{"-scheduler.parallelism=0"},
+		{"-storage.driver=oracle"},
+		{"-scheduler.defaultTimeout=20m"},
+		{"-scheduler.taskInterval=abc"},
+		{"-config", "not-exist.yaml"},
+		{"-scheduler.retry.maxAttempts=0"},
+		{"-scheduler.retry.jitter=2"},
+		{"-download.charset.fallback=unknown"},
+		{"-download.maxDecodedSize=-1"},
+		{"-download.cache.policy=sometimes"},
+		{"-scheduler.recrawl.enabled", "-scheduler.recrawl.checkInterval=0s"},
+		{"-download.warc.dir=./warc", "-download.warc.maxSize=0"},
+	}
+	for i, args := range cases {
+		if _, err := Load(args); err == nil {
+			t.Errorf("case %d: expect error for %v", i, args)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// EnvPrefix 环境变量前缀, 如 scheduler.parallelism 对应 MK_SCHEDULER_PARALLELISM
+	EnvPrefix = "MK_"
+	// EnvConfig 配置文件路径的环境变量
+	EnvConfig = "MK_CONFIG"
+)
+
+// option 一个可通过环境变量和命令行设置的配置项
+type option struct {
+	name  string
+	usage string
+	value interface{} // 指向Config中字段的指针
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"persistent", "record visited urls to redis unless dedup.store is set", &c.Persistent},
+		{"resume", "resume unfinished tasks from storage", &c.Resume},
+		{"output", "default output directory", &c.Output},
+		{"rule", "rule files (yaml or json) separated by comma", &c.Rules},
+		{"log.level", "log level: debug, info, warn, error", &c.Log.Level},
+		{"log.esUrl", "elasticsearch url of log hook, empty to disable", &c.Log.EsURL},
+		{"storage.driver", "storage driver: mysql, sqlite, memory", &c.Storage.Driver},
+		{"storage.dsn", "mysql dsn or sqlite file path", &c.Storage.DSN},
+		{"redis.addr", "redis address", &c.Redis.Addr},
+		{"manager.addr", "listen address of manager http server", &c.Manager.Addr},
+		{"scheduler.parallelism", "maximum concurrent processes of the same domain", &c.Scheduler.Parallelism},
+		{"scheduler.maxDepth", "max exploit depth of task", &c.Scheduler.MaxDepth},
+		{"scheduler.taskInterval", "interval between two tasks of a process", &c.Scheduler.TaskInterval},
+		{"scheduler.defaultTimeout", "default timeout of task", &c.Scheduler.DefaultTimeout},
+		{"scheduler.taskQueueSize", "size of task queue", &c.Scheduler.TaskQueueSize},
+		{"scheduler.idleTimeout", "stop idle browsers after this duration, 0 means never", &c.Scheduler.IdleTimeout},
+		{"scheduler.drainTimeout", "max time waiting for running tasks before stop", &c.Scheduler.DrainTimeout},
+		{"scheduler.robots.enabled", "obey robots.txt of each domain", &c.Scheduler.Robots.Enabled},
+		{"scheduler.robots.userAgent", "user-agent name matched in robots.txt", &c.Scheduler.Robots.UserAgent},
+		{"scheduler.rateLimit.rate", "requests per second of each domain, 0 means unlimited", &c.Scheduler.RateLimit.Rate},
+		{"scheduler.rateLimit.burst", "burst of requests of each domain", &c.Scheduler.RateLimit.Burst},
+		{"scheduler.rateLimit.jitter", "max random jitter between two requests", &c.Scheduler.RateLimit.Jitter},
+		{"scheduler.rateLimit.minDelay", "min delay between two requests of each domain", &c.Scheduler.RateLimit.MinDelay},
+		{"scheduler.retry.maxAttempts", "max attempts of a task including the first one", &c.Scheduler.Retry.MaxAttempts},
+		{"scheduler.retry.backoff", "wait time before the first retry", &c.Scheduler.Retry.Backoff},
+		{"scheduler.retry.maxBackoff", "max wait time before a retry", &c.Scheduler.Retry.MaxBackoff},
+		{"scheduler.retry.multiplier", "multiplier of wait time after each failure", &c.Scheduler.Retry.Multiplier},
+		{"scheduler.retry.jitter", "max random ratio added to wait time, in [0, 1]", &c.Scheduler.Retry.Jitter},
+		{"scheduler.retry.timeoutStep", "timeout added after each failure", &c.Scheduler.Retry.TimeoutStep},
+		{"scheduler.recrawl.enabled", "revisit urls matching scheduler.recrawl.rules periodically", &c.Scheduler.Recrawl.Enabled},
+		{"scheduler.recrawl.checkInterval", "interval of checking due urls to revisit", &c.Scheduler.Recrawl.CheckInterval},
+		{"dedup.store", "store of visited urls: sql, redis, memory", &c.Dedup.Store},
+		{"dedup.expectedUrls", "expected number of urls of bloom filter", &c.Dedup.ExpectedURLs},
+		{"dedup.falsePositive", "false positive rate of bloom filter", &c.Dedup.FalsePositive},
+		{"dedup.bloomFile", "file to save bloom filter on exit, empty to rebuild from store", &c.Dedup.BloomFile},
+		{"dedup.stripParams", "query params removed when canonicalizing urls, separated by comma", &c.Dedup.StripParams},
+		{"cluster.mode", "cluster mode: standalone, worker, coordinator", &c.Cluster.Mode},
+		{"cluster.workerId", "unique name of the worker, empty to use hostname-pid", &c.Cluster.WorkerID},
+		{"cluster.leaseTtl", "ttl of worker and domain leases", &c.Cluster.LeaseTTL},
+		{"cluster.prefetch", "max tasks taken from the shared queue per domain", &c.Cluster.Prefetch},
+		{"download.maxTimeout", "max timeout of a request", &c.Download.MaxTimeout},
+		{"download.maxDecodedSize", "max bytes of a decompressed response body, 0 for unlimited", &c.Download.MaxDecodedSize},
+		{"download.proxy.urls", "proxy urls (http, https, socks5) separated by comma, empty to use env", &c.Download.Proxy.URLs},
+		{"download.proxy.strategy", "proxy rotation: roundRobin, sticky, random", &c.Download.Proxy.Strategy},
+		{"download.proxy.maxFailures", "eject a proxy after consecutive failures", &c.Download.Proxy.MaxFailures},
+		{"download.proxy.cooldown", "check an ejected proxy after this duration", &c.Download.Proxy.Cooldown},
+		{"download.proxy.checkUrl", "url requested by health check, empty to restore after cooldown", &c.Download.Proxy.CheckURL},
+		{"download.session.persist", "save cookies of each domain to storage and restore them on restart", &c.Download.Session.Persist},
+		{"download.session.referer", "send the url of the parent task as referer", &c.Download.Session.Referer},
+		{"download.cache.dir", "directory of the http response cache, empty to disable", &c.Download.Cache.Dir},
+		{"download.cache.policy", "response cache policy: always, respect, never", &c.Download.Cache.Policy},
+		{"download.warc.dir", "directory of warc files recording all http requests and responses, empty to disable", &c.Download.Warc.Dir},
+		{"download.warc.maxSize", "max bytes of a warc file before rotation", &c.Download.Warc.MaxSize},
+		{"download.warc.replay", "warc files (glob supported) to replay responses from instead of the network, separated by comma", &c.Download.Warc.Replay},
+		{"download.charset.fallback", "charset used when a page declares none and is not valid utf-8", &c.Download.Charset.Fallback},
+		{"download.render.domains", "domains rendered by headless browser separated by comma", &c.Download.Render.Domains},
+		{"download.render.remoteUrl", "devtools url of a running browser, empty to launch a local one", &c.Download.Render.RemoteURL},
+		{"download.render.execPath", "path of local browser, empty to find automatically", &c.Download.Render.ExecPath},
+		{"download.render.headless", "run local browser in headless mode", &c.Download.Render.Headless},
+		{"download.render.waitSelector", "wait until the element is ready after page loaded", &c.Download.Render.WaitSelector},
+		{"download.render.waitTime", "extra wait time after page loaded", &c.Download.Render.WaitTime},
+		{"download.render.maxTabs", "max tabs opened at the same time", &c.Download.Render.MaxTabs},
+	}
+}
+
+// Load 按 默认值 < 配置文件 < 环境变量 < 命令行 的优先级加载配置并校验.
+// 配置文件通过 -config 或 MK_CONFIG 指定, 支持YAML和JSON.
+func Load(args []string) (*Config, error) {
+	c := Default()
+
+	path := os.Getenv(EnvConfig)
+	if p, ok := lookupArg(args, "config"); ok {
+		path = p
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.loadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.loadFlags(args, path); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file %v failed: %v", path, err)
+	}
+	// JSON是YAML的子集
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("parse config file %v failed: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	for _, opt := range c.options() {
+		key := EnvPrefix + strings.ToUpper(strings.ReplaceAll(opt.name, ".", "_"))
+		v, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if err := setValue(opt.value, v); err != nil {
+			return fmt.Errorf("invalid env %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) loadFlags(args []string, path string) error {
+	fs := flag.NewFlagSet("monkey-king", flag.ContinueOnError)
+	fs.String("config", path, "config file (yaml or json)")
+	for _, opt := range c.options() {
+		fs.Var(&flagValue{opt.value}, opt.name, opt.usage)
+	}
+	return fs.Parse(args)
+}
+
+// lookupArg 在解析前查找 -name value / -name=value 形式的参数
+func lookupArg(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"="), true
+		}
+	}
+	return "", false
+}
+
+func setValue(ptr interface{}, s string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = s
+	case *bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *int:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *float64:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *time.Duration:
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*p = v
+	case *[]string:
+		*p = (*p)[:0]
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", ptr)
+	}
+	return nil
+}
+
+// flagValue 将Config中的字段包装为flag.Value
+type flagValue struct {
+	ptr interface{}
+}
+
+func (f *flagValue) String() string {
+	if f == nil || f.ptr == nil {
+		return ""
+	}
+	switch p := f.ptr.(type) {
+	case *[]string:
+		return strings.Join(*p, ",")
+	case *string:
+		return *p
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *int:
+		return strconv.Itoa(*p)
+	case *float64:
+		return strconv.FormatFloat(*p, 'f', -1, 64)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+func (f *flagValue) Set(s string) error {
+	return setValue(f.ptr, s)
+}
+
+// IsBoolFlag 使bool类型的参数支持 -resume 的写法
+func (f *flagValue) IsBoolFlag() bool {
+	_, ok := f.ptr.(*bool)
+	return ok
+}
@@ -2,13 +2,16 @@ package api
 
 import (
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/api"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/sitemap"
 	"github.com/xiaorui77/monker-king/internal/engine/types"
 	"github.com/xiaorui77/monker-king/internal/view/model"
 	error2 "github.com/xiaorui77/monker-king/pkg/error"
 )
 
 type Collect interface {
-	Visit(url string) error
+	Visit(url string, opts ...task.Option) error
+	VisitSitemap(opts *sitemap.Options) error
 
 	TaskManager() api.TaskManage
 	GetDataProducer() model.DataProducer
@@ -16,4 +19,7 @@ type Collect interface {
 
 type Parsing interface {
 	HandleOnResponse(resp *types.ResponseWarp) error2.Error
+
+	// RestoreTask 为从存储中恢复的任务重新绑定Callback
+	RestoreTask(t *task.Task) error
 }
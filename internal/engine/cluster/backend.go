@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backend 多个worker共享的任务队列、租约和域名分配.
+// 任务按域名分队列, 被领取后记录为执行中, 直到Ack或被Reclaim放回队列.
+type Backend interface {
+	// Heartbeat 注册或续约worker, ttl内未再次调用视为失效
+	Heartbeat(worker string, ttl time.Duration) error
+	// Leave worker主动退出
+	Leave(worker string) error
+	// Workers 存活的worker
+	Workers() ([]string, error)
+
+	// Push 添加任务到域名的队列尾部
+	Push(domain, id string, data []byte) error
+	// Take 从域名的队列中领取最多n个任务, 并记录为执行中
+	Take(domain string, n int) ([][]byte, error)
+	// Ack 任务结束, 从执行中移除
+	Ack(domain, id string) error
+	// Reclaim 域名的租约无人持有时, 将执行中的任务放回队列头部, 返回放回的数量
+	Reclaim(domain string) (int, error)
+	// Domains 有过任务的域名
+	Domains() ([]string, error)
+
+	// Lease 获取或续约名为name的租约, 已被其他worker持有时返回false
+	Lease(name, worker string, ttl time.Duration) (bool, error)
+	// Release 释放自己持有的租约
+	Release(name, worker string) error
+	// Holders 返回names中每个有效租约的持有者, 无人持有的不包含在内
+	Holders(names []string) (map[string]string, error)
+
+	// Assign 将域名分配给worker
+	Assign(domain, worker string) error
+	// Assignments 所有域名的分配情况: domain -> worker
+	Assignments() (map[string]string, error)
+}
+
+type lease struct {
+	holder   string
+	deadline time.Time
+}
+
+type memoryQueue struct {
+	pending  []string
+	inflight map[string]bool
+	data     map[string][]byte
+}
+
+// MemoryBackend 进程内的Backend, 用于测试或在同一进程中运行多个worker
+type MemoryBackend struct {
+	mu          sync.Mutex
+	now         func() time.Time
+	workers     map[string]time.Time
+	queues      map[string]*memoryQueue
+	leases      map[string]*lease
+	assignments map[string]string
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		now:         time.Now,
+		workers:     map[string]time.Time{},
+		queues:      map[string]*memoryQueue{},
+		leases:      map[string]*lease{},
+		assignments: map[string]string{},
+	}
+}
+
+func (m *MemoryBackend) Heartbeat(worker string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers[worker] = m.now().Add(ttl)
+	return nil
+}
+
+func (m *MemoryBackend) Leave(worker string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.workers, worker)
+	return nil
+}
+
+func (m *MemoryBackend) Workers() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	res := make([]string, 0, len(m.workers))
+	for w, deadline := range m.workers {
+		if deadline.After(now) {
+			res = append(res, w)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (m *MemoryBackend) queue(domain string) *memoryQueue {
+	q, ok := m.queues[domain]
+	if !ok {
+		q = &memoryQueue{inflight: map[string]bool{}, data: map[string][]byte{}}
+		m.queues[domain] = q
+	}
+	return q
+}
+
+func (m *MemoryBackend) Push(domain, id string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(domain)
+	q.pending = append(q.pending, id)
+	q.data[id] = data
+	return nil
+}
+
+func (m *MemoryBackend) Take(domain string, n int) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queues[domain]
+	if !ok || n <= 0 {
+		return nil, nil
+	}
+	if n > len(q.pending) {
+		n = len(q.pending)
+	}
+	res := make([][]byte, 0, n)
+	for _, id := range q.pending[:n] {
+		// 放回队列后已被Ack的任务
+		if data, ok := q.data[id]; ok {
+			q.inflight[id] = true
+			res = append(res, data)
+		}
+	}
+	q.pending = q.pending[n:]
+	return res, nil
+}
+
+func (m *MemoryBackend) Ack(domain, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if q, ok := m.queues[domain]; ok {
+		delete(q.inflight, id)
+		delete(q.data, id)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Reclaim(domain string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.leases[domain]; l != nil && l.deadline.After(m.now()) {
+		return 0, nil
+	}
+	q, ok := m.queues[domain]
+	if !ok || len(q.inflight) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, 0, len(q.inflight))
+	for id := range q.inflight {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	q.pending = append(ids, q.pending...)
+	q.inflight = map[string]bool{}
+	return len(ids), nil
+}
+
+func (m *MemoryBackend) Domains() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]string, 0, len(m.queues))
+	for domain := range m.queues {
+		res = append(res, domain)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (m *MemoryBackend) Lease(name, worker string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if l := m.leases[name]; l != nil && l.holder != worker && l.deadline.After(now) {
+		return false, nil
+	}
+	m.leases[name] = &lease{holder: worker, deadline: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryBackend) Release(name, worker string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.leases[name]; l != nil && l.holder == worker {
+		delete(m.leases, name)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Holders(names []string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	res := make(map[string]string, len(names))
+	for _, name := range names {
+		if l := m.leases[name]; l != nil && l.deadline.After(now) {
+			res[name] = l.holder
+		}
+	}
+	return res, nil
+}
+
+func (m *MemoryBackend) Assign(domain, worker string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.assignments[domain] = worker
+	return nil
+}
+
+func (m *MemoryBackend) Assignments() (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]string, len(m.assignments))
+	for domain, worker := range m.assignments {
+		res[domain] = worker
+	}
+	return res, nil
+}
@@ -0,0 +1,331 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ModeStandalone  = "standalone"
+	ModeWorker      = "worker"
+	ModeCoordinator = "coordinator" // 同时作为worker
+
+	// CoordinatorLease 同一时间只有一个coordinator工作, 其余作为备用
+	CoordinatorLease = "@coordinator"
+)
+
+// Status 集群的状态, 用于管理接口
+type Status struct {
+	Mode        string            `json:"mode"`
+	Worker      string            `json:"worker"`
+	Coordinator string            `json:"coordinator"`
+	Workers     []string          `json:"workers"`
+	Owners      map[string]string `json:"owners"`      // domain -> 持有租约的worker
+	Assignments map[string]string `json:"assignments"` // domain -> 分配的worker
+}
+
+// Node 集群中的一个worker.
+// 任务都添加到共享队列, coordinator将域名分配给存活的worker, worker获取域名的租约后领取其任务,
+// 保证同一域名同一时间只在一个worker中调度. worker失效后租约过期, 执行中的任务被放回队列并重新分配.
+type Node struct {
+	conf    config.ClusterConfig
+	id      string
+	backend Backend
+
+	mu       sync.Mutex
+	owned    map[string]bool            // 持有租约的域名
+	inflight map[string]map[string]bool // 已领取未Ack的任务
+	revoke   func(domain string)        // 失去域名的租约时调用, 由Run设置
+}
+
+func NewNode(conf config.ClusterConfig, backend Backend) *Node {
+	id := conf.WorkerID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return &Node{
+		conf:     conf,
+		id:       id,
+		backend:  backend,
+		owned:    map[string]bool{},
+		inflight: map[string]map[string]bool{},
+	}
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Push 添加任务到共享队列
+func (n *Node) Push(t *task.Task) error {
+	data, err := encode(t)
+	if err != nil {
+		return fmt.Errorf("encode task failed: %v", err)
+	}
+	if err := n.backend.Push(t.Domain, TaskKey(t), data); err != nil {
+		logx.Errorf("[cluster] push Task[%08x] to shared queue failed: %v", t.ID, err)
+		return fmt.Errorf("push task failed: %v", err)
+	}
+	return nil
+}
+
+// Taken 任务是否由本worker领取且尚未结束, 失去域名的租约后为false
+func (n *Node) Taken(t *task.Task) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.inflight[t.Domain][TaskKey(t)]
+}
+
+// Ack 任务结束, 非领取的任务忽略; 失去租约后已被coordinator放回队列的任务也会被忽略
+func (n *Node) Ack(t *task.Task) {
+	key := TaskKey(t)
+	n.mu.Lock()
+	if !n.inflight[t.Domain][key] {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.inflight[t.Domain], key)
+	n.mu.Unlock()
+	if err := n.backend.Ack(t.Domain, key); err != nil {
+		logx.Warnf("[cluster] ack Task[%08x] failed: %v", t.ID, err)
+	}
+}
+
+// Run 每LeaseTTL/3续约一次并领取任务, 通过deliver交给本地的调度器.
+// 失去域名的租约时调用revoke, 本地调度器需要丢弃该域名已领取的任务, 它们会由coordinator交给新的持有者.
+func (n *Node) Run(ctx context.Context, deliver func(t *task.Task), revoke func(domain string)) {
+	n.mu.Lock()
+	n.revoke = revoke
+	n.mu.Unlock()
+	logx.Infof("[cluster] worker %s has joined, mode: %s", n.id, n.conf.Mode)
+	ticker := time.NewTicker(n.conf.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		n.tick(deliver)
+		select {
+		case <-ctx.Done():
+			n.leave()
+			logx.Infof("[cluster] worker %s has left", n.id)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Node) tick(deliver func(t *task.Task)) {
+	if err := n.backend.Heartbeat(n.id, n.conf.LeaseTTL); err != nil {
+		logx.Warnf("[cluster] worker %s heartbeat failed: %v", n.id, err)
+		return
+	}
+	if n.conf.Mode == ModeCoordinator {
+		if ok, err := n.backend.Lease(CoordinatorLease, n.id, n.conf.LeaseTTL); err != nil {
+			logx.Warnf("[cluster] lease coordinator failed: %v", err)
+		} else if ok {
+			n.coordinate()
+		}
+	}
+
+	assignments, err := n.backend.Assignments()
+	if err != nil {
+		logx.Warnf("[cluster] get assignments failed: %v", err)
+		return
+	}
+	for domain, worker := range assignments {
+		if worker != n.id {
+			n.release(domain)
+			continue
+		}
+		if ok, err := n.backend.Lease(domain, n.id, n.conf.LeaseTTL); err != nil || !ok {
+			// 等待之前的持有者释放或过期; 之前持有时租约已过期并可能被其他worker获取
+			if n.setOwned(domain, false) {
+				logx.Warnf("[cluster] worker %s lost lease of domain %s", n.id, domain)
+				n.lose(domain)
+			}
+			continue
+		}
+		if !n.setOwned(domain, true) {
+			logx.Infof("[cluster] worker %s owns domain %s", n.id, domain)
+		}
+		n.take(domain, deliver)
+	}
+}
+
+// setOwned 返回之前是否持有
+func (n *Node) setOwned(domain string, owned bool) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	before := n.owned[domain]
+	if owned {
+		n.owned[domain] = true
+	} else {
+		delete(n.owned, domain)
+	}
+	return before
+}
+
+// take 领取任务, 使执行中的任务数不超过Prefetch
+func (n *Node) take(domain string, deliver func(t *task.Task)) {
+	n.mu.Lock()
+	want := n.conf.Prefetch - len(n.inflight[domain])
+	n.mu.Unlock()
+	if want <= 0 {
+		return
+	}
+	items, err := n.backend.Take(domain, want)
+	if err != nil {
+		logx.Warnf("[cluster] take tasks of %s failed: %v", domain, err)
+		return
+	}
+	for _, data := range items {
+		t, err := decode(data)
+		if err != nil {
+			logx.Errorf("[cluster] decode task of %s failed: %v", domain, err)
+			continue
+		}
+		n.mu.Lock()
+		if n.inflight[domain] == nil {
+			n.inflight[domain] = map[string]bool{}
+		}
+		n.inflight[domain][TaskKey(t)] = true
+		n.mu.Unlock()
+		deliver(t)
+	}
+}
+
+func (n *Node) release(domain string) {
+	if !n.setOwned(domain, false) {
+		return
+	}
+	n.lose(domain)
+	if err := n.backend.Release(domain, n.id); err != nil {
+		logx.Warnf("[cluster] release domain %s failed: %v", domain, err)
+	}
+	logx.Infof("[cluster] worker %s released domain %s", n.id, domain)
+}
+
+// lose 不再持有域名的租约: 已领取的任务由coordinator放回队列, 不再Ack, 并通知本地调度器丢弃
+func (n *Node) lose(domain string) {
+	n.mu.Lock()
+	delete(n.inflight, domain)
+	revoke := n.revoke
+	n.mu.Unlock()
+	if revoke != nil {
+		revoke(domain)
+	}
+}
+
+// leave 释放所有租约, 执行中的任务由coordinator放回队列
+func (n *Node) leave() {
+	n.mu.Lock()
+	domains := make([]string, 0, len(n.owned))
+	for domain := range n.owned {
+		domains = append(domains, domain)
+	}
+	n.mu.Unlock()
+	for _, domain := range domains {
+		n.release(domain)
+	}
+	if n.conf.Mode == ModeCoordinator {
+		_ = n.backend.Release(CoordinatorLease, n.id)
+	}
+	if err := n.backend.Leave(n.id); err != nil {
+		logx.Warnf("[cluster] worker %s leave failed: %v", n.id, err)
+	}
+}
+
+// coordinate 将未分配或分配给失效worker的域名重新分配, 并回收无人持有的域名中执行中的任务
+func (n *Node) coordinate() {
+	workers, err := n.backend.Workers()
+	if err != nil || len(workers) == 0 {
+		return
+	}
+	alive := make(map[string]bool, len(workers))
+	for _, w := range workers {
+		alive[w] = true
+	}
+	domains, err := n.backend.Domains()
+	if err != nil {
+		logx.Warnf("[cluster] get domains failed: %v", err)
+		return
+	}
+	assignments, err := n.backend.Assignments()
+	if err != nil {
+		logx.Warnf("[cluster] get assignments failed: %v", err)
+		return
+	}
+	holders, err := n.backend.Holders(domains)
+	if err != nil {
+		logx.Warnf("[cluster] get lease holders failed: %v", err)
+		return
+	}
+	for _, domain := range domains {
+		// 已分配给存活的worker时保持不变, 避免域名在worker之间来回迁移
+		if w, ok := assignments[domain]; !ok || !alive[w] {
+			w = pick(domain, workers)
+			if err := n.backend.Assign(domain, w); err != nil {
+				logx.Warnf("[cluster] assign domain %s failed: %v", domain, err)
+				continue
+			}
+			logx.Infof("[cluster] assign domain %s to worker %s", domain, w)
+		}
+		if _, held := holders[domain]; !held {
+			if num, err := n.backend.Reclaim(domain); err != nil {
+				logx.Warnf("[cluster] reclaim tasks of %s failed: %v", domain, err)
+			} else if num > 0 {
+				logx.Infof("[cluster] reclaim %d tasks of domain %s", num, domain)
+			}
+		}
+	}
+}
+
+// pick 使用rendezvous hashing选择worker, worker变化时只有少量域名需要迁移
+func pick(domain string, workers []string) string {
+	var best string
+	var max uint64
+	for _, w := range workers {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(domain + "/" + w))
+		if s := h.Sum64(); best == "" || s > max {
+			best, max = w, s
+		}
+	}
+	return best
+}
+
+// Status 查询集群的状态
+func (n *Node) Status() (*Status, error) {
+	workers, err := n.backend.Workers()
+	if err != nil {
+		return nil, err
+	}
+	domains, err := n.backend.Domains()
+	if err != nil {
+		return nil, err
+	}
+	holders, err := n.backend.Holders(append(domains, CoordinatorLease))
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := n.backend.Assignments()
+	if err != nil {
+		return nil, err
+	}
+	s := &Status{
+		Mode:        n.conf.Mode,
+		Worker:      n.id,
+		Coordinator: holders[CoordinatorLease],
+		Workers:     workers,
+		Owners:      holders,
+		Assignments: assignments,
+	}
+	delete(s.Owners, CoordinatorLease)
+	return s, nil
+}
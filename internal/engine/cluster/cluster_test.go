@@ -0,0 +1,227 @@
+package cluster
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestBackend(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testBackend(t, NewMemoryBackend())
+	})
+	t.Run("redis", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		b, err := NewRedisBackend(mr.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		testBackend(t, b)
+	})
+}
+
+func testBackend(t *testing.T, b Backend) {
+	for _, id := range []string{"1", "2", "3"} {
+		if err := b.Push("a.com", id, []byte("task-"+id)); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	items, err := b.Take("a.com", 2)
+	if err != nil || len(items) != 2 || string(items[0]) != "task-1" || string(items[1]) != "task-2" {
+		t.Fatalf("take got %q, %v", items, err)
+	}
+	if err := b.Ack("a.com", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 持有租约时不会回收
+	if ok, _ := b.Lease("a.com", "w1", time.Minute); !ok {
+		t.Fatal("lease should be acquired")
+	}
+	if ok, _ := b.Lease("a.com", "w2", time.Minute); ok {
+		t.Fatal("lease held by w1 should not be acquired by w2")
+	}
+	if holders, _ := b.Holders([]string{"a.com", "b.com"}); len(holders) != 1 || holders["a.com"] != "w1" {
+		t.Fatalf("unexpected holders: %v", holders)
+	}
+	if n, _ := b.Reclaim("a.com"); n != 0 {
+		t.Fatalf("reclaim with lease held got %d", n)
+	}
+
+	// 释放后执行中的任务2回到队列头部
+	_ = b.Release("a.com", "w2")
+	if holders, _ := b.Holders([]string{"a.com"}); holders["a.com"] != "w1" {
+		t.Fatal("release by other worker should be ignored")
+	}
+	_ = b.Release("a.com", "w1")
+	if n, err := b.Reclaim("a.com"); n != 1 || err != nil {
+		t.Fatalf("reclaim got %d, %v", n, err)
+	}
+	items, _ = b.Take("a.com", 5)
+	if len(items) != 2 || string(items[0]) != "task-2" || string(items[1]) != "task-3" {
+		t.Fatalf("take after reclaim got %q", items)
+	}
+
+	_ = b.Heartbeat("w1", time.Minute)
+	_ = b.Heartbeat("w2", time.Minute)
+	_ = b.Leave("w2")
+	if workers, _ := b.Workers(); len(workers) != 1 || workers[0] != "w1" {
+		t.Fatalf("unexpected workers: %v", workers)
+	}
+	_ = b.Assign("a.com", "w1")
+	if assignments, _ := b.Assignments(); assignments["a.com"] != "w1" {
+		t.Fatalf("unexpected assignments: %v", assignments)
+	}
+	if domains, _ := b.Domains(); len(domains) != 1 || domains[0] != "a.com" {
+		t.Fatalf("unexpected domains: %v", domains)
+	}
+}
+
+func TestNode_Failover(t *testing.T) {
+	b := NewMemoryBackend()
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	conf := config.ClusterConfig{Mode: ModeCoordinator, WorkerID: "coordinator", LeaseTTL: time.Second * 30, Prefetch: 2}
+	coordinator := NewNode(conf, b)
+	conf.Mode, conf.WorkerID = ModeWorker, "worker"
+	worker := NewNode(conf, b)
+
+	received := map[string][]*task.Task{}
+	deliverTo := func(n *Node) func(t *task.Task) {
+		return func(t *task.Task) { received[n.ID()] = append(received[n.ID()], t) }
+	}
+	domains := []string{"a.com", "b.com", "c.com", "d.com", "e.com", "f.com"}
+	for _, domain := range domains {
+		for i := 0; i < 3; i++ {
+			tk := task.NewTask("", nil, "https://"+domain, nil)
+			tk.Domain = domain
+			if err := worker.Push(tk); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 先注册worker, 再由coordinator分配
+	worker.tick(deliverTo(worker))
+	coordinator.tick(deliverTo(coordinator))
+	worker.tick(deliverTo(worker))
+
+	status, err := coordinator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Coordinator != "coordinator" || len(status.Workers) != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	var lost []string
+	for _, domain := range domains {
+		owner := status.Owners[domain]
+		if owner == "" || owner != status.Assignments[domain] {
+			t.Fatalf("domain %s owned by %q but assigned to %q", domain, owner, status.Assignments[domain])
+		}
+		if owner == "worker" {
+			lost = append(lost, domain)
+		}
+	}
+	if len(lost) == 0 || len(lost) == len(domains) {
+		t.Fatalf("domains should be sharded across workers: %v", status.Owners)
+	}
+	// 每个域名最多领取Prefetch个任务
+	if got := len(received["worker"]) + len(received["coordinator"]); got != len(domains)*2 {
+		t.Fatalf("expect %d tasks taken, got %d", len(domains)*2, got)
+	}
+	for _, tk := range received["worker"] {
+		worker.Ack(tk)
+	}
+
+	// worker失效, 租约过期后其域名由coordinator接管, 执行中的任务被放回队列
+	now = now.Add(time.Minute)
+	before := len(received["coordinator"])
+	coordinator.tick(deliverTo(coordinator))
+	coordinator.tick(deliverTo(coordinator))
+
+	status, _ = coordinator.Status()
+	if len(status.Workers) != 1 {
+		t.Fatalf("dead worker should be removed: %v", status.Workers)
+	}
+	for _, domain := range lost {
+		if status.Owners[domain] != "coordinator" {
+			t.Fatalf("domain %s should be taken over, owners: %v", domain, status.Owners)
+		}
+	}
+	var urls []string
+	for _, tk := range received["coordinator"][before:] {
+		urls = append(urls, tk.Domain)
+	}
+	sort.Strings(urls)
+	// 已Ack的2个任务不会重复, 每个域名剩余1个
+	if len(urls) != len(lost) {
+		t.Fatalf("expect 1 remaining task of each lost domain %v, got %v", lost, urls)
+	}
+}
+
+func TestNode_Revoke(t *testing.T) {
+	b := NewMemoryBackend()
+	node := NewNode(config.ClusterConfig{Mode: ModeWorker, WorkerID: "w1", LeaseTTL: time.Second * 30, Prefetch: 2}, b)
+	var revoked []string
+	node.revoke = func(domain string) { revoked = append(revoked, domain) }
+	for i := 0; i < 2; i++ {
+		tk := task.NewTask("", nil, "https://a.com", nil)
+		tk.Domain = "a.com"
+		if err := node.Push(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Assign("a.com", "w1"); err != nil {
+		t.Fatal(err)
+	}
+	var taken []*task.Task
+	node.tick(func(t *task.Task) { taken = append(taken, t) })
+	if len(taken) != 2 || !node.Taken(taken[0]) {
+		t.Fatalf("expect 2 taken tasks, got %d", len(taken))
+	}
+
+	// 域名分配给其他worker后释放租约, 已领取的任务不再Ack, 由coordinator放回队列
+	if err := b.Assign("a.com", "w2"); err != nil {
+		t.Fatal(err)
+	}
+	node.tick(func(t *task.Task) {})
+	if len(revoked) != 1 || revoked[0] != "a.com" {
+		t.Fatalf("expect a.com revoked, got %v", revoked)
+	}
+	for _, tk := range taken {
+		if node.Taken(tk) {
+			t.Errorf("Task[%08x] should not be taken after release", tk.ID)
+		}
+		node.Ack(tk)
+	}
+	if n, err := b.Reclaim("a.com"); err != nil || n != 2 {
+		t.Errorf("expect 2 tasks reclaimed, got %d, %v", n, err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	tk := task.NewTask("search", nil, "https://a.com/search", nil,
+		task.WithMethod("put"), task.WithHeader("X-Token", "abc"), task.WithForm(map[string][]string{"q": {"monkey"}}))
+	tk.Domain = "a.com"
+	data, err := encode(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Request.GetMethod() != "PUT" || decoded.Request.Header.Get("X-Token") != "abc" || decoded.Request.Form.Get("q") != "monkey" {
+		t.Errorf("unexpected request: %+v", decoded.Request)
+	}
+	if decoded.Request.Signature() != tk.Request.Signature() {
+		t.Errorf("signature should be kept, expect %q, got %q", tk.Request.Signature(), decoded.Request.Signature())
+	}
+}
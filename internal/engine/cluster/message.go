@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"time"
+)
+
+// message 在共享队列中传递的任务, Callback由领取的worker通过MetaCallback重新绑定
+type message struct {
+	ID       uint64       `json:"id"`
+	ParentId uint64       `json:"pid"`
+	Name     string       `json:"name"`
+	Url      string       `json:"url"`
+	Domain   string       `json:"domain"`
+	Depth    int          `json:"depth"`
+	Priority int          `json:"priority"`
+	Meta     task.Meta    `json:"meta"`
+	Request  task.Request `json:"request"` // 请求方法, 请求头和请求体, 也用于去重的Signature
+}
+
+// TaskKey 任务在共享队列中的id
+func TaskKey(t *task.Task) string {
+	return fmt.Sprintf("%08x", t.ID)
+}
+
+func encode(t *task.Task) ([]byte, error) {
+	return json.Marshal(&message{
+		ID:       t.ID,
+		ParentId: t.ParentId,
+		Name:     t.Name,
+		Url:      t.Url,
+		Domain:   t.Domain,
+		Depth:    t.Depth,
+		Priority: t.Priority,
+		Meta:     t.Meta,
+		Request:  t.Request,
+	})
+}
+
+// decode 还原为没有Parent的任务, 在领取的worker中作为根任务调度.
+// 集群模式下任务树被展开, 只保留ParentId: 不能使用父任务的URL作为Referer, WARC中也只记录parent-id.
+func decode(data []byte) (*task.Task, error) {
+	m := &message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Meta == nil {
+		m.Meta = task.Meta{}
+	}
+	m.Meta.Normalize()
+	return &task.Task{
+		ID:         m.ID,
+		ParentId:   m.ParentId,
+		Name:       m.Name,
+		Url:        m.Url,
+		Domain:     m.Domain,
+		Depth:      m.Depth,
+		Priority:   m.Priority,
+		Meta:       m.Meta,
+		Request:    m.Request,
+		CreateTime: time.Now(),
+	}, nil
+}
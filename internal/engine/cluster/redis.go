@@ -0,0 +1,184 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/storage"
+	"strconv"
+	"time"
+)
+
+const (
+	keyPrefix   = storage.KeyPrefix + "cluster:"
+	workersKey  = keyPrefix + "workers"
+	domainsKey  = keyPrefix + "domains"
+	assignKey   = keyPrefix + "assign"
+	queueKey    = keyPrefix + "queue:"
+	inflightKey = keyPrefix + "inflight:"
+	dataKey     = keyPrefix + "data:"
+	leaseKey    = keyPrefix + "lease:"
+)
+
+var (
+	// 不存在或已由自己持有时设置并续约
+	leaseScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v == false or v == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0`)
+	releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+	// KEYS: queue, inflight, data; ARGV: n
+	takeScript = redis.NewScript(`
+local ids = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+if #ids == 0 then
+	return {}
+end
+redis.call('LTRIM', KEYS[1], #ids, -1)
+local res = {}
+for _, id in ipairs(ids) do
+	local data = redis.call('HGET', KEYS[3], id)
+	if data then
+		redis.call('SADD', KEYS[2], id)
+		table.insert(res, data)
+	end
+end
+return res`)
+	// KEYS: lease, inflight, queue
+	reclaimScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+local ids = redis.call('SMEMBERS', KEYS[2])
+if #ids == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[3], unpack(ids))
+redis.call('DEL', KEYS[2])
+return #ids`)
+)
+
+// RedisBackend 基于redis的Backend.
+// 每个域名使用list保存排队的任务id, set保存执行中的id, hash保存任务内容; 租约为带过期时间的key.
+type RedisBackend struct {
+	client *redis.Client
+}
+
+func NewRedisBackend(addr string) (*RedisBackend, error) {
+	c := redis.NewClient(&redis.Options{Addr: addr})
+	if err := c.Ping().Err(); err != nil {
+		logx.Errorf("[cluster] connect to redis %v failed: %v", addr, err)
+		return nil, fmt.Errorf("connect redis failed: %v", err)
+	}
+	logx.Infof("[cluster] connect to redis %v successfully", addr)
+	return &RedisBackend{client: c}, nil
+}
+
+// Heartbeat worker保存在有序集合中, 分数为过期时间(ms)
+func (r *RedisBackend) Heartbeat(worker string, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	return r.client.ZAdd(workersKey, redis.Z{Score: float64(deadline), Member: worker}).Err()
+}
+
+func (r *RedisBackend) Leave(worker string) error {
+	return r.client.ZRem(workersKey, worker).Err()
+}
+
+func (r *RedisBackend) Workers() ([]string, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	return r.client.ZRangeByScore(workersKey, redis.ZRangeBy{Min: "(" + strconv.FormatInt(now, 10), Max: "+inf"}).Result()
+}
+
+func (r *RedisBackend) Push(domain, id string, data []byte) error {
+	_, err := r.client.TxPipelined(func(p redis.Pipeliner) error {
+		p.HSet(dataKey+domain, id, data)
+		p.RPush(queueKey+domain, id)
+		p.SAdd(domainsKey, domain)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisBackend) Take(domain string, n int) ([][]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	res, err := takeScript.Run(r.client, []string{queueKey + domain, inflightKey + domain, dataKey + domain}, n).Result()
+	if err != nil {
+		return nil, err
+	}
+	items, _ := res.([]interface{})
+	data := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			data = append(data, []byte(s))
+		}
+	}
+	return data, nil
+}
+
+func (r *RedisBackend) Ack(domain, id string) error {
+	_, err := r.client.TxPipelined(func(p redis.Pipeliner) error {
+		p.SRem(inflightKey+domain, id)
+		p.HDel(dataKey+domain, id)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisBackend) Reclaim(domain string) (int, error) {
+	n, err := reclaimScript.Run(r.client, []string{leaseKey + domain, inflightKey + domain, queueKey + domain}).Int64()
+	return int(n), err
+}
+
+func (r *RedisBackend) Domains() ([]string, error) {
+	return r.client.SMembers(domainsKey).Result()
+}
+
+func (r *RedisBackend) Lease(name, worker string, ttl time.Duration) (bool, error) {
+	ok, err := leaseScript.Run(r.client, []string{leaseKey + name}, worker, ttl.Milliseconds()).Int64()
+	return ok == 1, err
+}
+
+func (r *RedisBackend) Release(name, worker string) error {
+	return releaseScript.Run(r.client, []string{leaseKey + name}, worker).Err()
+}
+
+func (r *RedisBackend) Holders(names []string) (map[string]string, error) {
+	res := make(map[string]string, len(names))
+	if len(names) == 0 {
+		return res, nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = leaseKey + name
+	}
+	values, err := r.client.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			res[names[i]] = s
+		}
+	}
+	return res, nil
+}
+
+func (r *RedisBackend) Assign(domain, worker string) error {
+	return r.client.HSet(assignKey, domain, worker).Err()
+}
+
+func (r *RedisBackend) Assignments() (map[string]string, error) {
+	return r.client.HGetAll(assignKey).Result()
+}
+
+func (r *RedisBackend) Close() error {
+	return r.client.Close()
+}
@@ -8,6 +8,12 @@ import (
 	"net/http"
 )
 
+// 可被恢复的task.Callback名称, 记录在task.MetaCallback中
+const (
+	CallbackParsing = "parsing"
+	CallbackSave    = "save"
+)
+
 // ResponseCallback is the callback function for response
 type ResponseCallback func(resp *types.ResponseWarp)
 
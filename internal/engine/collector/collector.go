@@ -8,6 +8,9 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/xiaorui77/goutils/logx"
 	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/cluster"
+	"github.com/xiaorui77/monker-king/internal/engine/dedup"
+	"github.com/xiaorui77/monker-king/internal/engine/item"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/api"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
@@ -22,12 +25,10 @@ import (
 type Collector struct {
 	config    *config.Config
 	scheduler *schedule.Scheduler
-	store     storage.Store
 	storage   storage.Storage
 
-	// visited list
-	visitedList  map[string]bool
-	visitedMutex sync.Mutex
+	// 已访问的URL
+	visited *dedup.Filter
 
 	// 抓取成功后回调
 	register sync.Mutex
@@ -35,43 +36,90 @@ type Collector struct {
 	// HTML 回调
 	htmlCallbacks    []HtmlCallbackContainer
 	ResponseCallback []ResponseCallback
+
+	// 结构化数据
+	pipeline *item.Pipeline
+
+	// Run之后可用, 用于后台的sitemap等种子任务
+	ctx     context.Context
+	running chan struct{}
 }
 
 func NewCollector(config *config.Config) (*Collector, error) {
-	var store storage.Store
-	var err error
-	if config.Persistent {
-		store, err = storage.NewRedisStore("127.0.0.1:6379")
-		if err != nil {
-			logx.Errorf("new collector failed: %v", err)
-			return nil, errors.New("connect redis failed")
-		}
+	db, err := storage.NewStorage(config.Storage)
+	if err != nil {
+		logx.Errorf("new collector failed: %v", err)
+		return nil, err
+	}
+	visited, err := newVisited(config, db)
+	if err != nil {
+		logx.Errorf("new collector failed: %v", err)
+		return nil, err
 	}
 
 	c := &Collector{
 		config:  config,
-		store:   store,
-		storage: storage.NewStorage("192.168.17.1:3306"),
+		storage: db,
+		visited: visited,
 
-		visitedList:   map[string]bool{},
 		htmlCallbacks: nil,
+		pipeline:      item.NewPipeline(),
+		running:       make(chan struct{}),
+	}
+	c.scheduler = schedule.NewRunner(config, c, c.storage)
+	if config.Cluster.Mode != cluster.ModeStandalone {
+		backend, err := cluster.NewRedisBackend(config.Redis.Addr)
+		if err != nil {
+			logx.Errorf("new collector failed: %v", err)
+			return nil, err
+		}
+		c.scheduler.Join(cluster.NewNode(config.Cluster, backend))
 	}
-	c.scheduler = schedule.NewRunner(c, c.storage)
 	return c, nil
 }
 
 func (c *Collector) Run(ctx context.Context) {
+	if c.config.Resume {
+		if err := c.scheduler.Restore(); err != nil {
+			logx.Errorf("[collector] restore tasks failed: %v", err)
+		}
+	}
 	logx.Infof("[collector] The Collector already running...")
+	c.ctx = ctx
+	close(c.running)
 	c.scheduler.Run(ctx)
+	c.pipeline.Close()
+	if err := c.visited.Close(); err != nil {
+		logx.Errorf("[collector] close visited filter failed: %v", err)
+	}
 	logx.Infof("[collector] The Collector has been stopped")
 }
 
+func (c *Collector) Storage() storage.Storage {
+	return c.storage
+}
+
+// DeclareItem 声明结构化数据, 之后可以在回调中通过HTMLElement.Extract提取
+func (c *Collector) DeclareItem(s *item.Schema) error {
+	return c.pipeline.Declare(s)
+}
+
+// Pipeline 返回Item处理管道, 可添加Processor和Exporter
+func (c *Collector) Pipeline() *item.Pipeline {
+	return c.pipeline
+}
+
+// RetryPolicies 返回重试策略, 可添加命名的策略和域名使用的策略
+func (c *Collector) RetryPolicies() *schedule.RetryPolicies {
+	return c.scheduler.RetryPolicies()
+}
+
 func (c *Collector) TaskManager() api.TaskManage {
 	return c.scheduler
 }
 
-// Visit 是对外的接口, 可以访问指定url
-func (c *Collector) Visit(rawUrl string) error {
+// Visit 是对外的接口, 可以访问指定url, opts可以设置请求方法和请求体等
+func (c *Collector) Visit(rawUrl string, opts ...task.Option) error {
 	logx.Infof("[collector] Visit url: %v", rawUrl)
 	if len(rawUrl) == 0 {
 		return errors.New("rawUrl is empty")
@@ -81,31 +129,34 @@ func (c *Collector) Visit(rawUrl string) error {
 		logx.Warnf("[collector] new schedule failed with parse url(%v): %v", rawUrl, err)
 		return err
 	}
-	return c.visit(nil, "", rawUrl, true)
+	return c.visit(nil, "", rawUrl, true, opts...)
 }
 
 // Download 下载保存, todo: 移动到parsing中
-func (c *Collector) Download(t *task.Task, name, path string, urlRaw string) error {
+func (c *Collector) Download(t *task.Task, name, path string, urlRaw string, opts ...task.Option) error {
 	if _, err := url.Parse(urlRaw); err != nil {
 		logx.Warnf("[schedule] new schedule failed with parse url(%v): %v", urlRaw, err)
 		return errors.New("未能识别的URL")
 	}
-	return c.scheduler.AddTask(task.NewTask(name, t, urlRaw, c.save).
-		SetPriority(1).SetMeta(task.MetaSavePath, path).SetMeta("save_name", name))
+	return c.scheduler.AddTask(task.NewTask(name, t, urlRaw, c.save, opts...).
+		SetPriority(1).SetMeta(task.MetaSavePath, path).SetMeta("save_name", name).
+		SetMeta(task.MetaCallback, CallbackSave))
 }
 
-func (c *Collector) visit(parent *task.Task, name, url string, resetDepth bool) error {
-	if err := c.filter(url); err != nil {
-		logx.Warnf("[collector] filter url(%s) cause by: %v", url, err)
-		return err
-	}
-	t := task.NewTask(name, parent, url, c.parsing, task.AddOnCreatedHandler(
+// visit 创建解析页面的任务, opts可以修改URL和请求, 因此在创建之后去重
+func (c *Collector) visit(parent *task.Task, name, url string, resetDepth bool, opts ...task.Option) error {
+	opts = append(opts, task.AddOnCreatedHandler(
 		func(task *task.Task) {
 			if resetDepth {
 				task.Depth = 0
 			}
 		}))
-
+	t := task.NewTask(name, parent, url, c.parsing, opts...)
+	t.SetMeta(task.MetaCallback, CallbackParsing)
+	if err := c.filter(t.Url, t.Request.Signature()); err != nil {
+		logx.Warnf("[collector] filter %s url(%s) cause by: %v", t.Request.GetMethod(), t.Url, err)
+		return err
+	}
 	return c.AddTask(t)
 }
 
@@ -117,21 +168,41 @@ func (c *Collector) AddTask(t *task.Task) error {
 	return c.scheduler.AddTask(t)
 }
 
+// RestoreTask 根据Meta中记录的回调名称重新绑定Callback, 并将其标记为已访问
+func (c *Collector) RestoreTask(t *task.Task) error {
+	name, _ := t.Meta[task.MetaCallback].(string)
+	switch name {
+	case CallbackParsing, "":
+		t.Callback = c.parsing
+	case CallbackSave:
+		t.Callback = c.save
+	default:
+		return fmt.Errorf("unknown callback: %s", name)
+	}
+	c.recordVisit(t.Url, t.Request.Signature())
+	return nil
+}
+
 // 回调函数: 处理抓取到的页面
 func (c *Collector) parsing(task *task.Task, resp *types.ResponseWarp) error {
 	logx.Debugf("[collector] Task[%08x] parsing response", task.ID)
 	c.handleOnHtml(task, resp)
-	c.recordVisit(resp.Request.URL.String())
 	logx.Infof("[collector] Task[%08x] parsing and handle done.", task.ID)
 	return nil
 }
 
 // 回调函数: 保存文件
 func (c *Collector) save(t *task.Task, resp *types.ResponseWarp) error {
-	name := t.Meta[task.MetaSaveName].(string)
-	path := t.Meta[task.MetaSavePath].(string)
+	name, _ := t.Meta[task.MetaSaveName].(string)
+	path, _ := t.Meta[task.MetaSavePath].(string)
+	if name == "" || path == "" {
+		return fmt.Errorf("task without save name or path")
+	}
 
 	logx.Infof("[collector] Task[%x] save file \"%s\" to: %s", t.ID, name, path)
+	if resp.File != "" {
+		return fileutil.MoveFile(resp.File, path, name)
+	}
 	return fileutil.SaveImage(resp.Body, path, name)
 }
 
@@ -154,31 +225,58 @@ func (c *Collector) handleOnHtml(task *task.Task, resp *types.ResponseWarp) {
 	}
 }
 
-// @return ok: 是否继续
-func (c *Collector) filter(url string) error {
-	if c.isVisited(url) {
+// filter 检查并记录请求, 已记录过时返回错误; sig为请求的Signature, 区分相同URL的不同请求.
+// 检查和记录是原子的, 并发的回调不会重复添加相同的请求; 在加入队列之前记录, 加入失败(如超过最大深度)的请求不会再次添加.
+// 增量重爬的URL只在本次爬取中去重, 之前爬取过的在到期后才会再次添加.
+func (c *Collector) filter(url, sig string) error {
+	if recrawl := c.scheduler.Recrawler(); recrawl.Tracked(url, sig) {
+		if !recrawl.Due(url) || c.visited.SeenOrRecordCrawl(url, sig) {
+			return fmt.Errorf("the URL has been browsed")
+		}
+		return nil
+	}
+	if c.visited.SeenOrRecord(url, sig) {
 		return fmt.Errorf("the URL has been browsed")
 	}
 	return nil
 }
 
-func (c *Collector) recordVisit(url string) {
-	c.visitedMutex.Lock()
-	defer c.visitedMutex.Unlock()
-	if c.config.Persistent {
-		c.store.Visit(url)
+// recordVisit 记录请求, 之后相同(规范化后)的URL和请求不会再次添加, 增量重爬的URL除外
+func (c *Collector) recordVisit(url, sig string) {
+	if c.scheduler.Recrawler().Tracked(url, sig) {
+		c.visited.RecordCrawl(url, sig)
+		return
 	}
-	c.visitedList[url] = true
+	c.visited.Record(url, sig)
 }
 
-func (c *Collector) isVisited(url string) bool {
-	c.visitedMutex.Lock()
-	defer c.visitedMutex.Unlock()
-	b, ok := c.visitedList[url]
-	if ok {
-		return b
+// newVisited 根据配置选择记录已访问URL的Store, 未指定时persistent为true使用redis, 否则使用storage
+func newVisited(config *config.Config, db storage.Storage) (*dedup.Filter, error) {
+	kind := config.Dedup.Store
+	if kind == "" {
+		kind = "sql"
+		if config.Persistent {
+			kind = "redis"
+		}
+	}
+	var store dedup.Store
+	switch kind {
+	case "redis":
+		rs, err := storage.NewRedisStore(config.Redis.Addr)
+		if err != nil {
+			return nil, errors.New("connect redis failed")
+		}
+		store = rs
+	case "memory":
+		store = dedup.NewMemoryStore()
+	default:
+		s, err := dedup.NewSQLStore(db.GetDB())
+		if err != nil {
+			return nil, err
+		}
+		store = s
 	}
-	return false
+	return dedup.NewFilter(config.Dedup, store)
 }
 
 func (c *Collector) GetDataProducer() model.DataProducer {
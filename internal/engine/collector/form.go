@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Submit 提交当前元素所在的<form>, values覆盖表单中的同名字段.
+// 按表单的method和enctype创建新任务, GET时字段合并到action的查询参数中.
+func (e *HTMLElement) Submit(name string, values url.Values, opts ...task.Option) error {
+	form := e.DOM.FilterNodes(e.Node).Closest("form")
+	if form.Length() == 0 {
+		return fmt.Errorf("element is not in a form")
+	}
+	action, _ := form.Attr("action")
+	base := e.Request.BaseURL
+	if base == nil {
+		base = e.Request.URL
+	}
+	u, err := base.Parse(action)
+	if err != nil {
+		return err
+	}
+	u.Fragment = ""
+
+	fields := FormValues(form)
+	for k, v := range values {
+		fields[k] = v
+	}
+	method, _ := form.Attr("method")
+	enctype, _ := form.Attr("enctype")
+	switch {
+	case !strings.EqualFold(method, http.MethodPost):
+		opts = append(opts, task.WithQuery(fields))
+	case strings.EqualFold(enctype, "multipart/form-data"):
+		opts = append(opts, task.WithMethod(http.MethodPost), task.WithMultipart(fields, nil))
+	default:
+		opts = append(opts, task.WithMethod(http.MethodPost), task.WithForm(fields))
+	}
+	logx.Infof("[parsing] Task[%x] submit form to: %v", e.task.ID, u.String())
+	return e.Collector.visit(e.task, name, u.String(), false, opts...)
+}
+
+// FormValues 按浏览器的规则收集表单中会被提交的字段, 忽略禁用的字段, 按钮和文件
+func FormValues(form *goquery.Selection) url.Values {
+	values := url.Values{}
+	form.Find("input, select, textarea").Each(func(_ int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		if _, disabled := s.Attr("disabled"); name == "" || disabled {
+			return
+		}
+		switch goquery.NodeName(s) {
+		case "input":
+			typ, _ := s.Attr("type")
+			switch strings.ToLower(typ) {
+			case "submit", "button", "image", "reset", "file":
+				return
+			case "checkbox", "radio":
+				if _, checked := s.Attr("checked"); !checked {
+					return
+				}
+				values.Add(name, s.AttrOr("value", "on"))
+			default:
+				values.Add(name, s.AttrOr("value", ""))
+			}
+		case "textarea":
+			values.Add(name, s.Text())
+		case "select":
+			_, multiple := s.Attr("multiple")
+			selected := s.Find("option[selected]")
+			if selected.Length() == 0 && !multiple {
+				selected = s.Find("option").First()
+			}
+			if !multiple {
+				selected = selected.First()
+			}
+			selected.Each(func(_ int, o *goquery.Selection) {
+				values.Add(name, o.AttrOr("value", strings.TrimSpace(o.Text())))
+			})
+		}
+	})
+	return values
+}
@@ -1,8 +1,10 @@
 package collector
 
 import (
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/item"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
 	"github.com/xiaorui77/monker-king/internal/engine/types"
 	"golang.org/x/net/html"
@@ -37,7 +39,8 @@ func NewHTMLElement(t *task.Task, collector *Collector, resp *types.ResponseWarp
 	}
 }
 
-func (e *HTMLElement) Visit(name, u string, resetDepth bool) error {
+// Visit 访问子链接, opts可设置新任务的meta等, 如task.WithMeta(task.MetaFetcher, "render")
+func (e *HTMLElement) Visit(name, u string, resetDepth bool, opts ...task.Option) error {
 	logx.Infof("[Parsing] Task[%x] continue Visit url: %v", e.task.ID, u)
 	URL, err := e.Request.URL.Parse(u)
 	if err != nil {
@@ -49,7 +52,22 @@ func (e *HTMLElement) Visit(name, u string, resetDepth bool) error {
 		URL.Scheme = e.Request.URL.Scheme
 	}
 	logx.Infof("[parsing] Task[%x] add sub task: %v", e.task.ID, URL.String())
-	return e.Collector.visit(e.task, name, URL.String(), resetDepth)
+	return e.Collector.visit(e.task, name, URL.String(), resetDepth, opts...)
+}
+
+// GetAttr 返回当前元素指定属性的值, 不存在时返回空
+func (e *HTMLElement) GetAttr(key string) string {
+	for _, attr := range e.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// Text 返回当前元素的文本
+func (e *HTMLElement) Text() string {
+	return goquery.NewDocumentFromNode(e.Node).Text()
 }
 
 func (e *HTMLElement) GetText(selector, def string) string {
@@ -58,3 +76,32 @@ func (e *HTMLElement) GetText(selector, def string) string {
 	}
 	return def
 }
+
+// Extract 根据声明的Schema从当前元素中提取Item
+func (e *HTMLElement) Extract(schema string) (*item.Item, error) {
+	s := e.Collector.pipeline.Schema(schema)
+	if s == nil {
+		return nil, fmt.Errorf("item %s is not declared", schema)
+	}
+	it, err := s.Extract(e.Doc, e.DOM.FilterNodes(e.Node), e.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+	it.TaskId = e.task.ID
+	return it, nil
+}
+
+// Emit 将Item发送到处理管道
+func (e *HTMLElement) Emit(it *item.Item) error {
+	return e.Collector.pipeline.Emit(it)
+}
+
+// EmitItem 提取并发送Item
+func (e *HTMLElement) EmitItem(schema string) error {
+	it, err := e.Extract(schema)
+	if err != nil {
+		logx.Warnf("[parsing] Task[%x] extract item failed: %v", e.task.ID, err)
+		return err
+	}
+	return e.Emit(it)
+}
@@ -0,0 +1,42 @@
+package collector
+
+import (
+	"math"
+
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/sitemap"
+)
+
+// VisitSitemap 从sitemap中发现URL并作为根任务添加到对应的Browser, sitemap中的priority决定任务的优先级.
+// 参数校验失败时立即返回错误, 获取和解析在Collector运行后于后台进行.
+func (c *Collector) VisitSitemap(opts *sitemap.Options) error {
+	s, err := sitemap.NewSeeder(opts, c.scheduler.Fetch)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-c.running
+		n, err := s.Run(c.ctx, func(e *sitemap.Entry) error {
+			if err := c.ctx.Err(); err != nil {
+				return err
+			}
+			if c.filter(e.Loc, "") != nil {
+				return sitemap.ErrSkip
+			}
+			t := task.NewTask("", nil, e.Loc, c.parsing).SetPriority(sitemapPriority(e.Priority))
+			t.SetMeta(task.MetaCallback, CallbackParsing)
+			return c.AddTask(t)
+		})
+		if err != nil {
+			logx.Warnf("[collector] visit sitemap of %v stopped: %v", opts.Site, err)
+		}
+		logx.Infof("[collector] visit sitemap of %v done, %d urls added", opts.Site, n)
+	}()
+	return nil
+}
+
+// sitemapPriority 将sitemap中0.0~1.0的priority映射为任务优先级0~10
+func sitemapPriority(p float64) int {
+	return int(math.Round(p * 10))
+}
@@ -0,0 +1,135 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+var bloomMagic = [4]byte{'M', 'K', 'B', 'F'}
+
+// Bloom 布隆过滤器, 不在其中的key一定未出现过
+type Bloom struct {
+	bits []uint64
+	m    uint64 // 位数
+	k    uint32 // 哈希函数个数
+}
+
+// NewBloom 根据预计的元素数量n和误判率p计算大小
+func NewBloom(n uint64, p float64) *Bloom {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &Bloom{bits: make([]uint64, m/64), m: m, k: k}
+}
+
+// locations 使用双重哈希由key的前16字节得到k个位置, key应为均匀分布的哈希值
+func (b *Bloom) locations(key []byte, fn func(i uint64) bool) bool {
+	var buf [16]byte
+	copy(buf[:], key)
+	h1 := binary.BigEndian.Uint64(buf[:8])
+	h2 := binary.BigEndian.Uint64(buf[8:]) | 1
+	for i := uint32(0); i < b.k; i++ {
+		if !fn((h1 + uint64(i)*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bloom) Add(key []byte) {
+	b.locations(key, func(i uint64) bool {
+		b.bits[i/64] |= 1 << (i % 64)
+		return true
+	})
+}
+
+func (b *Bloom) Test(key []byte) bool {
+	return b.locations(key, func(i uint64) bool {
+		return b.bits[i/64]&(1<<(i%64)) != 0
+	})
+}
+
+// Save 写入到文件, 先写临时文件再重命名
+func (b *Bloom) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := b.write(w); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (b *Bloom) write(w io.Writer) error {
+	if _, err := w.Write(bloomMagic[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, b.m); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, b.k); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, b.bits)
+}
+
+// LoadBloom 从文件中加载
+func LoadBloom(path string) (*Bloom, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != bloomMagic {
+		return nil, fmt.Errorf("%v is not a bloom filter file", path)
+	}
+	b := &Bloom{}
+	if err := binary.Read(r, binary.BigEndian, &b.m); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &b.k); err != nil {
+		return nil, err
+	}
+	if b.m == 0 || b.m%64 != 0 || b.k == 0 {
+		return nil, fmt.Errorf("invalid bloom filter file %v", path)
+	}
+	b.bits = make([]uint64, b.m/64)
+	if err := binary.Read(r, binary.BigEndian, b.bits); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,101 @@
+package dedup
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Canonicalizer 将URL规范化, 使等价的URL得到相同的结果
+type Canonicalizer struct {
+	exact  map[string]bool // 去除的查询参数
+	prefix []string        // 以*结尾的参数前缀, 如utm_*
+}
+
+// NewCanonicalizer strip为需要去除的查询参数, 以*结尾时按前缀匹配
+func NewCanonicalizer(strip []string) *Canonicalizer {
+	c := &Canonicalizer{exact: map[string]bool{}}
+	for _, p := range strip {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if strings.HasSuffix(p, "*") {
+			c.prefix = append(c.prefix, strings.TrimSuffix(p, "*"))
+		} else {
+			c.exact[p] = true
+		}
+	}
+	return c
+}
+
+// Canonical 规范化URL: scheme和host转为小写, 去除默认端口和片段, 空路径补为/,
+// 去除指定的查询参数并按参数名和值排序.
+func (c *Canonicalizer) Canonical(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", fmt.Errorf("not an absolute url: %v", raw)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.Fragment, u.RawFragment = "", ""
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", ""
+	}
+	u.RawQuery = c.query(u.RawQuery)
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+func (c *Canonicalizer) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		// 无法解析时保持原样
+		return raw
+	}
+	for key := range values {
+		if c.stripped(key) {
+			delete(values, key)
+		}
+	}
+	for _, vs := range values {
+		sort.Strings(vs)
+	}
+	// Encode按参数名排序
+	return values.Encode()
+}
+
+func (c *Canonicalizer) stripped(key string) bool {
+	key = strings.ToLower(key)
+	if c.exact[key] {
+		return true
+	}
+	for _, p := range c.prefix {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package dedup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// Filter 判断URL是否已访问. URL规范化后取128位哈希,
+// 先查询内存中的Bloom filter, 可能存在时再由Store确认, 内存占用只与Bloom filter的大小有关.
+type Filter struct {
+	canon     *Canonicalizer
+	store     Store
+	bloomFile string
+
+	// recordMu 使检查和记录是原子的, Record和SeenOrRecord需要持有
+	recordMu sync.Mutex
+	mu       sync.RWMutex
+	bloom    *Bloom
+	// crawl 本次爬取(进程启动后)通过RecordCrawl记录的请求, 用于区分"本次爬取已访问"和"曾经访问过".
+	// 只记录增量重爬的URL, 数量由重爬规则限制
+	crawl map[string]struct{}
+}
+
+// NewFilter 优先从BloomFile加载Bloom filter, 不存在或损坏时从Store重建.
+// 加载后会删除该文件, 正常Close时再写入, 避免异常退出后使用过期的Bloom filter.
+func NewFilter(conf config.DedupConfig, store Store) (*Filter, error) {
+	f := &Filter{
+		canon:     NewCanonicalizer(conf.StripParams),
+		store:     store,
+		bloomFile: conf.BloomFile,
+		crawl:     map[string]struct{}{},
+	}
+	if conf.BloomFile != "" {
+		b, err := LoadBloom(conf.BloomFile)
+		if err == nil {
+			logx.Infof("[dedup] load bloom filter from %v", conf.BloomFile)
+			f.bloom = b
+			if err := os.Remove(conf.BloomFile); err != nil {
+				logx.Warnf("[dedup] remove bloom filter file failed: %v", err)
+			}
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			logx.Warnf("[dedup] load bloom filter from %v failed, will rebuild: %v", conf.BloomFile, err)
+		}
+	}
+
+	f.bloom = NewBloom(uint64(conf.ExpectedURLs), conf.FalsePositive)
+	n := 0
+	err := store.Visited(func(key string) {
+		if k, err := hex.DecodeString(key); err == nil {
+			f.bloom.Add(k)
+			n++
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rebuild bloom filter failed: %v", err)
+	}
+	logx.Infof("[dedup] bloom filter built with %d visited urls", n)
+	return f, nil
+}
+
+// Canonical 返回规范化的URL, 无法解析时返回原值
+func (f *Filter) Canonical(raw string) string {
+	if c, err := f.canon.Canonical(raw); err == nil {
+		return c
+	}
+	return raw
+}
+
+// key sig不为空时与URL一起计算, 为空时与只按URL记录的结果一致
+func (f *Filter) key(raw, sig string) []byte {
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(f.Canonical(raw)))
+	if sig != "" {
+		_, _ = h.Write([]byte("\n" + sig))
+	}
+	return h.Sum(nil)
+}
+
+// Seen 判断请求是否曾经记录过(包括之前的爬取), sig区分相同URL的不同请求(方法和请求体), 不带请求体的GET为空
+func (f *Filter) Seen(raw, sig string) bool {
+	return f.seen(f.key(raw, sig))
+}
+
+func (f *Filter) seen(key []byte) bool {
+	f.mu.RLock()
+	maybe := f.bloom.Test(key)
+	f.mu.RUnlock()
+	if !maybe {
+		return false
+	}
+	return f.store.IsVisited(hex.EncodeToString(key))
+}
+
+// Record 记录请求, sig同Seen
+func (f *Filter) Record(raw, sig string) {
+	f.recordMu.Lock()
+	defer f.recordMu.Unlock()
+	f.record(f.key(raw, sig))
+}
+
+// SeenOrRecord 请求曾经记录过时返回true, 否则记录并返回false. 并发调用时相同的请求只有一个返回false; sig同Seen
+func (f *Filter) SeenOrRecord(raw, sig string) bool {
+	key := f.key(raw, sig)
+	f.recordMu.Lock()
+	defer f.recordMu.Unlock()
+	if f.seen(key) {
+		return true
+	}
+	f.record(key)
+	return false
+}
+
+// RecordCrawl 记录请求, 同时记录为本次爬取中已访问, 只用于增量重爬的URL; sig同Seen
+func (f *Filter) RecordCrawl(raw, sig string) {
+	f.SeenOrRecordCrawl(raw, sig)
+}
+
+// SeenOrRecordCrawl 请求在本次爬取中记录过时返回true, 否则通过RecordCrawl记录并返回false; sig同Seen
+func (f *Filter) SeenOrRecordCrawl(raw, sig string) bool {
+	key := f.key(raw, sig)
+	f.recordMu.Lock()
+	defer f.recordMu.Unlock()
+	f.mu.RLock()
+	_, ok := f.crawl[hex.EncodeToString(key)]
+	f.mu.RUnlock()
+	if ok {
+		return true
+	}
+	f.mu.Lock()
+	f.crawl[hex.EncodeToString(key)] = struct{}{}
+	f.mu.Unlock()
+	f.record(key)
+	return false
+}
+
+// record 需要持有recordMu
+func (f *Filter) record(key []byte) {
+	f.mu.Lock()
+	f.bloom.Add(key)
+	f.mu.Unlock()
+	f.store.Visit(hex.EncodeToString(key))
+}
+
+// Close 将Bloom filter写入BloomFile
+func (f *Filter) Close() error {
+	if f.bloomFile == "" {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if err := f.bloom.Save(f.bloomFile); err != nil {
+		return fmt.Errorf("save bloom filter failed: %v", err)
+	}
+	logx.Infof("[dedup] bloom filter saved to %v", f.bloomFile)
+	return nil
+}
@@ -0,0 +1,161 @@
+package dedup
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/storage"
+)
+
+func TestCanonical(t *testing.T) {
+	c := NewCanonicalizer([]string{"utm_*", "gclid"})
+	cases := map[string]string{
+		"HTTP://Example.COM":                           "http://example.com/",
+		"https://example.com:443/a?b=2&a=1#top":        "https://example.com/a?a=1&b=2",
+		"http://example.com:8080/a?x=2&x=1":            "http://example.com:8080/a?x=1&x=2",
+		"https://example.com/a?utm_source=x&id=1":      "https://example.com/a?id=1",
+		"https://example.com/a?UTM_Medium=x&gclid=abc": "https://example.com/a",
+		"https://[::1]:443/a":                          "https://[::1]/a",
+	}
+	for raw, expect := range cases {
+		if got, err := c.Canonical(raw); err != nil || got != expect {
+			t.Errorf("%s: expect %s, but %s, %v", raw, expect, got, err)
+		}
+	}
+	if _, err := c.Canonical("/relative/path"); err == nil {
+		t.Errorf("relative url should be rejected")
+	}
+}
+
+func TestBloom(t *testing.T) {
+	b := NewBloom(10000, 0.01)
+	key := func(i int) []byte {
+		h := sha1.Sum([]byte(fmt.Sprint(i)))
+		return h[:]
+	}
+	for i := 0; i < 10000; i++ {
+		b.Add(key(i))
+	}
+	for i := 0; i < 10000; i++ {
+		if !b.Test(key(i)) {
+			t.Fatalf("added key %d not found", i)
+		}
+	}
+	fp := 0
+	for i := 10000; i < 20000; i++ {
+		if b.Test(key(i)) {
+			fp++
+		}
+	}
+	if fp > 300 {
+		t.Errorf("false positive rate too high: %d/10000", fp)
+	}
+
+	path := filepath.Join(t.TempDir(), "visited.bloom")
+	if err := b.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBloom(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.m != b.m || loaded.k != b.k || !loaded.Test(key(1)) {
+		t.Errorf("loaded bloom mismatch")
+	}
+}
+
+func TestFilter_Rebuild(t *testing.T) {
+	db, err := storage.NewStorage(config.StorageConfig{Driver: storage.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSQLStore(db.GetDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Default().Dedup
+	f, err := NewFilter(conf, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Record("https://Example.com/a?b=1&a=2&utm_source=x", "")
+	if !f.Seen("https://example.com:443/a?a=2&b=1", "") {
+		t.Errorf("equivalent url should be seen")
+	}
+	if f.Seen("https://example.com/b", "") {
+		t.Errorf("unknown url should not be seen")
+	}
+	// 相同URL的不同请求体分别记录
+	f.Record("https://example.com/search", "POST\nform:q=a")
+	if f.Seen("https://example.com/search", "") || f.Seen("https://example.com/search", "POST\nform:q=b") {
+		t.Errorf("requests with different method or body should not be seen")
+	}
+	if !f.Seen("https://example.com/search", "POST\nform:q=a") {
+		t.Errorf("same request should be seen")
+	}
+
+	// 重启后从Store重建
+	f2, err := NewFilter(conf, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f2.Seen("https://example.com/a?a=2&b=1", "") {
+		t.Errorf("visited url should be seen after rebuild")
+	}
+	// 只有RecordCrawl记录的请求属于本次爬取; 之前爬取中访问过, 但本次爬取中未访问
+	f.RecordCrawl("https://example.com/list", "")
+	if f.SeenOrRecordCrawl("https://example.com/a?a=2&b=1", "") || !f.SeenOrRecordCrawl("https://example.com/list", "") {
+		t.Errorf("only urls recorded by RecordCrawl should be seen in this crawl")
+	}
+	if len(f.crawl) != 2 || !f.Seen("https://example.com/list", "") {
+		t.Errorf("unexpected crawl records: %d", len(f.crawl))
+	}
+	if f2.SeenOrRecordCrawl("https://example.com/list", "") {
+		t.Errorf("url should only be seen in the crawl recording it")
+	}
+
+	// 从BloomFile加载
+	conf.BloomFile = filepath.Join(t.TempDir(), "visited.bloom")
+	f2.bloomFile = conf.BloomFile
+	if err := f2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f3, err := NewFilter(conf, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f3.bloom.Test(f3.key("https://example.com/a?a=2&b=1", "")) {
+		t.Errorf("bloom filter should be loaded from file")
+	}
+}
+
+func TestFilter_SeenOrRecord(t *testing.T) {
+	f, err := NewFilter(config.Default().Dedup, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// 等价的URL只有一个可以记录
+			if !f.SeenOrRecord(fmt.Sprintf("https://example.com/a?utm_source=%d", i), "") {
+				atomic.AddInt32(&recorded, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if recorded != 1 {
+		t.Errorf("expect 1 recorded, got %d", recorded)
+	}
+	if !f.Seen("https://example.com/a", "") {
+		t.Errorf("recorded url should be seen")
+	}
+}
@@ -0,0 +1,97 @@
+package dedup
+
+import (
+	"github.com/xiaorui77/goutils/logx"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// Store 精确记录已访问URL的哈希, 用于确认Bloom filter的结果
+type Store interface {
+	Visit(key string)
+	IsVisited(key string) bool
+	// Visited 遍历所有已记录的key, 用于重建Bloom filter
+	Visited(fn func(key string)) error
+}
+
+// memoryStore 进程内的Store, 退出即丢失
+type memoryStore struct {
+	mu   sync.RWMutex
+	keys map[string]struct{}
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{keys: map[string]struct{}{}}
+}
+
+func (s *memoryStore) Visit(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = struct{}{}
+}
+
+func (s *memoryStore) IsVisited(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.keys[key]
+	return ok
+}
+
+func (s *memoryStore) Visited(fn func(key string)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key := range s.keys {
+		fn(key)
+	}
+	return nil
+}
+
+// Visited 已访问URL的哈希
+type Visited struct {
+	Hash      string `gorm:"primaryKey;size:32"`
+	CreatedAt time.Time
+}
+
+func (Visited) TableName() string {
+	return "visited"
+}
+
+// sqlStore 记录在visited表中
+type sqlStore struct {
+	db *gorm.DB
+}
+
+func NewSQLStore(db *gorm.DB) (Store, error) {
+	if err := db.AutoMigrate(&Visited{}); err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) Visit(key string) {
+	err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&Visited{Hash: key}).Error
+	if err != nil {
+		logx.Warnf("[dedup] record visited %s failed: %v", key, err)
+	}
+}
+
+func (s *sqlStore) IsVisited(key string) bool {
+	var n int64
+	if err := s.db.Model(&Visited{}).Where("hash = ?", key).Count(&n).Error; err != nil {
+		logx.Warnf("[dedup] query visited %s failed: %v", key, err)
+		return false
+	}
+	return n > 0
+}
+
+func (s *sqlStore) Visited(fn func(key string)) error {
+	var rows []*Visited
+	return s.db.Model(&Visited{}).Select("hash").FindInBatches(&rows, 10000, func(tx *gorm.DB, batch int) error {
+		for _, row := range rows {
+			fn(row.Hash)
+		}
+		return nil
+	}).Error
+}
@@ -0,0 +1,243 @@
+package download
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/dedup"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheEntry 缓存的响应, 与响应体保存在同一个文件中: 第一行为JSON, 之后为响应体
+type cacheEntry struct {
+	URL          string      `json:"url"`
+	StatusCode   int         `json:"statusCode"`
+	Header       http.Header `json:"header"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"lastModified,omitempty"`
+	StoredAt     time.Time   `json:"storedAt"`
+	// Expires respect策略下在此之前直接使用缓存, 不发送请求
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// conditional 设置条件请求的请求头
+func (e *cacheEntry) conditional(req *http.Request) {
+	if e.ETag != "" {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+	if e.LastModified != "" {
+		req.Header.Set("If-Modified-Since", e.LastModified)
+	}
+}
+
+// update 使用响应头更新缓存, 304响应中没有的头保持不变
+func (e *cacheEntry) update(h http.Header, now time.Time) {
+	for k, v := range h {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		e.Header[k] = v
+	}
+	e.ETag, e.LastModified = e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+	e.StoredAt, e.Expires = now, freshUntil(e.Header, now)
+}
+
+// cache 按规范化URL保存在磁盘上的HTTP缓存, 只缓存不带请求体的GET
+type cache struct {
+	conf      config.CacheConfig
+	canonical *dedup.Canonicalizer
+}
+
+// newCache 未配置目录时返回nil, 此时所有域名的策略均为never
+func newCache(conf config.CacheConfig) *cache {
+	if conf.Dir == "" {
+		return nil
+	}
+	logx.Infof("[cache] response cache in %s, policy: %s", conf.Dir, conf.Policy)
+	return &cache{conf: conf, canonical: dedup.NewCanonicalizer(nil)}
+}
+
+// policy 任务使用的缓存策略, 带请求体的请求和下载任务不缓存
+func (c *cache) policy(t *task.Task) string {
+	if c == nil || t.Request.Signature() != "" {
+		return config.CacheNever
+	}
+	if policy, ok := c.conf.Domains[t.Domain]; ok {
+		return policy
+	}
+	return c.conf.Policy
+}
+
+func (c *cache) path(rawUrl string) (string, error) {
+	canonical, err := c.canonical.Canonical(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(canonical))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.conf.Dir, key[:2], key), nil
+}
+
+// load 读取缓存, 不存在或无法读取时返回nil
+func (c *cache) load(rawUrl string) (*cacheEntry, []byte) {
+	path, err := c.path(rawUrl)
+	if err != nil {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logx.Warnf("[cache] open cache of %s failed: %v", rawUrl, err)
+		}
+		return nil, nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		logx.Warnf("[cache] read cache of %s failed: %v", rawUrl, err)
+		return nil, nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(line, entry); err != nil {
+		logx.Warnf("[cache] invalid cache of %s: %v", rawUrl, err)
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		logx.Warnf("[cache] read cache of %s failed: %v", rawUrl, err)
+		return nil, nil
+	}
+	return entry, body
+}
+
+// store 写入缓存, 先写临时文件再重命名
+func (c *cache) store(rawUrl string, entry *cacheEntry, body []byte) error {
+	path, err := c.path(rawUrl)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.Write(append(line, '\n'))
+	_, _ = w.Write(body)
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// save 按策略缓存成功的响应, respect策略下不缓存no-store
+func (c *cache) save(rawUrl, policy string, res *types.ResponseWarp) {
+	if policy == config.CacheNever || res.StatusCode != http.StatusOK {
+		return
+	}
+	if _, ok := cacheControl(res.Header)["no-store"]; ok && policy == config.CacheRespect {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{URL: rawUrl, StatusCode: res.StatusCode, Header: http.Header{}}
+	entry.update(res.Header, now)
+	if policy != config.CacheRespect {
+		entry.Expires = time.Time{}
+	}
+	if err := c.store(rawUrl, entry, res.Body); err != nil {
+		logx.Warnf("[cache] save cache of %s failed: %v", rawUrl, err)
+	}
+}
+
+// revalidated 304时更新缓存的响应头和过期时间
+func (c *cache) revalidated(rawUrl, policy string, entry *cacheEntry, body []byte, h http.Header) {
+	entry.update(h, time.Now())
+	if policy != config.CacheRespect {
+		entry.Expires = time.Time{}
+	}
+	if err := c.store(rawUrl, entry, body); err != nil {
+		logx.Warnf("[cache] update cache of %s failed: %v", rawUrl, err)
+	}
+}
+
+// replay 使用缓存的响应作为任务的响应
+func (d *Downloader) replay(t *task.Task, req *types.RequestWrap, entry *cacheEntry, body []byte) *types.ResponseWarp {
+	res := &types.ResponseWarp{
+		StatusCode: entry.StatusCode,
+		Header:     entry.Header,
+		Body:       body,
+		Size:       int64(len(body)),
+		Cached:     true,
+		Request:    req,
+	}
+	decodeBody(res, d.charset.Domains[t.Domain], d.charset.Fallback)
+	return res
+}
+
+// freshUntil 按Cache-Control的max-age或Expires计算过期时间, no-cache和没有声明时为零值, 即总是重新验证
+func freshUntil(h http.Header, now time.Time) time.Time {
+	cc := cacheControl(h)
+	if _, ok := cc["no-cache"]; ok {
+		return time.Time{}
+	}
+	if v, ok := cc["max-age"]; ok {
+		age, err := strconv.Atoi(v)
+		if err != nil || age <= 0 {
+			return time.Time{}
+		}
+		return now.Add(time.Duration(age) * time.Second)
+	}
+	expires, err := http.ParseTime(h.Get("Expires"))
+	if err != nil {
+		return time.Time{}
+	}
+	// 使用与服务器时间的差值, 避免时钟不一致
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		return now.Add(expires.Sub(date))
+	}
+	return expires
+}
+
+// cacheControl 解析Cache-Control, 指令名为小写
+func cacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, value := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, value = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = value
+			}
+		}
+	}
+	return cc
+}
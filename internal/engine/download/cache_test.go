@@ -0,0 +1,86 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestDownloader_Cache(t *testing.T) {
+	const etag = `"v1"`
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+	}))
+	defer srv.Close()
+
+	conf := config.Default().Download
+	conf.Cache.Dir = t.TempDir()
+	conf.Cache.Domains = map[string]string{"always.com": config.CacheAlways, "never.com": config.CacheNever}
+	d := NewDownloader(conf)
+	get := func(path, domain string, opts ...task.Option) (string, bool) {
+		tk := task.NewTask("page", nil, srv.URL+path, nil, opts...)
+		tk.Domain = domain
+		resp, err := d.Get(context.Background(), tk)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, resp.StatusCode)
+		}
+		return string(resp.Body), resp.Cached
+	}
+
+	cases := []struct {
+		path, domain          string
+		cached                bool
+		requests, notModified int // 第二次访问后的总数
+	}{
+		{"/page", "", true, 2, 1},            // 重新验证, 304使用缓存
+		{"/fresh", "", true, 1, 0},           // 未过期, 不发送请求
+		{"/nostore", "", false, 2, 0},        // 不缓存
+		{"/fresh", "always.com", true, 2, 1}, // 忽略max-age, 总是发送条件请求
+		{"/nostore", "always.com", true, 2, 1},
+		{"/page", "never.com", false, 2, 0},
+	}
+	for i, c := range cases {
+		requests, notModified = 0, 0
+		conf.Cache.Dir = t.TempDir()
+		d = NewDownloader(conf)
+		if body, cached := get(c.path, c.domain); cached || body != "<p>"+c.path+"</p>" {
+			t.Fatalf("case %d: unexpected first response %q, cached: %v", i, body, cached)
+		}
+		body, cached := get(c.path, c.domain)
+		if cached != c.cached || body != "<p>"+c.path+"</p>" {
+			t.Errorf("case %d: expect cached %v, got %v %q", i, c.cached, cached, body)
+		}
+		if requests != c.requests || notModified != c.notModified {
+			t.Errorf("case %d: expect %d requests and %d 304, got %d and %d", i, c.requests, c.notModified, requests, notModified)
+		}
+	}
+
+	// 带请求体的请求不缓存
+	requests = 0
+	get("/page", "", task.WithForm(map[string][]string{"q": {"monkey"}}))
+	if _, cached := get("/page", "", task.WithForm(map[string][]string{"q": {"monkey"}})); cached || requests != 2 {
+		t.Errorf("request with body should not be cached")
+	}
+}
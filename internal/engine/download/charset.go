@@ -0,0 +1,97 @@
+package download
+
+import (
+	"bytes"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// metaPrescan 在页面开头查找<meta>声明的字符集的字节数
+const metaPrescan = 4096
+
+// metaCharset 匹配<meta charset="gbk">和<meta http-equiv="Content-Type" content="text/html; charset=gbk">
+var metaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_:.\-]+)`)
+
+var boms = []struct {
+	bom  []byte
+	name string
+}{
+	{[]byte{0xEF, 0xBB, 0xBF}, "utf-8"},
+	{[]byte{0xFE, 0xFF}, "utf-16be"},
+	{[]byte{0xFF, 0xFE}, "utf-16le"},
+}
+
+// textual 是否为需要检测字符集的文本内容, 没有Content-Type时视为文本
+func textual(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	return strings.HasPrefix(media, "text/") || strings.Contains(media, "html") ||
+		strings.Contains(media, "xml") || strings.Contains(media, "json") || strings.Contains(media, "javascript")
+}
+
+// detectCharset 按 override > BOM > Content-Type > <meta> > 字节探测 的顺序确定字符集,
+// 没有声明且不是合法的UTF-8时使用fallback. 返回nil表示无需转换.
+func detectCharset(body []byte, contentType, override, fallback string) (encoding.Encoding, string) {
+	labels := []string{override}
+	for _, b := range boms {
+		if bytes.HasPrefix(body, b.bom) {
+			labels = append(labels, b.name)
+		}
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		labels = append(labels, params["charset"])
+	}
+	head := body
+	if len(head) > metaPrescan {
+		head = head[:metaPrescan]
+	}
+	if m := metaCharset.FindSubmatch(head); m != nil {
+		labels = append(labels, string(m[1]))
+	}
+	for _, label := range labels {
+		if label == "" {
+			continue
+		}
+		if e, name := charset.Lookup(label); e != nil {
+			return e, name
+		}
+		logx.Debugf("[downloader] unknown charset %q, ignored", label)
+	}
+	if utf8.Valid(body) {
+		return nil, "utf-8"
+	}
+	e, name := charset.Lookup(fallback)
+	return e, name
+}
+
+// decodeBody 将文本内容转换为UTF-8并记录原始字符集, 转换失败时保留原始内容
+func decodeBody(resp *types.ResponseWarp, override, fallback string) {
+	contentType := resp.Header.Get("Content-Type")
+	if !textual(contentType) || len(resp.Body) == 0 {
+		return
+	}
+	e, name := detectCharset(resp.Body, contentType, override, fallback)
+	resp.Charset = name
+	if e == nil || e == encoding.Nop || name == "utf-8" {
+		resp.Body = bytes.TrimPrefix(resp.Body, boms[0].bom)
+		return
+	}
+	body, err := e.NewDecoder().Bytes(resp.Body)
+	if err != nil {
+		logx.Warnf("[downloader] decode %s from %s failed, keep raw body: %v", resp.Request.URL, name, err)
+		return
+	}
+	// UTF-16的BOM转换后为U+FEFF
+	resp.Body = bytes.TrimPrefix(body, boms[0].bom)
+}
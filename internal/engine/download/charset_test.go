@@ -0,0 +1,70 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+func TestDownloader_Charset(t *testing.T) {
+	encode := func(e encoding.Encoding, s string) string {
+		b, err := e.NewEncoder().String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	pages := map[string][2]string{ // path -> Content-Type, body
+		"/header": {"text/html; charset=GBK", encode(simplifiedchinese.GBK, "<p>美猴王</p>")},
+		"/meta":   {"text/html", encode(simplifiedchinese.GBK, `<meta charset="gb2312"><p>美猴王</p>`)},
+		"/equiv":  {"", encode(traditionalchinese.Big5, `<meta http-equiv="Content-Type" content="text/html; charset=big5"><p>美猴王</p>`)},
+		"/sniff":  {"text/html", encode(simplifiedchinese.GB18030, "<p>美猴王</p>")},
+		"/utf8":   {"text/html", "\xEF\xBB\xBF<p>美猴王</p>"},
+		"/binary": {"image/png", "\x89PNG\xb5"},
+		"/wrong":  {"text/html; charset=utf-8", encode(simplifiedchinese.GBK, "<p>美猴王</p>")},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := pages[r.URL.Path]
+		if page[0] != "" {
+			w.Header().Set("Content-Type", page[0])
+		} else {
+			w.Header()["Content-Type"] = nil
+		}
+		_, _ = w.Write([]byte(page[1]))
+	}))
+	defer srv.Close()
+
+	conf := config.Default().Download
+	conf.Charset.Domains = map[string]string{"override.com": "gbk"}
+	d := NewDownloader(conf)
+	cases := []struct {
+		path, domain, charset, body string
+	}{
+		{"/header", "", "gbk", "<p>美猴王</p>"},
+		{"/meta", "", "gbk", `<meta charset="gb2312"><p>美猴王</p>`},
+		{"/equiv", "", "big5", `<meta http-equiv="Content-Type" content="text/html; charset=big5"><p>美猴王</p>`},
+		{"/sniff", "", "gb18030", "<p>美猴王</p>"},
+		{"/utf8", "", "utf-8", "<p>美猴王</p>"},
+		{"/binary", "", "", "\x89PNG\xb5"},
+		// 域名配置优先于响应中的声明
+		{"/wrong", "override.com", "gbk", "<p>美猴王</p>"},
+	}
+	for _, c := range cases {
+		tk := task.NewTask("page", nil, srv.URL+c.path, nil)
+		tk.Domain = c.domain
+		resp, err := d.Get(context.Background(), tk)
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		if resp.Charset != c.charset || string(resp.Body) != c.body {
+			t.Errorf("%s: expect %s %q, got %s %q", c.path, c.charset, c.body, resp.Charset, resp.Body)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package download
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AcceptEncoding 普通请求协商的压缩方式, 响应由uncompress流式解压
+const AcceptEncoding = "gzip, deflate, br, zstd"
+
+// ErrTooLarge 解压后的响应体超过上限, 用于防止压缩炸弹
+var ErrTooLarge = errors.New("decoded body exceeds the size limit")
+
+// uncompress 按Content-Encoding流式解压body, 多个编码按相反的顺序解压.
+// limit大于0时解压后的内容超过limit字节返回ErrTooLarge; 不支持的编码返回错误.
+func uncompress(body io.Reader, encoding string, limit int64) (io.Reader, error) {
+	encodings := strings.Split(encoding, ",")
+	r, compressed := body, false
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[i])); enc {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(r)
+		case "deflate":
+			r, err = newDeflateReader(r)
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			var dec *zstd.Decoder
+			if dec, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1)); err == nil {
+				r = dec.IOReadCloser()
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", enc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode %s failed: %v", encodings[i], err)
+		}
+		compressed = true
+	}
+	if !compressed || limit <= 0 {
+		return r, nil
+	}
+	return &limitReader{Reader: r, remain: limit}, nil
+}
+
+// newDeflateReader HTTP的deflate应为zlib格式, 部分服务器发送不带zlib头的raw deflate
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// zlib头: CM为8, 且前两个字节按大端序是31的倍数
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// decoded 解压后删除响应中与传输相关的头, ContentLength未知
+func decoded(resp *http.Response) {
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// limitReader 与io.LimitReader不同, 超过限制时返回ErrTooLarge而不是io.EOF
+type limitReader struct {
+	io.Reader
+	remain int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.remain < 0 {
+		return 0, ErrTooLarge
+	}
+	// 多读取一个字节以判断是否超过限制
+	if int64(len(p)) > l.remain+1 {
+		p = p[:l.remain+1]
+	}
+	n, err := l.Reader.Read(p)
+	l.remain -= int64(n)
+	if l.remain < 0 {
+		return n + int(l.remain), ErrTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,118 @@
+package download
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestDownloader_Compress(t *testing.T) {
+	page := strings.Repeat("<p>monkey king</p>", 1000)
+	compress := func(encoding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "raw-deflate":
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "zstd":
+			w, _ = zstd.NewWriter(&buf)
+		}
+		_, _ = w.Write(data)
+		_ = w.Close()
+		return buf.Bytes()
+	}
+	var accepted string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch enc := strings.TrimPrefix(r.URL.Path, "/"); enc {
+		case "identity":
+			_, _ = w.Write([]byte(page))
+		case "raw-deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			_, _ = w.Write(compress(enc, []byte(page)))
+		case "gzip,br":
+			w.Header().Set("Content-Encoding", "gzip, br")
+			_, _ = w.Write(compress("br", compress("gzip", []byte(page))))
+		case "bomb":
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(compress("gzip", make([]byte, 10<<20)))
+		default:
+			w.Header().Set("Content-Encoding", enc)
+			_, _ = w.Write(compress(enc, []byte(page)))
+		}
+	}))
+	defer srv.Close()
+
+	conf := config.Default().Download
+	conf.MaxDecodedSize = 1 << 20
+	d := NewDownloader(conf)
+	for _, enc := range []string{"identity", "gzip", "deflate", "raw-deflate", "br", "zstd", "gzip,br"} {
+		resp, err := d.Get(context.Background(), task.NewTask("page", nil, srv.URL+"/"+enc, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", enc, err)
+		}
+		if string(resp.Body) != page || resp.Size != int64(len(page)) {
+			t.Errorf("%s: unexpected body of %d bytes", enc, resp.Size)
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: Content-Encoding should be removed", enc)
+		}
+		if enc == "identity" && resp.Wire != resp.Size || enc != "identity" && resp.Wire >= resp.Size {
+			t.Errorf("%s: unexpected wire bytes %d of %d", enc, resp.Wire, resp.Size)
+		}
+	}
+	if accepted != AcceptEncoding {
+		t.Errorf("expect Accept-Encoding %q, got %q", AcceptEncoding, accepted)
+	}
+
+	// 解压后超过上限的响应失败且不会重试
+	tk := task.NewTask("bomb", nil, srv.URL+"/bomb", nil)
+	if _, err := d.Get(context.Background(), tk); err == nil || err.ErrCode() != task.ErrBodyTooLarge {
+		t.Fatalf("expect ErrBodyTooLarge, got %v", err)
+	}
+}
+
+func TestUncompress_Limit(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(make([]byte, 100))
+	_ = w.Close()
+	data := buf.Bytes()
+
+	for limit, ok := range map[int64]bool{0: true, 99: false, 100: true, 101: true} {
+		r, err := uncompress(bytes.NewReader(data), "gzip", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r)
+		if ok && (err != nil || len(body) != 100) {
+			t.Errorf("limit %d: expect 100 bytes, got %d, %v", limit, len(body), err)
+		}
+		if !ok && (err != ErrTooLarge || int64(len(body)) != limit) {
+			t.Errorf("limit %d: expect ErrTooLarge after %d bytes, got %d, %v", limit, limit, len(body), err)
+		}
+	}
+	if _, err := uncompress(bytes.NewReader(data), "compress", 0); err == nil {
+		t.Errorf("expect error for unsupported encoding")
+	}
+}
@@ -2,73 +2,143 @@ package download
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
 	"github.com/xiaorui77/monker-king/internal/engine/types"
 	"github.com/xiaorui77/monker-king/internal/utils"
 	"github.com/xiaorui77/monker-king/internal/utils/fileutil"
 	"github.com/xiaorui77/monker-king/pkg/error"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"time"
 )
 
-const (
-	MaxTimeout = time.Minute * 10
-)
-
 type Downloader struct {
-	client *http.Client
+	client  *http.Client // 不属于任何会话的请求使用
+	proxies *ProxyPool   // 未配置代理时为nil, 使用环境变量中的代理
+	session config.SessionConfig
+	charset config.CharsetConfig
+	cache   *cache      // 未配置缓存目录时为nil
+	warc    *WarcWriter // 未配置WARC目录时为nil
+	// maxDecoded 解压后的响应体的最大字节数, 0为不限制
+	maxDecoded int64
 }
 
-func NewDownloader() *Downloader {
+func NewDownloader(conf config.DownloadConfig) *Downloader {
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		logx.Errorf("[downloader] new cookiejar failed: %v", err)
 		return nil
 	}
 
-	return &Downloader{
+	d := &Downloader{
 		client: &http.Client{
 			Jar: jar,
 			// The timeout includes connection time, any redirects, and reading the response body.
 			// includes Dial、TLS handshake、Request、Resp.Headers、Resp.Body, excludes Idle
-			Timeout: MaxTimeout,
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:   15 * time.Second,
-					KeepAlive: 10 * time.Second,
-				}).DialContext,
-				ForceAttemptHTTP2:     true,
-				MaxIdleConns:          100,
-				MaxIdleConnsPerHost:   10,
-				IdleConnTimeout:       60 * time.Second,
-				TLSHandshakeTimeout:   15 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-			},
+			Timeout: conf.MaxTimeout,
 		},
+		session:    conf.Session,
+		charset:    conf.Charset,
+		maxDecoded: int64(conf.MaxDecodedSize),
+		cache:      newCache(conf.Cache),
+	}
+	if len(conf.Proxy.URLs) > 0 {
+		d.proxies = NewProxyPool(conf.Proxy, newTransport)
+		d.client.Transport = d.proxies
+	} else {
+		transport := newTransport()
+		transport.Proxy = http.ProxyFromEnvironment
+		d.client.Transport = transport
+	}
+	if conf.Warc.Dir != "" {
+		if w, err := NewWarcWriter(conf.Warc); err != nil {
+			logx.Errorf("[downloader] create warc writer failed, responses will not be archived: %v", err)
+		} else {
+			d.warc = w
+			d.client.Transport = &warcTransport{next: d.client.Transport, writer: w}
+		}
+	}
+	return d
+}
+
+// Close 关闭正在写入的WARC文件
+func (d *Downloader) Close() {
+	if d.warc != nil {
+		if err := d.warc.Close(); err != nil {
+			logx.Warnf("[downloader] close warc writer failed: %v", err)
+		}
 	}
 }
 
-// Get send an HTTP Request by GET Method.
-// Caller should close resp.Body when done reading from it.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   15 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       60 * time.Second,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Proxies 返回代理池中代理的状态, 未配置代理时为空
+func (d *Downloader) Proxies() []ProxyStatus {
+	if d.proxies == nil {
+		return []ProxyStatus{}
+	}
+	return d.proxies.Status()
+}
+
+// MaxTimeout 单个请求的最大超时时间
+func (d *Downloader) MaxTimeout() time.Duration {
+	return d.client.Timeout
+}
+
+// Get send the HTTP Request of the task, GET by default.
+// 下载任务(设置了MetaSavePath)的响应体流式写入临时文件, 见stream.
 func (d *Downloader) Get(ctx context.Context, t *task.Task) (*types.ResponseWarp, error.Error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.Url, nil)
+	if savePath, ok := t.Meta[task.MetaSavePath].(string); ok && savePath != "" {
+		return d.stream(ctx, t, savePath)
+	}
+	req, err := newRequest(ctx, t)
 	if err != nil {
 		logx.Errorf("[downloader] Task[%08x] new request failed: %v", t.ID, err)
 		return nil, &error.Err{Err: err, Code: task.ErrNewRequest}
 	}
 	reqWrap := &types.RequestWrap{
 		URL:     req.URL,
+		Method:  req.Method,
 		BaseURL: req.URL,
 	}
-	d.beforeReq(req)
+	client := d.prepare(ctx, req, t)
+
+	// 有缓存时在过期前直接使用, 否则发送条件请求
+	policy := d.cache.policy(t)
+	var cached *cacheEntry
+	var cachedBody []byte
+	if policy != config.CacheNever {
+		if cached, cachedBody = d.cache.load(t.Url); cached != nil {
+			if policy == config.CacheRespect && time.Now().Before(cached.Expires) {
+				logx.Debugf("[downloader] Task[%08x] use fresh cache stored at %v", t.ID, cached.StoredAt)
+				return d.replay(t, reqWrap, cached, cachedBody), nil
+			}
+			cached.conditional(req)
+		}
+	}
 
-	logx.Debugf("[downloader] Task[%08x] send request, header: %v", t.ID, req.Header)
-	resp, err := d.client.Do(req)
+	logx.Debugf("[downloader] Task[%08x] send %s request, header: %v", t.ID, req.Method, req.Header)
+	resp, err := client.Do(req)
 	if err != nil {
 		logx.Warnf("[downloader] Task[%08x] do request failed: %v", t.ID, err)
 		return nil, &error.Err{Code: task.ErrDoRequest, Err: err}
@@ -80,30 +150,102 @@ func (d *Downloader) Get(ctx context.Context, t *task.Task) (*types.ResponseWarp
 			logx.Errorf("[downloader] resp.Body close fail: %v", err)
 		}
 	}()
-	reader := &fileutil.VisualReader{
-		Reader: resp.Body,
-		Total:  resp.ContentLength,
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		logx.Debugf("[downloader] Task[%08x] not modified, use cache stored at %v", t.ID, cached.StoredAt)
+		d.cache.revalidated(t.Url, policy, cached, cachedBody, resp.Header)
+		return d.replay(t, reqWrap, cached, cachedBody), nil
 	}
+
+	// 流式解压, reader记录传输和解压后的字节数
+	reader := &fileutil.VisualReader{Total: resp.ContentLength}
+	reader.Reader, err = uncompress(reader.CountWire(resp.Body), resp.Header.Get("Content-Encoding"), d.maxDecoded)
+	if err != nil {
+		return nil, &error.Err{Code: task.ErrReadRespBody, Err: err}
+	}
+	decoded(resp)
 	body, err := reader.ReadAll()
 	if err != nil {
 		t.SetMeta(task.MetaReader, reader) // convention：如果有错误，则记录reader
+		code := task.ErrReadRespBody
+		if errors.Is(err, ErrTooLarge) {
+			code = task.ErrBodyTooLarge
+		}
 		return nil, &error.Err{
-			Code: task.ErrReadRespBody,
-			Err:  fmt.Errorf("reading resp.Body when[%v/%v] failed: %v", reader.Cur, reader.Total, err),
+			Code: code,
+			Err:  fmt.Errorf("reading resp.Body when[%v/%v] failed: %v", reader.Wire, reader.Total, err),
 		}
 	}
 
-	return &types.ResponseWarp{
+	res := &types.ResponseWarp{
 		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
 		Body:       body,
+		Size:       int64(len(body)),
+		Wire:       reader.Wire,
 		Request:    reqWrap,
+	}
+	// 缓存转换字符集之前的响应体, 使用时重新检测
+	d.cache.save(t.Url, policy, res)
+	decodeBody(res, d.charset.Domains[t.Domain], d.charset.Fallback)
+	return res, nil
+}
+
+// Fetch 获取指定URL的内容, 用于robots.txt等辅助资源, 最多读取limit字节
+func (d *Downloader) Fetch(ctx context.Context, rawUrl string, limit int64) (*types.ResponseWarp, error.Error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, &error.Err{Err: err, Code: task.ErrNewRequest}
+	}
+	client := d.prepare(ctx, req, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &error.Err{Code: task.ErrDoRequest, Err: err}
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logx.Errorf("[downloader] resp.Body close fail: %v", err)
+		}
+	}()
+	r, err := uncompress(resp.Body, resp.Header.Get("Content-Encoding"), d.maxDecoded)
+	if err != nil {
+		return nil, &error.Err{Code: task.ErrReadRespBody, Err: err}
+	}
+	decoded(resp)
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return nil, &error.Err{Code: task.ErrReadRespBody, Err: err}
+	}
+	return &types.ResponseWarp{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Request:    &types.RequestWrap{URL: req.URL, Method: req.Method, BaseURL: req.URL},
 	}, nil
 }
 
+// prepare 设置请求头并返回发送请求的client, ctx中有会话时使用会话的cookie和请求头.
+// 任务的请求头覆盖默认值.
+func (d *Downloader) prepare(ctx context.Context, req *http.Request, t *task.Task) *http.Client {
+	client := d.client
+	if s := sessionFrom(ctx); s != nil {
+		s.prepare(req, t)
+		client = s.client
+	} else {
+		d.beforeReq(req)
+	}
+	if t != nil {
+		for k, v := range t.Request.Header {
+			req.Header[k] = append([]string(nil), v...)
+		}
+	}
+	return client
+}
+
 func (d *Downloader) beforeReq(req *http.Request) {
 	req.Header.Set(utils.UserAgentKey, utils.RandomUserAgent())
 
-	req.Header.Set("accept-encoding", "")
+	req.Header.Set("accept-encoding", AcceptEncoding)
 	req.Header.Set("accept-language", "zh-CN,zh;q=0.9")
 
 	// TODO: 待设定
@@ -0,0 +1,26 @@
+package download
+
+import (
+	"context"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"github.com/xiaorui77/monker-king/pkg/error"
+)
+
+// Fetcher名称, 记录在task.MetaFetcher中
+const (
+	FetcherHTTP   = "http"   // 直接发送HTTP请求
+	FetcherRender = "render" // 使用无头浏览器渲染, 用于依赖JavaScript的页面
+	FetcherReplay = "replay" // 从WARC文件中重放, 不发送请求
+)
+
+// Fetcher 获取任务对应的页面, 调度器通过Fetcher发起请求
+type Fetcher interface {
+	Get(ctx context.Context, t *task.Task) (*types.ResponseWarp, error.Error)
+}
+
+var (
+	_ Fetcher = (*Downloader)(nil)
+	_ Fetcher = (*Renderer)(nil)
+	_ Fetcher = (*Replayer)(nil)
+)
@@ -0,0 +1,244 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/utils/domainutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 代理的状态
+const (
+	ProxyHealthy  = "healthy"
+	ProxyEjected  = "ejected"  // 连续失败被剔除, 冷却后进行健康检查
+	ProxyChecking = "checking" // 正在进行健康检查
+)
+
+// ProxyStatus 代理的健康状况
+type ProxyStatus struct {
+	URL         string    `json:"url"` // 隐藏了密码
+	State       string    `json:"state"`
+	Requests    int64     `json:"requests"`
+	Failures    int64     `json:"failures"`    // 累计失败次数
+	Consecutive int       `json:"consecutive"` // 连续失败次数
+	LastError   string    `json:"lastError,omitempty"`
+	EjectedAt   time.Time `json:"ejectedAt,omitempty"`
+	Domains     []string  `json:"domains,omitempty"` // sticky策略下固定使用该代理的域名
+}
+
+type proxy struct {
+	raw       string
+	url       *url.URL
+	transport *http.Transport
+
+	state       string
+	requests    int64
+	failures    int64
+	consecutive int
+	lastErr     string
+	ejectedAt   time.Time
+}
+
+// ProxyPool 按策略为每个请求选择代理, 剔除连续失败或返回封禁状态码的代理.
+// 实现http.RoundTripper, 作为Downloader的Transport.
+type ProxyPool struct {
+	conf config.ProxyConfig
+	ban  map[int]bool
+
+	mu      sync.Mutex
+	proxies []*proxy
+	byURL   map[string]*proxy
+	next    int               // roundRobin和sticky分配的位置
+	sticky  map[string]*proxy // sticky策略下域名使用的代理
+}
+
+// NewProxyPool newTransport用于为每个代理创建独立的Transport
+func NewProxyPool(conf config.ProxyConfig, newTransport func() *http.Transport) *ProxyPool {
+	p := &ProxyPool{
+		conf:    conf,
+		ban:     make(map[int]bool, len(conf.BanStatuses)),
+		proxies: make([]*proxy, 0, len(conf.URLs)),
+		byURL:   make(map[string]*proxy, len(conf.URLs)),
+		sticky:  map[string]*proxy{},
+	}
+	for _, code := range conf.BanStatuses {
+		p.ban[code] = true
+	}
+	for _, raw := range conf.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			logx.Errorf("[proxy] invalid proxy url %q: %v", raw, err)
+			continue
+		}
+		transport := newTransport()
+		transport.Proxy = http.ProxyURL(u)
+		px := &proxy{raw: raw, url: u, transport: transport, state: ProxyHealthy}
+		p.proxies = append(p.proxies, px)
+		p.byURL[raw] = px
+	}
+	logx.Infof("[proxy] proxy pool with %d proxies, strategy: %s", len(p.proxies), conf.Strategy)
+	return p
+}
+
+// RoundTrip implement http.RoundTripper
+func (p *ProxyPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	px, err := p.pick(domainutil.CalDomain(req.URL.String()))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := px.transport.RoundTrip(req)
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// 任务被取消, 与代理无关
+		return resp, err
+	}
+	var reason string
+	if err != nil {
+		reason = err.Error()
+	} else if p.ban[resp.StatusCode] {
+		reason = fmt.Sprintf("ban-like status %d of %s", resp.StatusCode, req.URL.Host)
+	}
+	p.observe(px, reason)
+	return resp, err
+}
+
+// pick 在域名可用的代理中按策略选择
+func (p *ProxyPool) pick(domain string) (*proxy, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candidates := p.available(domain)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no available proxy for %s", domain)
+	}
+	switch p.conf.Strategy {
+	case config.ProxySticky:
+		if px, ok := p.sticky[domain]; ok && px.state == ProxyHealthy {
+			for _, c := range candidates {
+				if c == px {
+					return px, nil
+				}
+			}
+		}
+		px := candidates[p.next%len(candidates)]
+		p.next++
+		p.sticky[domain] = px
+		logx.Infof("[proxy] domain %s sticks to proxy %s", domain, px.url.Redacted())
+		return px, nil
+	case config.ProxyRandom:
+		return candidates[rand.Intn(len(candidates))], nil
+	default:
+		px := candidates[p.next%len(candidates)]
+		p.next++
+		return px, nil
+	}
+}
+
+// available 返回域名可用的健康代理, 冷却结束的代理开始健康检查; 需要持有mu
+func (p *ProxyPool) available(domain string) []*proxy {
+	all := p.proxies
+	if urls, ok := p.conf.Domains[domain]; ok {
+		all = make([]*proxy, 0, len(urls))
+		for _, raw := range urls {
+			if px, ok := p.byURL[raw]; ok {
+				all = append(all, px)
+			}
+		}
+	}
+	res := make([]*proxy, 0, len(all))
+	for _, px := range all {
+		if px.state == ProxyEjected && time.Since(px.ejectedAt) >= p.conf.Cooldown {
+			if p.conf.CheckURL == "" {
+				p.restore(px)
+			} else {
+				px.state = ProxyChecking
+				go p.check(px)
+			}
+		}
+		if px.state == ProxyHealthy {
+			res = append(res, px)
+		}
+	}
+	return res
+}
+
+// observe 记录请求结果, reason为空表示成功
+func (p *ProxyPool) observe(px *proxy, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	px.requests++
+	if reason == "" {
+		px.consecutive = 0
+		return
+	}
+	px.failures++
+	px.consecutive++
+	px.lastErr = reason
+	if px.state == ProxyHealthy && px.consecutive >= p.conf.MaxFailures {
+		px.state, px.ejectedAt = ProxyEjected, time.Now()
+		logx.Warnf("[proxy] proxy %s ejected after %d failures, last: %s", px.url.Redacted(), px.consecutive, reason)
+	}
+}
+
+// check 通过代理访问CheckURL, 成功时恢复
+func (p *ProxyPool) check(px *proxy) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	err := fmt.Errorf("invalid check url")
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, p.conf.CheckURL, nil)
+	if reqErr == nil {
+		var resp *http.Response
+		if resp, err = px.transport.RoundTrip(req); err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode >= http.StatusBadRequest {
+				err = fmt.Errorf("health check status %d", resp.StatusCode)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		px.state, px.ejectedAt, px.lastErr = ProxyEjected, time.Now(), err.Error()
+		logx.Warnf("[proxy] proxy %s health check failed: %v", px.url.Redacted(), err)
+		return
+	}
+	p.restore(px)
+}
+
+// restore 需要持有mu
+func (p *ProxyPool) restore(px *proxy) {
+	px.state, px.consecutive = ProxyHealthy, 0
+	logx.Infof("[proxy] proxy %s restored", px.url.Redacted())
+}
+
+// Status 返回所有代理的健康状况
+func (p *ProxyPool) Status() []ProxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domains := make(map[*proxy][]string, len(p.proxies))
+	for domain, px := range p.sticky {
+		domains[px] = append(domains[px], domain)
+	}
+	res := make([]ProxyStatus, 0, len(p.proxies))
+	for _, px := range p.proxies {
+		sort.Strings(domains[px])
+		res = append(res, ProxyStatus{
+			URL:         px.url.Redacted(),
+			State:       px.state,
+			Requests:    px.requests,
+			Failures:    px.failures,
+			Consecutive: px.consecutive,
+			LastError:   px.lastErr,
+			EjectedAt:   px.ejectedAt,
+			Domains:     domains[px],
+		})
+	}
+	return res
+}
@@ -0,0 +1,206 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"github.com/xiaorui77/monker-king/internal/utils"
+	error2 "github.com/xiaorui77/monker-king/pkg/error"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Renderer 通过DevTools协议驱动无头浏览器获取渲染后的页面.
+// 浏览器在第一次使用时启动, 每个任务使用一个独立的标签页.
+type Renderer struct {
+	conf config.RenderConfig
+	tabs chan struct{} // 限制同时打开的标签页
+
+	once       sync.Once
+	err        error
+	browserCtx context.Context
+
+	// mu 保护cancel和closed, Close可能与正在启动浏览器的start同时调用
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	closed bool
+}
+
+func NewRenderer(conf config.RenderConfig) *Renderer {
+	return &Renderer{
+		conf: conf,
+		tabs: make(chan struct{}, conf.MaxTabs),
+	}
+}
+
+// start 启动本地浏览器或连接到RemoteURL
+func (r *Renderer) start() error {
+	r.once.Do(func() {
+		var allocCtx context.Context
+		var allocCancel context.CancelFunc
+		if r.conf.RemoteURL != "" {
+			allocCtx, allocCancel = chromedp.NewRemoteAllocator(context.Background(), r.conf.RemoteURL)
+		} else {
+			opts := append(chromedp.DefaultExecAllocatorOptions[:],
+				chromedp.Flag("headless", r.conf.Headless),
+				chromedp.UserAgent(utils.RandomUserAgent()),
+			)
+			if r.conf.ExecPath != "" {
+				opts = append(opts, chromedp.ExecPath(r.conf.ExecPath))
+			}
+			allocCtx, allocCancel = chromedp.NewExecAllocator(context.Background(), opts...)
+		}
+		browserCtx, browserCancel := chromedp.NewContext(allocCtx)
+		r.browserCtx = browserCtx
+		cancel := func() {
+			browserCancel()
+			allocCancel()
+		}
+		r.mu.Lock()
+		closed := r.closed
+		r.cancel = cancel
+		r.mu.Unlock()
+		if closed {
+			r.err = fmt.Errorf("renderer has been closed")
+			cancel()
+			return
+		}
+		// 启动浏览器, 期间Close会取消启动
+		if r.err = chromedp.Run(browserCtx); r.err != nil {
+			logx.Errorf("[render] start browser failed: %v", r.err)
+			cancel()
+			return
+		}
+		logx.Infof("[render] browser has been started")
+	})
+	return r.err
+}
+
+// Get 在新标签页中打开页面, 等待渲染完成后返回页面的HTML.
+// StatusCode和Header取自主文档的响应, 重定向后的地址作为BaseURL.
+func (r *Renderer) Get(ctx context.Context, t *task.Task) (*types.ResponseWarp, error2.Error) {
+	u, err := url.Parse(t.Url)
+	if err != nil {
+		return nil, &error2.Err{Err: err, Code: task.ErrNewRequest}
+	}
+	if t.Request.GetMethod() != http.MethodGet || t.Request.HasBody() {
+		return nil, &error2.Err{Code: task.ErrNewRequest, Err: fmt.Errorf("render only supports GET without body")}
+	}
+	if err := r.start(); err != nil {
+		return nil, &error2.Err{Code: task.ErrRender, Err: fmt.Errorf("start browser failed: %v", err)}
+	}
+
+	select {
+	case r.tabs <- struct{}{}:
+		defer func() { <-r.tabs }()
+	case <-ctx.Done():
+		return nil, &error2.Err{Code: task.ErrDoRequest, Err: ctx.Err()}
+	}
+
+	tabCtx, cancel := chromedp.NewContext(r.browserCtx)
+	defer cancel()
+	// 任务超时或停止时关闭标签页
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	var mu sync.Mutex
+	var doc *network.Response
+	chromedp.ListenTarget(tabCtx, func(ev interface{}) {
+		if e, ok := ev.(*network.EventResponseReceived); ok && e.Type == network.ResourceTypeDocument {
+			mu.Lock()
+			if doc == nil {
+				doc = e.Response
+			}
+			mu.Unlock()
+		}
+	})
+
+	var html, location string
+	actions := []chromedp.Action{network.Enable()}
+	if s := sessionFrom(ctx); s != nil {
+		actions = append(actions, sessionActions(s, u, t)...)
+	}
+	actions = append(actions, chromedp.Navigate(t.Url), chromedp.WaitReady(r.conf.WaitSelector))
+	if r.conf.WaitTime > 0 {
+		actions = append(actions, chromedp.Sleep(r.conf.WaitTime))
+	}
+	actions = append(actions, chromedp.Location(&location), chromedp.OuterHTML("html", &html))
+
+	logx.Debugf("[render] Task[%08x] render page: %v", t.ID, t.Url)
+	if err := chromedp.Run(tabCtx, actions...); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		logx.Warnf("[render] Task[%08x] render failed: %v", t.ID, err)
+		return nil, &error2.Err{Code: task.ErrRender, Err: err}
+	}
+
+	resp := &types.ResponseWarp{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       []byte(html),
+		Size:       int64(len(html)),
+		Charset:    "utf-8", // 浏览器已完成转换
+		Request:    &types.RequestWrap{URL: u, Method: http.MethodGet, BaseURL: u},
+	}
+	mu.Lock()
+	if doc != nil {
+		resp.StatusCode = int(doc.Status)
+		for k, v := range doc.Headers {
+			resp.Header.Set(k, fmt.Sprint(v))
+		}
+	}
+	mu.Unlock()
+	if base, err := url.Parse(location); err == nil && base.Host != "" {
+		resp.Request.BaseURL = base
+	}
+	return resp, nil
+}
+
+// sessionActions 在标签页中使用会话的请求头和cookie, User-Agent由浏览器决定
+func sessionActions(s *Session, u *url.URL, t *task.Task) []chromedp.Action {
+	req := &http.Request{Header: http.Header{}}
+	s.prepare(req, t)
+	headers := network.Headers{}
+	for k, v := range req.Header {
+		if k != utils.UserAgentKey && k != "Accept-Encoding" && len(v) > 0 && v[0] != "" {
+			headers[k] = v[0]
+		}
+	}
+	actions := []chromedp.Action{network.SetExtraHTTPHeaders(headers)}
+	for _, c := range s.Cookies(u) {
+		c := c
+		actions = append(actions, chromedp.ActionFunc(func(ctx context.Context) error {
+			_, err := network.SetCookie(c.Name, c.Value).WithURL(t.Url).Do(ctx)
+			return err
+		}))
+	}
+	return actions
+}
+
+// Close 关闭浏览器, 之后的任务都会失败
+func (r *Renderer) Close() {
+	r.mu.Lock()
+	r.closed = true
+	cancel := r.cancel
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	r.once.Do(func() {
+		r.err = fmt.Errorf("renderer has been closed")
+	})
+}
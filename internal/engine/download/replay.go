@@ -0,0 +1,329 @@
+package download
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/dedup"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	error2 "github.com/xiaorui77/monker-king/pkg/error"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxReplayRedirects 重放时最多跟随的重定向次数, 与http.Client一致
+const maxReplayRedirects = 10
+
+// warcOffset 响应记录所在的文件和偏移
+type warcOffset struct {
+	path   string
+	offset int64
+}
+
+// Replayer 从已有的WARC文件中重放响应, 使解析可以离线重新运行.
+// 按规范化的URL查找, 同一URL有多个响应时使用最后一个完整(未截断)的2xx/3xx响应(304和206除外);
+// 不区分请求方法和请求体.
+type Replayer struct {
+	canon      *dedup.Canonicalizer
+	index      map[string]warcOffset
+	charset    config.CharsetConfig
+	maxDecoded int64
+}
+
+// NewReplayer 读取Warc.Replay匹配的所有文件, 建立响应记录的索引
+func NewReplayer(conf config.DownloadConfig) (*Replayer, error) {
+	r := &Replayer{
+		canon:      dedup.NewCanonicalizer(nil),
+		index:      map[string]warcOffset{},
+		charset:    conf.Charset,
+		maxDecoded: int64(conf.MaxDecodedSize),
+	}
+	files := 0
+	for _, pattern := range conf.Warc.Replay {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if err := r.scan(path); err != nil {
+				return nil, fmt.Errorf("index %s failed: %v", path, err)
+			}
+			files++
+		}
+	}
+	logx.Infof("[replay] indexed %d responses from %d warc files", len(r.index), files)
+	return r, nil
+}
+
+func (r *Replayer) key(rawUrl string) string {
+	if c, err := r.canon.Canonical(rawUrl); err == nil {
+		return c
+	}
+	return rawUrl
+}
+
+// scan 记录文件中每个可重放的响应记录的偏移
+func (r *Replayer) scan(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	wr := newWarcReader(f, strings.HasSuffix(path, ".gz"))
+	for {
+		offset, header, block, err := wr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// 被截断的记录只有部分响应体, 不覆盖之前完整的响应
+		if header["warc-type"] != "response" || header["warc-target-uri"] == "" || header["warc-truncated"] != "" {
+			continue
+		}
+		code, err := statusCode(block)
+		if err != nil {
+			return fmt.Errorf("invalid response record at %d: %v", offset, err)
+		}
+		if replayable(code) {
+			r.index[r.key(header["warc-target-uri"])] = warcOffset{path: path, offset: offset}
+		}
+	}
+}
+
+// statusCode 读取响应记录块中状态行的状态码
+func statusCode(block io.Reader) (int, error) {
+	line, err := readLine(bufio.NewReader(io.LimitReader(block, 1024)))
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return 0, fmt.Errorf("invalid status line %q", line)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// replayable 完整的2xx/3xx响应可以重放, 304和206的响应体不是完整的资源
+func replayable(code int) bool {
+	return code >= 200 && code < 400 && code != http.StatusNotModified && code != http.StatusPartialContent
+}
+
+// Get implement Fetcher, 跟随已记录的重定向
+func (r *Replayer) Get(ctx context.Context, t *task.Task) (*types.ResponseWarp, error2.Error) {
+	target := t.Url
+	for redirects := 0; ; redirects++ {
+		resp, body, err := r.load(target)
+		if err != nil {
+			logx.Warnf("[replay] Task[%08x] replay %s failed: %v", t.ID, target, err)
+			return nil, &error2.Err{Code: task.ErrDoRequest, Err: err}
+		}
+		u, _ := resp.Request.URL.Parse(resp.Header.Get("Location"))
+		if redirect(resp.StatusCode) && u != nil && redirects < maxReplayRedirects {
+			if _, ok := r.index[r.key(u.String())]; ok {
+				target = u.String()
+				continue
+			}
+		}
+		res := &types.ResponseWarp{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       body,
+			Size:       int64(len(body)),
+			Request:    &types.RequestWrap{URL: resp.Request.URL, Method: t.Request.GetMethod(), BaseURL: resp.Request.URL},
+		}
+		decodeBody(res, r.charset.Domains[t.Domain], r.charset.Fallback)
+		return res, nil
+	}
+}
+
+// load 读取URL对应的响应记录, 返回解压后的响应体
+func (r *Replayer) load(rawUrl string) (*http.Response, []byte, error) {
+	loc, ok := r.index[r.key(rawUrl)]
+	if !ok {
+		return nil, nil, fmt.Errorf("no response of %s in warc files", rawUrl)
+	}
+	f, err := os.Open(loc.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.Seek(loc.offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	_, _, block, err := newWarcReader(f, strings.HasSuffix(loc.path, ".gz")).next()
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(block), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := uncompress(resp.Body, resp.Header.Get("Content-Encoding"), r.maxDecoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoded(resp)
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+func redirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// countReader 统计已读取的字节数. 实现io.ByteReader, 使gzip.Reader不再额外缓冲, 从而得到每条记录准确的偏移
+type countReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// warcReader 按顺序读取WARC文件中的记录, gz为true时每条记录为单独的gzip member
+type warcReader struct {
+	cr   *countReader
+	gz   bool
+	z    *gzip.Reader
+	last io.Reader // 上一条记录未读取的部分, gzip时为整个member
+}
+
+func newWarcReader(r io.Reader, gz bool) *warcReader {
+	return &warcReader{cr: &countReader{r: bufio.NewReader(r)}, gz: gz}
+}
+
+// next 返回下一条记录的偏移, 头(名称为小写)和记录块, 没有更多记录时返回io.EOF
+func (r *warcReader) next() (int64, map[string]string, io.Reader, error) {
+	if r.last != nil {
+		if _, err := io.Copy(ioutil.Discard, r.last); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	offset := r.cr.n
+	var src byteReader = r.cr
+	if r.gz {
+		if _, err := r.cr.r.Peek(1); err != nil {
+			return 0, nil, nil, err
+		}
+		var err error
+		if r.z == nil {
+			r.z, err = gzip.NewReader(r.cr)
+		} else {
+			err = r.z.Reset(r.cr)
+		}
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		r.z.Multistream(false)
+		src = bufio.NewReader(r.z)
+		r.last = src
+	}
+
+	// 版本行, 跳过上一条记录结尾的空行
+	for {
+		if !r.gz {
+			offset = r.cr.n
+		}
+		line, err := readLine(src)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "WARC/") {
+			return 0, nil, nil, fmt.Errorf("invalid warc record at %d: %q", offset, line)
+		}
+		break
+	}
+	header := map[string]string{}
+	for {
+		line, err := readLine(src)
+		if err != nil {
+			return 0, nil, nil, unexpected(err)
+		}
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			header[strings.ToLower(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	length, err := strconv.ParseInt(header["content-length"], 10, 64)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid Content-Length of warc record at %d: %v", offset, err)
+	}
+	block := &io.LimitedReader{R: src, N: length}
+	if !r.gz {
+		r.last = block
+	}
+	return offset, header, block, nil
+}
+
+// readLine 读取一行并去除结尾的\r\n
+func readLine(r io.ByteReader) (string, error) {
+	var b strings.Builder
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && b.Len() > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if c == '\n' {
+			return strings.TrimSuffix(b.String(), "\r"), nil
+		}
+		b.WriteByte(c)
+	}
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// newRequest 按任务的Request创建HTTP请求, 每次请求重新生成请求体, 使重试时可以再次发送
+func newRequest(ctx context.Context, t *task.Task) (*http.Request, error) {
+	body, contentType, err := requestBody(&t.Request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(withTask(ctx, t), t.Request.GetMethod(), t.Url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// requestBody 返回请求体和对应的Content-Type, 没有请求体时均为空
+func requestBody(r *task.Request) (io.Reader, string, error) {
+	switch {
+	case r.Form != nil:
+		return bytes.NewBufferString(r.Form.Encode()), "application/x-www-form-urlencoded", nil
+	case r.JSON != nil:
+		return bytes.NewReader(r.JSON), "application/json", nil
+	case r.Multipart != nil:
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		for name, values := range r.Multipart.Fields {
+			for _, v := range values {
+				if err := w.WriteField(name, v); err != nil {
+					return nil, "", err
+				}
+			}
+		}
+		names := make([]string, 0, len(r.Multipart.Files))
+		for name := range r.Multipart.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := writeFile(w, name, r.Multipart.Files[name]); err != nil {
+				return nil, "", fmt.Errorf("multipart file %s: %v", name, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf, w.FormDataContentType(), nil
+	}
+	return nil, "", nil
+}
+
+func writeFile(w *multipart.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	part, err := w.CreateFormFile(name, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
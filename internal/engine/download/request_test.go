@@ -0,0 +1,66 @@
+package download
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestDownloader_Request(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(f)
+			body = r.FormValue("name") + ":" + string(data)
+		} else {
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+		}
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.RawQuery + " " + r.Header.Get("X-Token") + " " + body))
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "a.txt")
+	_ = ioutil.WriteFile(file, []byte("content"), 0644)
+	d := NewDownloader(config.Default().Download)
+	cases := []struct {
+		opts   []task.Option
+		expect string
+	}{
+		{nil, "GET   "},
+		{[]task.Option{task.WithQuery(url.Values{"q": {"a"}}), task.WithHeader("X-Token", "t")}, "GET q=a t "},
+		{[]task.Option{task.WithForm(url.Values{"q": {"a b"}})}, "POST   q=a+b"},
+		{[]task.Option{task.WithMethod("put"), task.WithJSON([]byte(`{"page":2}`))}, `PUT   {"page":2}`},
+		{[]task.Option{task.WithMultipart(url.Values{"name": {"monkey"}}, map[string]string{"file": file})}, "POST   monkey:content"},
+	}
+	for i, c := range cases {
+		tk := task.NewTask("req", nil, srv.URL+"/api", nil, c.opts...)
+		// 重试时请求体可以再次发送
+		for attempt := 0; attempt < 2; attempt++ {
+			resp, err := d.Get(context.Background(), tk)
+			if err != nil {
+				t.Fatalf("case %d: %v", i, err)
+			}
+			if string(resp.Body) != c.expect || resp.Request.Method != tk.Request.GetMethod() {
+				t.Errorf("case %d: expect %q, got %q", i, c.expect, resp.Body)
+			}
+		}
+	}
+}
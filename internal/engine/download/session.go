@@ -0,0 +1,375 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginMaxSize 读取登录响应的最大字节数
+const loginMaxSize = 2 << 20
+
+type sessionKey struct{}
+
+// WithSession 使ctx中的请求使用会话的cookie和请求头
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+func sessionFrom(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// SavedCookie 持久化的cookie, 按会话(域名)保存.
+// 没有过期时间的会话cookie也会保存, 使重启后仍保持登录.
+type SavedCookie struct {
+	ID       string `gorm:"primaryKey;size:40"` // 由会话, 设置cookie的host, domain, path, name计算
+	Session  string `gorm:"index;size:255"`
+	URL      string // 设置cookie的URL, 恢复时重新设置到该URL
+	Name     string
+	Value    string
+	Domain   string
+	Path     string
+	Expires  time.Time
+	Secure   bool
+	HttpOnly bool
+}
+
+func (SavedCookie) TableName() string {
+	return "cookies"
+}
+
+func (c *SavedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// Session 一个Browser独立的HTTP会话: cookie, 默认请求头, Referer和登录.
+// 实现http.CookieJar, 在cookiejar之外记录cookie用于持久化.
+type Session struct {
+	domain  string
+	client  *http.Client
+	jar     *cookiejar.Jar
+	header  http.Header
+	referer bool
+	login   *config.LoginConfig
+
+	mu      sync.Mutex
+	cookies map[string]*SavedCookie
+	dirty   bool // 有未保存的修改
+
+	loginMu  sync.Mutex
+	loggedIn bool
+}
+
+// NewSession 创建域名的会话, 与Downloader共享连接和代理.
+// 同一个会话的请求使用相同的User-Agent.
+func (d *Downloader) NewSession(domain string) *Session {
+	jar, _ := cookiejar.New(nil)
+	site := d.session.Domains[domain]
+	s := &Session{
+		domain:  domain,
+		jar:     jar,
+		header:  http.Header{},
+		referer: d.session.Referer,
+		login:   site.Login,
+		cookies: map[string]*SavedCookie{},
+	}
+	s.header.Set(utils.UserAgentKey, utils.RandomUserAgent())
+	s.header.Set("accept-encoding", AcceptEncoding)
+	s.header.Set("accept-language", "zh-CN,zh;q=0.9")
+	for k, v := range d.session.Headers {
+		s.header.Set(k, v)
+	}
+	for k, v := range site.Headers {
+		s.header.Set(k, v)
+	}
+	if site.Referer != nil {
+		s.referer = *site.Referer
+	}
+	s.client = &http.Client{
+		Jar:       s,
+		Transport: d.client.Transport,
+		Timeout:   d.client.Timeout,
+	}
+	return s
+}
+
+// Domain 会话所属的域名
+func (s *Session) Domain() string {
+	return s.domain
+}
+
+// SetCookies implement http.CookieJar
+func (s *Session) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	s.jar.SetCookies(u, cookies)
+	now := time.Now()
+	source := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range cookies {
+		saved := &SavedCookie{
+			Session:  s.domain,
+			URL:      source,
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Expires:  c.Expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		saved.ID = cookieID(s.domain, u.Host, c.Domain, c.Path, c.Name)
+		if c.MaxAge > 0 {
+			saved.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		}
+		if c.MaxAge < 0 || saved.expired(now) {
+			delete(s.cookies, saved.ID)
+		} else {
+			s.cookies[saved.ID] = saved
+		}
+		s.dirty = true
+	}
+}
+
+// Cookies implement http.CookieJar
+func (s *Session) Cookies(u *url.URL) []*http.Cookie {
+	return s.jar.Cookies(u)
+}
+
+// Saved 返回未过期的cookie, changed表示上次调用后是否有修改
+func (s *Session) Saved() (cookies []*SavedCookie, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	cookies = make([]*SavedCookie, 0, len(s.cookies))
+	for id, c := range s.cookies {
+		if c.expired(now) {
+			delete(s.cookies, id)
+			continue
+		}
+		saved := *c
+		cookies = append(cookies, &saved)
+	}
+	changed, s.dirty = s.dirty, false
+	return cookies, changed
+}
+
+// Restore 恢复之前保存的cookie
+func (s *Session) Restore(cookies []*SavedCookie) {
+	now := time.Now()
+	for _, c := range cookies {
+		u, err := url.Parse(c.URL)
+		if err != nil || c.expired(now) {
+			continue
+		}
+		s.jar.SetCookies(u, []*http.Cookie{{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Expires:  c.Expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}})
+		saved := *c
+		s.mu.Lock()
+		s.cookies[c.ID] = &saved
+		s.mu.Unlock()
+	}
+	logx.Infof("[session] Browser[%s] restored %d cookies", s.domain, len(cookies))
+}
+
+// prepare 设置会话的请求头, t不为空时按配置设置Referer
+func (s *Session) prepare(req *http.Request, t *task.Task) {
+	for k, v := range s.header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	if t == nil {
+		return
+	}
+	if referer, _ := t.Meta[task.MetaReferer].(string); referer != "" {
+		req.Header.Set("Referer", referer)
+	} else if s.referer && t.Parent != nil {
+		req.Header.Set("Referer", t.Parent.Url)
+	}
+}
+
+// NeedLogin 配置了登录且尚未成功
+func (s *Session) NeedLogin() bool {
+	if s.login == nil {
+		return false
+	}
+	s.loginMu.Lock()
+	defer s.loginMu.Unlock()
+	return !s.loggedIn
+}
+
+// Login 导入cookie并提交登录表单, 成功后不再执行; 没有配置登录时直接返回
+func (s *Session) Login(ctx context.Context) error {
+	if s.login == nil {
+		return nil
+	}
+	s.loginMu.Lock()
+	defer s.loginMu.Unlock()
+	if s.loggedIn {
+		return nil
+	}
+	if err := s.importCookies(); err != nil {
+		return err
+	}
+	if s.login.URL != "" {
+		if err := s.submit(ctx); err != nil {
+			return err
+		}
+	}
+	s.loggedIn = true
+	logx.Infof("[session] Browser[%s] logged in", s.domain)
+	return nil
+}
+
+// importCookies 导入配置中的cookie和cookie文件
+func (s *Session) importCookies() error {
+	if s.login.Cookies != "" {
+		// 借助http.Request解析Cookie请求头
+		cookies := (&http.Request{Header: http.Header{"Cookie": {s.login.Cookies}}}).Cookies()
+		for _, c := range cookies {
+			c.Domain, c.Path = s.domain, "/"
+		}
+		s.SetCookies(&url.URL{Scheme: "https", Host: s.domain, Path: "/"}, cookies)
+	}
+	if s.login.CookieFile != "" {
+		if err := s.importCookieFile(s.login.CookieFile); err != nil {
+			return fmt.Errorf("import cookie file failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// importCookieFile 导入Netscape格式的cookie文件, 每行为:
+// domain, includeSubdomains, path, secure, expires, name, value, 以tab分隔
+func (s *Session) importCookieFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 值可以为空, 不能去除结尾的tab
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("invalid line: %q", line)
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		c := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = host
+		}
+		if expires, err := strconv.ParseInt(fields[4], 10, 64); err == nil && expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		s.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: c.Path}, []*http.Cookie{c})
+	}
+	return scanner.Err()
+}
+
+// submit 提交登录表单, 响应设置的cookie保存在会话中
+func (s *Session) submit(ctx context.Context) error {
+	u, err := url.Parse(s.login.URL)
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	for k, v := range s.login.Form {
+		form.Set(k, v)
+	}
+	var body io.Reader
+	method := strings.ToUpper(s.login.Method)
+	if method == http.MethodGet {
+		query := u.Query()
+		for k, v := range form {
+			query[k] = v
+		}
+		u.RawQuery = query.Encode()
+	} else {
+		method = http.MethodPost
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	s.prepare(req, nil)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("login request failed: %v", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logx.Errorf("[session] resp.Body close fail: %v", err)
+		}
+	}()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("login failed with status %d", resp.StatusCode)
+	}
+	if s.login.Check != "" {
+		r, err := uncompress(resp.Body, resp.Header.Get("Content-Encoding"), 0)
+		if err != nil {
+			return fmt.Errorf("read login response failed: %v", err)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r, loginMaxSize))
+		if err != nil {
+			return fmt.Errorf("read login response failed: %v", err)
+		}
+		if !strings.Contains(string(data), s.login.Check) {
+			return fmt.Errorf("login check %q not found in response", s.login.Check)
+		}
+	}
+	return nil
+}
+
+func cookieID(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
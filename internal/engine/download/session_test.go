@@ -0,0 +1,91 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestSession(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.Method != http.MethodPost || r.FormValue("user") != "monkey" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "king", Path: "/", MaxAge: 3600})
+			_, _ = w.Write([]byte("welcome"))
+		default:
+			_, _ = w.Write([]byte(r.Header.Get("Cookie") + "|" + r.Header.Get("Referer") + "|" + r.Header.Get("X-Token")))
+		}
+	}))
+	defer srv.Close()
+
+	conf := config.Default().Download
+	conf.Session.Referer = true
+	conf.Session.Domains = map[string]config.SiteSession{
+		"127.0.0.1": {
+			Headers: map[string]string{"X-Token": "t1"},
+			Login: &config.LoginConfig{
+				Cookies: "theme=dark",
+				URL:     srv.URL + "/login",
+				Form:    map[string]string{"user": "monkey"},
+				Check:   "welcome",
+			},
+		},
+	}
+	d := NewDownloader(conf)
+	get := func(s *Session, tk *task.Task) string {
+		resp, err := d.Get(WithSession(context.Background(), s), tk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Body)
+	}
+
+	logged := d.NewSession("127.0.0.1")
+	if !logged.NeedLogin() {
+		t.Fatal("session with login config should need login")
+	}
+	if err := logged.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	parent := task.NewTask("parent", nil, srv.URL+"/list", nil)
+	child := task.NewTask("child", parent, srv.URL+"/page", nil)
+	if body := get(logged, child); body != "sid=king; theme=dark|"+parent.Url+"|t1" && body != "theme=dark; sid=king|"+parent.Url+"|t1" {
+		t.Errorf("unexpected request of logged session: %s", body)
+	}
+
+	// 其他会话的cookie和请求头互不影响
+	anonymous := d.NewSession("example.com")
+	if body := get(anonymous, child); body != "|"+parent.Url+"|" {
+		t.Errorf("sessions should be isolated: %s", body)
+	}
+
+	// 保存后在新的会话中恢复
+	cookies, changed := logged.Saved()
+	if !changed || len(cookies) != 2 {
+		t.Fatalf("expect 2 changed cookies, got %d, changed: %v", len(cookies), changed)
+	}
+	if _, changed := logged.Saved(); changed {
+		t.Error("cookies should not be changed after saved")
+	}
+	restored := d.NewSession("127.0.0.1")
+	restored.Restore(cookies)
+	if body := get(restored, task.NewTask("root", nil, srv.URL+"/page", nil)); !strings.Contains(body, "sid=king") {
+		t.Errorf("cookies should be restored: %s", body)
+	}
+
+	// 登录失败时下次重新登录
+	conf.Session.Domains["127.0.0.1"].Login.Form["user"] = "wrong"
+	failed := NewDownloader(conf).NewSession("127.0.0.1")
+	if err := failed.Login(context.Background()); err == nil || !failed.NeedLogin() {
+		t.Errorf("login should fail and be retried, err: %v", err)
+	}
+}
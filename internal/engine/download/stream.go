@@ -0,0 +1,202 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"github.com/xiaorui77/monker-king/internal/utils/fileutil"
+	"github.com/xiaorui77/monker-king/pkg/error"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PartPath 返回下载任务的临时文件路径, 与最终文件位于同一目录以便原子重命名
+func PartPath(savePath string, id uint64) string {
+	return filepath.Join(savePath, fmt.Sprintf(".%08x.part", id))
+}
+
+// stream 将响应体流式写入临时文件, 重试时通过Range/If-Range从已下载的位置继续.
+// 完成后ResponseWarp.File为临时文件路径, Body为空, 由回调负责重命名.
+func (d *Downloader) stream(ctx context.Context, t *task.Task, savePath string) (*types.ResponseWarp, error.Error) {
+	if err := os.MkdirAll(savePath, 0711); err != nil {
+		return nil, &error.Err{Code: task.ErrWriteFile, Err: fmt.Errorf("create path %v failed: %v", savePath, err)}
+	}
+	part := PartPath(savePath, t.ID)
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, &error.Err{Code: task.ErrWriteFile, Err: err}
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logx.Errorf("[downloader] Task[%08x] close %v failed: %v", t.ID, part, err)
+		}
+	}()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, &error.Err{Code: task.ErrWriteFile, Err: err}
+	}
+
+	req, err := newRequest(ctx, t)
+	if err != nil {
+		return nil, &error.Err{Err: err, Code: task.ErrNewRequest}
+	}
+	client := d.prepare(ctx, req, t)
+	// 文件按原样保存, 且Range的偏移针对未压缩的内容
+	req.Header.Set("Accept-Encoding", "identity")
+	// 没有校验值时无法确认文件未变化, 只能重新下载
+	validator, _ := t.Meta[task.MetaValidator].(string)
+	if offset > 0 && validator != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+		logx.Infof("[downloader] Task[%08x] resume download from %d bytes", t.ID, offset)
+	} else {
+		offset = 0
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logx.Warnf("[downloader] Task[%08x] do request failed: %v", t.ID, err)
+		return nil, &error.Err{Code: task.ErrDoRequest, Err: err}
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logx.Errorf("[downloader] resp.Body close fail: %v", err)
+		}
+	}()
+	res := &types.ResponseWarp{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Request:    &types.RequestWrap{URL: req.URL, Method: req.Method, BaseURL: req.URL},
+	}
+
+	start, total := int64(0), resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		first, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || first != offset || !sameValidator(validator, resp.Header) {
+			discard(t, f)
+			return nil, &error.Err{Code: task.ErrDoRequest, Err: fmt.Errorf("unexpected partial response, Content-Range: %v", resp.Header.Get("Content-Range"))}
+		}
+		start, total = offset, size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 上次已下载完整但未完成重命名
+		if _, size, _ := parseContentRange(resp.Header.Get("Content-Range")); offset > 0 && size == offset {
+			res.StatusCode = http.StatusOK
+			res.File = part
+			return res, nil
+		}
+		discard(t, f)
+		return nil, &error.Err{Code: task.ErrHttpUnknown + resp.StatusCode, Err: fmt.Errorf("range %d- not satisfiable", offset)}
+	default:
+		// 由HandleOnResponse处理错误码
+		return res, nil
+	}
+
+	if start == 0 {
+		if err := f.Truncate(0); err != nil {
+			return nil, &error.Err{Code: task.ErrWriteFile, Err: err}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, &error.Err{Code: task.ErrWriteFile, Err: err}
+		}
+	}
+	if v := validatorOf(resp.Header); v != "" {
+		t.SetMeta(task.MetaValidator, v)
+	} else {
+		delete(t.Meta, task.MetaValidator)
+	}
+
+	reader := &fileutil.VisualReader{Total: total, Cur: start, Wire: start}
+	reader.Reader = reader.CountWire(resp.Body)
+	if _, err := io.Copy(f, reader); err != nil {
+		t.SetMeta(task.MetaReader, reader) // convention：如果有错误，则记录reader
+		return nil, &error.Err{
+			Code: task.ErrReadRespBody,
+			Err:  fmt.Errorf("reading resp.Body when[%v/%v] failed: %v", reader.Cur, reader.Total, err),
+		}
+	}
+	if reader.Total >= 0 && reader.Cur != reader.Total {
+		t.SetMeta(task.MetaReader, reader)
+		return nil, &error.Err{
+			Code: task.ErrReadRespBody,
+			Err:  fmt.Errorf("incomplete body: %v/%v", reader.Cur, reader.Total),
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return nil, &error.Err{Code: task.ErrWriteFile, Err: err}
+	}
+	logx.Debugf("[downloader] Task[%08x] stream %d bytes to %v", t.ID, reader.Cur, part)
+
+	// 续传完成后视为完整的响应
+	res.StatusCode = http.StatusOK
+	res.File = part
+	res.Size = reader.Cur - start
+	res.Wire = res.Size
+	return res, nil
+}
+
+// discard 丢弃已下载的部分, 下次重新下载
+func discard(t *task.Task, f *os.File) {
+	delete(t.Meta, task.MetaValidator)
+	if err := f.Truncate(0); err != nil {
+		logx.Warnf("[downloader] Task[%08x] truncate part file failed: %v", t.ID, err)
+	}
+}
+
+// validatorOf 返回用于If-Range的校验值, 只能使用强ETag或Last-Modified
+func validatorOf(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// sameValidator 判断续传的响应与上次是否为同一文件
+func sameValidator(validator string, h http.Header) bool {
+	if strings.HasPrefix(validator, `"`) {
+		etag := h.Get("ETag")
+		return etag == "" || etag == validator
+	}
+	lastModified := h.Get("Last-Modified")
+	return lastModified == "" || lastModified == validator
+}
+
+// parseContentRange 解析 bytes first-last/size 或 bytes */size, size未知时为-1
+func parseContentRange(v string) (first, size int64, ok bool) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, false
+	}
+	v = strings.TrimPrefix(v, "bytes ")
+	i := strings.IndexByte(v, '/')
+	if i < 0 {
+		return 0, 0, false
+	}
+	size = -1
+	if s := v[i+1:]; s != "*" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		size = n
+	}
+	if r := v[:i]; r != "*" {
+		j := strings.IndexByte(r, '-')
+		if j < 0 {
+			return 0, 0, false
+		}
+		n, err := strconv.ParseInt(r[:j], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		first = n
+	}
+	return first, size, true
+}
@@ -0,0 +1,109 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestDownloader_Stream(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(config.Default().Download)
+	dir := t.TempDir()
+	newTask := func() *task.Task {
+		tk := task.NewTask("file", nil, srv.URL, nil).SetMeta(task.MetaSavePath, dir)
+		tk.ID = 1
+		return tk
+	}
+	part := PartPath(dir, 1)
+
+	cases := []struct {
+		name      string
+		partial   []byte
+		validator string
+		expect    string // 请求的Range
+	}{
+		{"fresh", nil, "", ""},
+		{"resume", content[:4000], `"v1"`, "bytes=4000-"},
+		{"changed", []byte("stale data"), `"v0"`, "bytes=10-"},
+		{"no validator", content[:4000], "", ""},
+		{"complete", content, `"v1"`, "bytes=100000-"},
+	}
+	for _, c := range cases {
+		ranges = nil
+		if err := ioutil.WriteFile(part, c.partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+		tk := newTask()
+		tk.SetMeta(task.MetaValidator, c.validator)
+		resp, err := d.Get(context.Background(), tk)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.File != part || resp.Body != nil {
+			t.Errorf("%s: unexpected response %+v", c.name, resp)
+		}
+		if len(ranges) != 1 || ranges[0] != c.expect {
+			t.Errorf("%s: expect range %q, but %q", c.name, c.expect, ranges)
+		}
+		if data, _ := ioutil.ReadFile(part); !bytes.Equal(data, content) {
+			t.Errorf("%s: content mismatch, got %d bytes", c.name, len(data))
+		}
+		if v := tk.Meta[task.MetaValidator]; c.name != "complete" && v != `"v1"` {
+			t.Errorf("%s: validator should be recorded, but %v", c.name, v)
+		}
+	}
+}
+
+func TestDownloader_StreamError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(strings.Repeat("a", 40)))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	tk := task.NewTask("file", nil, srv.URL, nil).SetMeta(task.MetaSavePath, dir)
+	if _, err := NewDownloader(config.Default().Download).Get(context.Background(), tk); err == nil || err.ErrCode() != task.ErrReadRespBody {
+		t.Fatalf("expect ErrReadRespBody, but %v", err)
+	}
+	// 保留已下载的部分用于续传
+	if data, _ := ioutil.ReadFile(PartPath(dir, tk.ID)); len(data) != 40 {
+		t.Errorf("partial data should be kept, but %d bytes", len(data))
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	cases := map[string][3]int64{
+		"bytes 0-99/100": {0, 100, 1},
+		"bytes 50-99/*":  {50, -1, 1},
+		"bytes */1000":   {0, 1000, 1},
+		"bytes 1-2":      {0, 0, 0},
+		"items 0-1/2":    {0, 0, 0},
+		"bytes x-99/100": {0, 0, 0},
+		"bytes 0-99/abc": {0, 0, 0},
+	}
+	for v, expect := range cases {
+		first, size, ok := parseContentRange(v)
+		if ok != (expect[2] == 1) || (ok && (first != expect[0] || size != expect[1])) {
+			t.Errorf("%s: unexpected %d %d %v", v, first, size, ok)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package download
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	warcVersion = "WARC/1.1"
+	// warcSpoolMemory 记录的响应体超过该大小时写入临时文件
+	warcSpoolMemory = 4 << 20
+	// warcDrainSize 响应体未读取完就关闭时, 最多继续读取的字节数
+	warcDrainSize = 64 << 10
+)
+
+type taskKey struct{}
+
+// withTask 使请求的记录中包含任务的信息
+func withTask(ctx context.Context, t *task.Task) context.Context {
+	return context.WithValue(ctx, taskKey{}, t)
+}
+
+// warcRecord WARC记录, header按顺序写入
+type warcRecord struct {
+	header [][2]string
+	block  io.Reader
+	length int64
+}
+
+func newWarcRecord(typ string, date time.Time, block []byte) *warcRecord {
+	r := &warcRecord{block: bytes.NewReader(block), length: int64(len(block))}
+	r.set("WARC-Type", typ)
+	r.set("WARC-Record-ID", newRecordID())
+	r.set("WARC-Date", date.UTC().Format(time.RFC3339Nano))
+	return r
+}
+
+func (r *warcRecord) set(key, value string) {
+	r.header = append(r.header, [2]string{key, value})
+}
+
+func (r *warcRecord) get(key string) string {
+	for _, kv := range r.header {
+		if kv[0] == key {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+func (r *warcRecord) writeTo(w io.Writer) error {
+	var head bytes.Buffer
+	head.WriteString(warcVersion + "\r\n")
+	for _, kv := range r.header {
+		head.WriteString(kv[0] + ": " + kv[1] + "\r\n")
+	}
+	head.WriteString("Content-Length: " + strconv.FormatInt(r.length, 10) + "\r\n\r\n")
+	if _, err := w.Write(head.Bytes()); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r.block); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// newRecordID 随机的UUID
+func newRecordID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6], b[8] = b[6]&0x0f|0x40, b[8]&0x3f|0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func digest(h hash.Hash) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WarcWriter 按顺序写入WARC文件, 文件超过MaxSize后写入新的文件, 每个文件以warcinfo记录开始
+type WarcWriter struct {
+	conf config.WarcConfig
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	seq  int
+}
+
+func NewWarcWriter(conf config.WarcConfig) (*WarcWriter, error) {
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &WarcWriter{conf: conf}, nil
+}
+
+// Write 将一组记录写入同一个文件
+func (w *WarcWriter) Write(records ...*warcRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil || w.size >= int64(w.conf.MaxSize) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		if err := w.write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write 需要持有mu
+func (w *WarcWriter) write(r *warcRecord) error {
+	counter := &countWriter{w: w.f}
+	if w.conf.Gzip {
+		zw := gzip.NewWriter(counter)
+		if err := r.writeTo(zw); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else if err := r.writeTo(counter); err != nil {
+		return err
+	}
+	w.size += counter.n
+	return nil
+}
+
+// rotate 关闭当前文件并创建新的文件, 需要持有mu
+func (w *WarcWriter) rotate() error {
+	if err := w.close(); err != nil {
+		logx.Warnf("[warc] close file failed: %v", err)
+	}
+	w.seq++
+	name := fmt.Sprintf("%s-%s-%05d.warc", w.conf.Prefix, time.Now().Format("20060102150405"), w.seq)
+	if w.conf.Gzip {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(filepath.Join(w.conf.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.f, w.size = f, 0
+	logx.Infof("[warc] writing to %s", f.Name())
+
+	info := newWarcRecord("warcinfo", time.Now(), []byte("software: monkey-king\r\nformat: WARC File Format 1.1\r\n"))
+	info.set("WARC-Filename", name)
+	info.set("Content-Type", "application/warc-fields")
+	return w.write(info)
+}
+
+func (w *WarcWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Close 关闭当前文件
+func (w *WarcWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// warcTransport 记录经过的每个请求和响应(包括重定向), 响应体在关闭时写入WARC文件.
+// 响应体为传输的原始内容, 未解压.
+type warcTransport struct {
+	next   http.RoundTripper
+	writer *WarcWriter
+}
+
+func (w *warcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	date := time.Now()
+	resp, err := w.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	ex := &warcExchange{
+		ReadCloser: resp.Body,
+		writer:     w.writer,
+		req:        req,
+		date:       date,
+		head:       responseHead(resp),
+		block:      sha1.New(),
+		payload:    sha1.New(),
+		spool:      &spool{},
+	}
+	ex.block.Write(ex.head)
+	resp.Body = ex
+	return resp, nil
+}
+
+// responseHead 响应的状态行和响应头, Transfer-Encoding已由Transport处理, 响应体为解除分块后的内容
+func responseHead(resp *http.Response) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\r\n", resp.Proto, resp.Status)
+	_ = resp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// requestBlock 发送的请求, 包括Cookie; 请求体无法重新获取时省略
+func requestBlock(req *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	_ = req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			_, _ = io.Copy(&buf, body)
+			_ = body.Close()
+		}
+	}
+	return buf.Bytes()
+}
+
+// warcExchange 记录读取的响应体, 关闭时写入request, response和metadata记录
+type warcExchange struct {
+	io.ReadCloser
+	writer *WarcWriter
+	req    *http.Request
+	date   time.Time
+	head   []byte
+
+	block, payload hash.Hash
+	spool          *spool
+	eof            bool
+	once           sync.Once
+}
+
+func (e *warcExchange) Read(p []byte) (int, error) {
+	n, err := e.ReadCloser.Read(p)
+	if n > 0 {
+		e.record(p[:n])
+	}
+	if err == io.EOF {
+		e.eof = true
+	}
+	return n, err
+}
+
+func (e *warcExchange) record(p []byte) {
+	e.block.Write(p)
+	e.payload.Write(p)
+	e.spool.Write(p)
+}
+
+func (e *warcExchange) Close() error {
+	e.once.Do(func() {
+		if !e.eof {
+			// 继续读取少量未读的内容, 如gzip的结尾
+			var buf bytes.Buffer
+			_, err := io.Copy(&buf, io.LimitReader(e.ReadCloser, warcDrainSize))
+			e.record(buf.Bytes())
+			if err == nil && int64(buf.Len()) < warcDrainSize {
+				e.eof = true
+			}
+		}
+		if err := e.save(); err != nil {
+			logx.Errorf("[warc] write records of %s failed: %v", e.req.URL, err)
+		}
+		e.spool.Close()
+	})
+	return e.ReadCloser.Close()
+}
+
+func (e *warcExchange) save() error {
+	body, err := e.spool.Reader()
+	if err != nil {
+		return err
+	}
+	target := e.req.URL.String()
+	resp := &warcRecord{
+		block:  io.MultiReader(bytes.NewReader(e.head), body),
+		length: int64(len(e.head)) + e.spool.size,
+	}
+	resp.set("WARC-Type", "response")
+	resp.set("WARC-Record-ID", newRecordID())
+	resp.set("WARC-Date", e.date.UTC().Format(time.RFC3339Nano))
+	resp.set("WARC-Target-URI", target)
+	resp.set("Content-Type", "application/http;msgtype=response")
+	resp.set("WARC-Block-Digest", digest(e.block))
+	resp.set("WARC-Payload-Digest", digest(e.payload))
+	if !e.eof {
+		resp.set("WARC-Truncated", "unspecified")
+	}
+	id := resp.get("WARC-Record-ID")
+
+	req := newWarcRecord("request", e.date, requestBlock(e.req))
+	req.set("WARC-Target-URI", target)
+	req.set("WARC-Concurrent-To", id)
+	req.set("Content-Type", "application/http;msgtype=request")
+
+	records := []*warcRecord{resp, req}
+	if t, ok := e.req.Context().Value(taskKey{}).(*task.Task); ok {
+		var fields bytes.Buffer
+		fmt.Fprintf(&fields, "task-id: %08x\r\n", t.ID)
+		if t.Parent != nil {
+			fmt.Fprintf(&fields, "parent-id: %08x\r\n", t.Parent.ID)
+			fmt.Fprintf(&fields, "parent-url: %s\r\n", t.Parent.Url)
+		} else if t.ParentId != 0 {
+			// 集群模式下领取的任务没有Parent, 只有ParentId
+			fmt.Fprintf(&fields, "parent-id: %08x\r\n", t.ParentId)
+		}
+		fmt.Fprintf(&fields, "depth: %d\r\n", t.Depth)
+		if t.Name != "" {
+			fmt.Fprintf(&fields, "task-name: %s\r\n", t.Name)
+		}
+		meta := newWarcRecord("metadata", e.date, fields.Bytes())
+		meta.set("WARC-Target-URI", target)
+		meta.set("WARC-Refers-To", id)
+		meta.set("Content-Type", "application/warc-fields")
+		records = append(records, meta)
+	}
+	return e.writer.Write(records...)
+}
+
+// spool 暂存响应体, 超过warcSpoolMemory后写入临时文件
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+	err  error // 写入临时文件失败后不再写入, 记录被丢弃
+}
+
+func (s *spool) Write(p []byte) {
+	if s.err != nil {
+		return
+	}
+	s.size += int64(len(p))
+	if s.file == nil && s.buf.Len()+len(p) <= warcSpoolMemory {
+		s.buf.Write(p)
+		return
+	}
+	if s.file == nil {
+		if s.file, s.err = ioutil.TempFile("", "monkey-king-warc-*"); s.err != nil {
+			return
+		}
+		if _, s.err = s.file.Write(s.buf.Bytes()); s.err != nil {
+			return
+		}
+		s.buf.Reset()
+	}
+	_, s.err = s.file.Write(p)
+}
+
+// Reader 读取暂存的全部内容
+func (s *spool) Reader() (io.Reader, error) {
+	if s.err != nil {
+		return nil, fmt.Errorf("spool response failed: %v", s.err)
+	}
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+func (s *spool) Close() {
+	if s.file != nil {
+		_ = s.file.Close()
+		_ = os.Remove(s.file.Name())
+	}
+}
@@ -0,0 +1,167 @@
+package download
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestWarc_WriteAndReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/page/1", http.StatusMovedPermanently)
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			_, _ = zw.Write([]byte("<p>compressed</p>"))
+			_ = zw.Close()
+		default:
+			_, _ = w.Write([]byte("<p>" + r.URL.Path + "</p>"))
+		}
+	}))
+	defer srv.Close()
+
+	for _, gz := range []bool{true, false} {
+		conf := config.Default().Download
+		conf.Warc.Dir = t.TempDir()
+		conf.Warc.Gzip = gz
+		conf.Warc.MaxSize = 1024
+		d := NewDownloader(conf)
+		root := task.NewTask("root", nil, srv.URL+"/page/0", nil)
+		for _, path := range []string{"/page/0", "/old", "/gzip", "/page/2", "/page/3"} {
+			tk := task.NewTask("page", root, srv.URL+path, nil)
+			if path == "/page/3" {
+				// 集群模式下领取的任务只有ParentId
+				tk = task.NewTask("page", nil, srv.URL+path, nil)
+				tk.ParentId = root.ID
+			}
+			if _, err := d.Get(context.Background(), tk); err != nil {
+				t.Fatalf("gzip %v, %s: %v", gz, path, err)
+			}
+		}
+		d.Close()
+
+		files, _ := filepath.Glob(filepath.Join(conf.Warc.Dir, "*"))
+		if len(files) < 2 {
+			t.Fatalf("gzip %v: expect rotated files, got %v", gz, files)
+		}
+		var types []string
+		for _, file := range files {
+			if gz != strings.HasSuffix(file, ".warc.gz") {
+				t.Errorf("unexpected file name %s", file)
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var inFile []string
+			r := newWarcReader(f, gz)
+			for {
+				_, header, block, err := r.next()
+				if err != nil {
+					break
+				}
+				inFile = append(inFile, header["warc-type"])
+				if header["warc-type"] == "metadata" {
+					b, _ := ioutil.ReadAll(block)
+					if !strings.Contains(string(b), fmt.Sprintf("parent-id: %08x", root.ID)) {
+						t.Errorf("metadata without parent: %q", b)
+					}
+				}
+			}
+			_ = f.Close()
+			if len(inFile) == 0 || inFile[0] != "warcinfo" {
+				t.Fatalf("file %s should start with warcinfo", file)
+			}
+			types = append(types, inFile[1:]...)
+		}
+		// 重定向也单独记录, 共6次请求
+		if len(types) != 18 {
+			t.Errorf("gzip %v: expect 18 records, got %v", gz, types)
+		}
+
+		conf.Warc.Replay = []string{filepath.Join(conf.Warc.Dir, "*")}
+		replayer, err := NewReplayer(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			path, body string
+		}{
+			{"/page/0", "<p>/page/0</p>"},
+			{"/old", "<p>/page/1</p>"},
+			{"/gzip", "<p>compressed</p>"},
+			{"/page/3#top", "<p>/page/3</p>"},
+		}
+		for _, c := range cases {
+			resp, err := replayer.Get(context.Background(), task.NewTask("page", nil, srv.URL+c.path, nil))
+			if err != nil {
+				t.Fatalf("gzip %v, replay %s: %v", gz, c.path, err)
+			}
+			if resp.StatusCode != http.StatusOK || string(resp.Body) != c.body {
+				t.Errorf("gzip %v, replay %s: unexpected response %d %q", gz, c.path, resp.StatusCode, resp.Body)
+			}
+		}
+		if _, err := replayer.Get(context.Background(), task.NewTask("page", nil, srv.URL+"/page/4", nil)); err == nil {
+			t.Errorf("url not in warc files should fail")
+		}
+	}
+}
+
+func TestReplayer_SkipIncompleteResponses(t *testing.T) {
+	conf := config.Default().Download
+	conf.Warc.Dir = t.TempDir()
+	w, err := NewWarcWriter(conf.Warc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := func(url, head, body string) *warcRecord {
+		r := newWarcRecord("response", time.Now(), []byte(head+"\r\n\r\n"+body))
+		r.set("WARC-Target-URI", url)
+		return r
+	}
+	truncated := response("http://example.com/page", "HTTP/1.1 200 OK\r\nContent-Length: 8", "fu")
+	truncated.set("WARC-Truncated", "unspecified")
+	// 重新验证得到的304, 范围请求得到的206和被截断的响应在200之后记录
+	records := []*warcRecord{
+		response("http://example.com/page", "HTTP/1.1 200 OK\r\nETag: \"v1\"\r\nContent-Length: 4", "full"),
+		response("http://example.com/page", "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"", ""),
+		response("http://example.com/page", "HTTP/1.1 206 Partial Content\r\nContent-Range: bytes 0-1/4\r\nContent-Length: 2", "fu"),
+		truncated,
+		response("http://example.com/missing", "HTTP/1.1 404 Not Found\r\nContent-Length: 4", "gone"),
+	}
+	if err := w.Write(records...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.Warc.Replay = []string{filepath.Join(conf.Warc.Dir, "*")}
+	replayer, err := NewReplayer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err2 := replayer.Get(context.Background(), task.NewTask("page", nil, "http://example.com/page", nil))
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "full" {
+		t.Errorf("expect the 200 response, got %d %q", resp.StatusCode, resp.Body)
+	}
+	if _, err := replayer.Get(context.Background(), task.NewTask("page", nil, "http://example.com/missing", nil)); err == nil {
+		t.Errorf("url with only error responses should fail")
+	}
+}
@@ -0,0 +1,151 @@
+package item
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	ExporterJSONLines = "jsonl"
+	ExporterCSV       = "csv"
+	ExporterSQL       = "sql"
+
+	FieldUrl = "_url" // 导出时附加的来源地址
+)
+
+// Exporter 将Item输出到外部
+type Exporter interface {
+	Export(s *Schema, it *Item) error
+	Close() error
+}
+
+// fileExporter 每个Schema对应一个文件, 路径中的{item}会被替换为Schema名称
+type fileExporter struct {
+	mu      sync.Mutex
+	pattern string
+	files   map[string]*os.File
+	open    func(s *Schema, f *os.File, fresh bool) (write func(it *Item) error, err error)
+	writers map[string]func(it *Item) error
+}
+
+func newFileExporter(pattern string) *fileExporter {
+	if !strings.Contains(pattern, "{item}") {
+		ext := filepath.Ext(pattern)
+		pattern = strings.TrimSuffix(pattern, ext) + "-{item}" + ext
+	}
+	return &fileExporter{
+		pattern: pattern,
+		files:   map[string]*os.File{},
+		writers: map[string]func(it *Item) error{},
+	}
+}
+
+func (e *fileExporter) Export(s *Schema, it *Item) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	write, ok := e.writers[s.Name]
+	if !ok {
+		path := strings.ReplaceAll(e.pattern, "{item}", s.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0711); err != nil {
+			return fmt.Errorf("create path %v failed: %v", filepath.Dir(path), err)
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		if write, err = e.open(s, f, stat.Size() == 0); err != nil {
+			_ = f.Close()
+			return err
+		}
+		e.files[s.Name] = f
+		e.writers[s.Name] = write
+	}
+	return write(it)
+}
+
+func (e *fileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var err error
+	for name, f := range e.files {
+		if cErr := f.Close(); cErr != nil {
+			err = cErr
+		}
+		delete(e.files, name)
+		delete(e.writers, name)
+	}
+	return err
+}
+
+// NewJSONLinesExporter 每行一个JSON对象
+func NewJSONLinesExporter(pattern string) Exporter {
+	e := newFileExporter(pattern)
+	e.open = func(s *Schema, f *os.File, _ bool) (func(it *Item) error, error) {
+		enc := json.NewEncoder(f)
+		return func(it *Item) error {
+			row := make(map[string]interface{}, len(it.Fields)+1)
+			for k, v := range it.Fields {
+				row[k] = v
+			}
+			row[FieldUrl] = it.Url
+			return enc.Encode(row)
+		}, nil
+	}
+	return e
+}
+
+// NewCSVExporter 按Schema中字段的顺序输出, 新文件会写入表头
+func NewCSVExporter(pattern string) Exporter {
+	e := newFileExporter(pattern)
+	e.open = func(s *Schema, f *os.File, fresh bool) (func(it *Item) error, error) {
+		w := csv.NewWriter(f)
+		if fresh {
+			header := make([]string, 0, len(s.Fields)+1)
+			for _, field := range s.Fields {
+				header = append(header, field.Name)
+			}
+			if err := w.Write(append(header, FieldUrl)); err != nil {
+				return nil, err
+			}
+		}
+		return func(it *Item) error {
+			record := make([]string, 0, len(s.Fields)+1)
+			for _, field := range s.Fields {
+				record = append(record, fmt.Sprint(it.Fields[field.Name]))
+			}
+			if err := w.Write(append(record, it.Url)); err != nil {
+				return err
+			}
+			w.Flush()
+			return w.Error()
+		}, nil
+	}
+	return e
+}
+
+// NewExporter 根据类型创建Exporter, sql类型使用db
+func NewExporter(typ, path string, db *gorm.DB) (Exporter, error) {
+	switch typ {
+	case ExporterJSONLines:
+		return NewJSONLinesExporter(path), nil
+	case ExporterCSV:
+		return NewCSVExporter(path), nil
+	case ExporterSQL:
+		if db == nil {
+			return nil, fmt.Errorf("sql exporter requires storage")
+		}
+		return NewSQLExporter(db)
+	}
+	return nil, fmt.Errorf("unknown exporter type: %s", typ)
+}
@@ -0,0 +1,185 @@
+package item
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+	TypeURL    = "url" // 转换为绝对地址
+)
+
+var (
+	intRe   = regexp.MustCompile(`-?\d+`)
+	floatRe = regexp.MustCompile(`-?\d+(\.\d+)?`)
+)
+
+// Schema 描述一种结构化数据
+type Schema struct {
+	Name   string   `yaml:"name" json:"name"`
+	Fields []*Field `yaml:"fields" json:"fields"`
+	// Key 用于去重的字段, 为空时不去重
+	Key []string `yaml:"key" json:"key"`
+}
+
+// Field 绑定到选择器/属性的字段
+type Field struct {
+	Name     string `yaml:"name" json:"name"`
+	Selector string `yaml:"selector" json:"selector"` // 相对于当前元素, 为空时取当前元素
+	Global   bool   `yaml:"global" json:"global"`     // Selector在整个页面中查找
+	Attr     string `yaml:"attr" json:"attr"`         // 为空时取文本
+	Type     string `yaml:"type" json:"type"`         // 默认string
+	Required bool   `yaml:"required" json:"required"`
+	Default  string `yaml:"default" json:"default"`
+}
+
+// Item 一条提取出的数据
+type Item struct {
+	Schema string
+	Key    string // 去重key, 为空表示不去重
+	Url    string
+	TaskId uint64
+	Fields map[string]interface{}
+}
+
+// Validate 校验并填充默认值
+func (s *Schema) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("item name is required")
+	}
+	if len(s.Fields) == 0 {
+		return fmt.Errorf("item %s: fields is required", s.Name)
+	}
+	names := make(map[string]bool, len(s.Fields))
+	for i, f := range s.Fields {
+		if f == nil || f.Name == "" {
+			return fmt.Errorf("item %s: fields[%d] name is required", s.Name, i)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("item %s: duplicate field %s", s.Name, f.Name)
+		}
+		names[f.Name] = true
+		switch f.Type {
+		case "":
+			f.Type = TypeString
+		case TypeString, TypeInt, TypeFloat, TypeBool, TypeURL:
+		default:
+			return fmt.Errorf("item %s: field %s has unknown type %q", s.Name, f.Name, f.Type)
+		}
+	}
+	for _, k := range s.Key {
+		if !names[k] {
+			return fmt.Errorf("item %s: key %s is not a field", s.Name, k)
+		}
+	}
+	return nil
+}
+
+// Extract 从元素中提取Item, doc为整个页面, sel为当前元素, base用于计算绝对地址
+func (s *Schema) Extract(doc *goquery.Document, sel *goquery.Selection, base *url.URL) (*Item, error) {
+	it := &Item{
+		Schema: s.Name,
+		Fields: make(map[string]interface{}, len(s.Fields)),
+	}
+	if base != nil {
+		it.Url = base.String()
+	}
+	for _, f := range s.Fields {
+		v, err := f.extract(doc, sel, base)
+		if err != nil {
+			return nil, fmt.Errorf("item %s: %v", s.Name, err)
+		}
+		it.Fields[f.Name] = v
+	}
+	it.Key = s.key(it)
+	return it, nil
+}
+
+// key 计算去重key
+func (s *Schema) key(it *Item) string {
+	if len(s.Key) == 0 {
+		return ""
+	}
+	h := sha1.New()
+	h.Write([]byte(s.Name))
+	for _, k := range s.Key {
+		h.Write([]byte{0})
+		h.Write([]byte(fmt.Sprint(it.Fields[k])))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (f *Field) extract(doc *goquery.Document, sel *goquery.Selection, base *url.URL) (interface{}, error) {
+	target := sel
+	if f.Selector != "" {
+		if f.Global {
+			target = doc.Find(f.Selector).First()
+		} else {
+			target = sel.Find(f.Selector).First()
+		}
+	}
+	var raw string
+	if f.Attr == "" {
+		raw = target.Text()
+	} else {
+		raw, _ = target.Attr(f.Attr)
+	}
+	if raw = strings.TrimSpace(raw); raw == "" {
+		raw = f.Default
+	}
+	if raw == "" && f.Required {
+		return nil, fmt.Errorf("field %s is required", f.Name)
+	}
+	v, err := f.coerce(raw, base)
+	if err != nil && f.Required {
+		return nil, err
+	}
+	return v, nil
+}
+
+// coerce 将文本转换为字段类型, 数字类型取文本中的第一个数字
+func (f *Field) coerce(raw string, base *url.URL) (interface{}, error) {
+	switch f.Type {
+	case TypeInt:
+		n, err := strconv.ParseInt(intRe.FindString(strings.ReplaceAll(raw, ",", "")), 10, 64)
+		if err != nil {
+			return int64(0), fmt.Errorf("field %s: %q is not int", f.Name, raw)
+		}
+		return n, nil
+	case TypeFloat:
+		n, err := strconv.ParseFloat(floatRe.FindString(strings.ReplaceAll(raw, ",", "")), 64)
+		if err != nil {
+			return float64(0), fmt.Errorf("field %s: %q is not float", f.Name, raw)
+		}
+		return n, nil
+	case TypeBool:
+		switch strings.ToLower(raw) {
+		case "1", "true", "yes", "y", "on", "是":
+			return true, nil
+		case "", "0", "false", "no", "n", "off", "否":
+			return false, nil
+		}
+		return false, fmt.Errorf("field %s: %q is not bool", f.Name, raw)
+	case TypeURL:
+		if raw == "" || base == nil {
+			return raw, nil
+		}
+		u, err := base.Parse(raw)
+		if err != nil {
+			return raw, fmt.Errorf("field %s: %q is not url", f.Name, raw)
+		}
+		u.Fragment = ""
+		return u.String(), nil
+	}
+	return raw, nil
+}
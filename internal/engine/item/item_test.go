@@ -0,0 +1,130 @@
+package item
+
+import (
+	"github.com/PuerkitoBio/goquery"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const page = `<html><body><h1>Books</h1>
+<div class="book"><a href="/b/1">Go</a><span class="price">￥1,299.50</span><i>是</i></div>
+<div class="book"><a href="/b/2">Rust</a><span class="price">免费</span></div>
+<div class="book"><a href="/b/1">Go again</a><span class="price">10</span></div>
+</body></html>`
+
+func newSchema() *Schema {
+	return &Schema{
+		Name: "book",
+		Key:  []string{"link"},
+		Fields: []*Field{
+			{Name: "title", Selector: "a", Required: true},
+			{Name: "link", Selector: "a", Attr: "href", Type: TypeURL},
+			{Name: "price", Selector: ".price", Type: TypeFloat},
+			{Name: "stock", Selector: "i", Type: TypeBool},
+			{Name: "category", Selector: "h1", Global: true},
+		},
+	}
+}
+
+func extractAll(t *testing.T, s *Schema) []*Item {
+	doc, _ := goquery.NewDocumentFromReader(strings.NewReader(page))
+	base, _ := url.Parse("https://example.com/list?p=1")
+	items := make([]*Item, 0)
+	doc.Find("div.book").Each(func(_ int, sel *goquery.Selection) {
+		it, err := s.Extract(doc, sel, base)
+		if err != nil {
+			t.Fatalf("extract failed: %v", err)
+		}
+		items = append(items, it)
+	})
+	return items
+}
+
+func TestSchema_Extract(t *testing.T) {
+	s := newSchema()
+	if err := s.Validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	items := extractAll(t, s)
+	first := items[0].Fields
+	if first["title"] != "Go" || first["link"] != "https://example.com/b/1" || first["price"] != 1299.5 ||
+		first["stock"] != true || first["category"] != "Books" {
+		t.Errorf("unexpected item: %v", first)
+	}
+	// 无法转换的非必填字段取零值
+	if items[1].Fields["price"] != float64(0) || items[1].Fields["stock"] != false {
+		t.Errorf("unexpected item: %v", items[1].Fields)
+	}
+	if items[0].Key == "" || items[0].Key != items[2].Key || items[0].Key == items[1].Key {
+		t.Errorf("unexpected keys: %s %s %s", items[0].Key, items[1].Key, items[2].Key)
+	}
+}
+
+func TestSchema_Validate(t *testing.T) {
+	cases := []*Schema{
+		{Fields: []*Field{{Name: "a"}}},
+		{Name: "x"},
+		{Name: "x", Fields: []*Field{{Name: "a", Type: "date"}}},
+		{Name: "x", Fields: []*Field{{Name: "a"}}, Key: []string{"b"}},
+	}
+	for i, s := range cases {
+		if err := s.Validate(); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}
+
+func TestPipeline_CSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "{item}.csv")
+	p := NewPipeline()
+	s := newSchema()
+	if err := p.Declare(s); err != nil {
+		t.Fatalf("declare failed: %v", err)
+	}
+	p.AddExporter(NewCSVExporter(path))
+	for _, it := range extractAll(t, s) {
+		if err := p.Emit(it); err != nil {
+			t.Fatalf("emit failed: %v", err)
+		}
+	}
+	p.Close()
+
+	data, _ := os.ReadFile(strings.ReplaceAll(path, "{item}", "book"))
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "title,link,price,stock,category,_url" {
+		t.Errorf("unexpected csv: %s", data)
+	}
+}
+
+type countExporter struct{ n int }
+
+func (e *countExporter) Export(*Schema, *Item) error { e.n++; return nil }
+func (e *countExporter) Close() error                { return nil }
+
+func TestPipeline_Processor(t *testing.T) {
+	p := NewPipeline()
+	if err := p.Declare(newSchema()); err != nil {
+		t.Fatalf("declare failed: %v", err)
+	}
+	// 第一次丢弃, 之后通过
+	calls := 0
+	p.Use(func(it *Item) (*Item, error) {
+		if calls++; calls == 1 {
+			return nil, nil
+		}
+		return it, nil
+	})
+	e := &countExporter{}
+	p.AddExporter(e)
+	for i := 0; i < 3; i++ {
+		if err := p.Emit(&Item{Schema: "book", Key: "k1"}); err != nil {
+			t.Fatalf("emit failed: %v", err)
+		}
+	}
+	if e.n != 1 {
+		t.Errorf("rejected item should be emitted again once, got %d exports", e.n)
+	}
+}
@@ -0,0 +1,118 @@
+package item
+
+import (
+	"fmt"
+	"github.com/xiaorui77/goutils/logx"
+	"sync"
+)
+
+// Processor 处理Item, 返回nil表示丢弃
+type Processor func(it *Item) (*Item, error)
+
+// Pipeline Item依次经过去重, Processor, 然后发送到所有Exporter
+type Pipeline struct {
+	mu         sync.Mutex
+	schemas    map[string]*Schema
+	seen       map[string]struct{}
+	processors []Processor
+	exporters  []Exporter
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		schemas: map[string]*Schema{},
+		seen:    map[string]struct{}{},
+	}
+}
+
+// Declare 声明Schema, 同名的会被覆盖
+func (p *Pipeline) Declare(s *Schema) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.schemas[s.Name] = s
+	return nil
+}
+
+func (p *Pipeline) Schema(name string) *Schema {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.schemas[name]
+}
+
+func (p *Pipeline) Use(processor Processor) *Pipeline {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processors = append(p.processors, processor)
+	return p
+}
+
+func (p *Pipeline) AddExporter(e Exporter) *Pipeline {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exporters = append(p.exporters, e)
+	return p
+}
+
+// Emit 发送Item, 重复的Item会被忽略.
+// Item通过所有Processor后才记录为已发送, 被丢弃或出错的Item在任务重试时可以再次发送.
+// Processor和Exporter在锁外执行, Exporter需要自行保证并发安全.
+func (p *Pipeline) Emit(it *Item) error {
+	p.mu.Lock()
+	s, ok := p.schemas[it.Schema]
+	processors, exporters := p.processors, p.exporters
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("item %s is not declared", it.Schema)
+	}
+	if p.duplicated(it.Schema, it.Key, false) {
+		return nil
+	}
+
+	var err error
+	for _, processor := range processors {
+		if it, err = processor(it); err != nil || it == nil {
+			return err
+		}
+	}
+	// 并发处理相同Key的Item时只导出第一个完成的
+	if p.duplicated(it.Schema, it.Key, true) {
+		return nil
+	}
+	for _, e := range exporters {
+		if err := e.Export(s, it); err != nil {
+			logx.Warnf("[pipeline] export item %s[%s] failed: %v", it.Schema, it.Key, err)
+		}
+	}
+	return nil
+}
+
+// duplicated Key是否已经发送过, mark为true时将未发送的Key记录为已发送
+func (p *Pipeline) duplicated(schema, key string, mark bool) bool {
+	if key == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.seen[key]; ok {
+		logx.Debugf("[pipeline] item %s[%s] is duplicated, skip", schema, key)
+		return true
+	}
+	if mark {
+		p.seen[key] = struct{}{}
+	}
+	return false
+}
+
+// Close 关闭所有Exporter
+func (p *Pipeline) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.exporters {
+		if err := e.Close(); err != nil {
+			logx.Warnf("[pipeline] close exporter failed: %v", err)
+		}
+	}
+}
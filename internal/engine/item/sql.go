@@ -0,0 +1,60 @@
+package item
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Record 以JSON形式保存在SQL表中的Item
+type Record struct {
+	Id         uint64 `gorm:"primaryKey;autoIncrement"`
+	Schema     string `gorm:"size:64;uniqueIndex:idx_item_key"`
+	Key        string `gorm:"size:64;uniqueIndex:idx_item_key"` // 为空时不去重
+	Url        string
+	TaskId     uint64
+	Data       string
+	CreateTime time.Time
+}
+
+func (Record) TableName() string {
+	return "items"
+}
+
+type sqlExporter struct {
+	db *gorm.DB
+}
+
+// NewSQLExporter 保存到items表, 相同Schema和Key的Item只保存一次
+func NewSQLExporter(db *gorm.DB) (Exporter, error) {
+	if err := db.AutoMigrate(&Record{}); err != nil {
+		return nil, fmt.Errorf("migrate items table failed: %v", err)
+	}
+	return &sqlExporter{db: db}, nil
+}
+
+func (e *sqlExporter) Export(_ *Schema, it *Item) error {
+	data, err := json.Marshal(it.Fields)
+	if err != nil {
+		return err
+	}
+	r := &Record{
+		Schema:     it.Schema,
+		Key:        it.Key,
+		Url:        it.Url,
+		TaskId:     it.TaskId,
+		Data:       string(data),
+		CreateTime: time.Now(),
+	}
+	if r.Key == "" {
+		// 不去重时使用唯一值避免冲突
+		r.Key = fmt.Sprintf("%d-%d", it.TaskId, r.CreateTime.UnixNano())
+	}
+	return e.db.Clauses(clause.OnConflict{DoNothing: true}).Create(r).Error
+}
+
+func (e *sqlExporter) Close() error {
+	return nil
+}
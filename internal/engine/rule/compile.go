@@ -0,0 +1,166 @@
+package rule
+
+import (
+	"fmt"
+	"github.com/xiaorui77/goutils/fileutils"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/collector"
+	"github.com/xiaorui77/monker-king/internal/engine/item"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"net/url"
+	"strings"
+)
+
+// defaultDownloadName 下载时名称为空时使用的{name}
+const defaultDownloadName = "download"
+
+// Apply 将规则编译为HtmlCallback注册到Collector, 并访问所有种子URL
+func Apply(c *collector.Collector, f *File) error {
+	for _, s := range f.Items {
+		if err := c.DeclareItem(s); err != nil {
+			return err
+		}
+	}
+	exporters := f.Exporters
+	if len(exporters) == 0 && len(f.Items) > 0 {
+		exporters = []*Exporter{{Type: item.ExporterJSONLines, Path: fmt.Sprintf("%v/{item}.jsonl", f.Output)}}
+	}
+	for _, conf := range exporters {
+		e, err := item.NewExporter(conf.Type, conf.Path, c.Storage().GetDB())
+		if err != nil {
+			return err
+		}
+		c.Pipeline().AddExporter(e)
+	}
+
+	for name, p := range f.Retry {
+		if err := c.RetryPolicies().Set(name, p); err != nil {
+			return err
+		}
+	}
+	for domain, name := range f.RetryDomains {
+		if err := c.RetryPolicies().SetDomain(domain, name); err != nil {
+			return fmt.Errorf("retry_domains.%s: %v", domain, err)
+		}
+	}
+	for i, r := range f.Rules {
+		if r.Retry != "" && !c.RetryPolicies().Has(r.Retry) {
+			return fmt.Errorf("rules[%d]: retry policy %q not found", i, r.Retry)
+		}
+	}
+
+	for _, r := range f.Rules {
+		c.OnHTMLAny(r.Selector, r.compile(c, f.Output))
+	}
+	logx.Infof("[rule] rule file %s applied, %d rules", f.Name, len(f.Rules))
+
+	for _, seed := range f.Seeds {
+		if err := c.Visit(seed); err != nil {
+			return fmt.Errorf("visit seed %v failed: %v", seed, err)
+		}
+	}
+	for i, s := range f.Sitemaps {
+		if err := c.VisitSitemap(s); err != nil {
+			return fmt.Errorf("sitemaps[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) compile(c *collector.Collector, output string) collector.HtmlCallback {
+	switch r.Action {
+	case ActionVisit, ActionPaging:
+		resetDepth := r.ResetDepth || r.Action == ActionPaging
+		opts := r.options()
+		if r.Fetcher != "" {
+			opts = append(opts, task.WithMeta(task.MetaFetcher, r.Fetcher))
+		}
+		return func(t *task.Task, e *collector.HTMLElement) {
+			u := e.GetAttr(r.Attr)
+			if u == "" {
+				return
+			}
+			_ = e.Visit(fallback(r.Name.Resolve(e), u), u, resetDepth, opts...)
+		}
+	case ActionDownload:
+		opts := r.options()
+		return func(t *task.Task, e *collector.HTMLElement) {
+			u, file, path, ok := r.download(e)
+			if !ok {
+				return
+			}
+			_ = c.Download(t, file, fmt.Sprintf("%v/%v", output, path), u, opts...)
+		}
+	case ActionSubmit:
+		opts := r.options()
+		if r.Fetcher != "" {
+			opts = append(opts, task.WithMeta(task.MetaFetcher, r.Fetcher))
+		}
+		values := url.Values{}
+		for k, v := range r.Form {
+			values.Set(k, v)
+		}
+		return func(t *task.Task, e *collector.HTMLElement) {
+			_ = e.Submit(r.Name.Resolve(e), values, opts...)
+		}
+	case ActionExtract:
+		return func(t *task.Task, e *collector.HTMLElement) {
+			_ = e.EmitItem(r.Item)
+		}
+	}
+	return func(t *task.Task, e *collector.HTMLElement) {}
+}
+
+// download 返回下载的URL, 文件名和相对于Output的目录, 元素没有链接属性时ok为false
+func (r *Rule) download(e *collector.HTMLElement) (u, file, path string, ok bool) {
+	raw := e.GetAttr(r.Attr)
+	if raw == "" {
+		return "", "", "", false
+	}
+	// AbsoluteURL对空字符串返回页面本身, 因此先检查属性
+	if u = e.Request.AbsoluteURL(raw); u == "" {
+		return "", "", "", false
+	}
+	name := fallback(fileutils.WindowsName(r.Name.Resolve(e)), defaultDownloadName)
+	return u, expand(r.File, name, e.Index), expand(r.Path, name, e.Index), true
+}
+
+// options 新任务的公共选项
+func (r *Rule) options() []task.Option {
+	var opts []task.Option
+	if r.Retry != "" {
+		opts = append(opts, task.WithMeta(task.MetaRetry, r.Retry))
+	}
+	return opts
+}
+
+// Resolve 从元素中取值, 取不到时返回Default
+func (v Value) Resolve(e *collector.HTMLElement) string {
+	var s string
+	if v.Selector == "" {
+		if v.Attr == "" {
+			s = e.Text()
+		} else {
+			s = e.GetAttr(v.Attr)
+		}
+	} else {
+		sel := e.Doc.Find(v.Selector).First()
+		if v.Attr == "" {
+			s = sel.Text()
+		} else {
+			s, _ = sel.Attr(v.Attr)
+		}
+	}
+	return fallback(strings.TrimSpace(s), v.Default)
+}
+
+func expand(pattern, name string, index int) string {
+	return strings.NewReplacer("{name}", name, "{index}", fmt.Sprintf("%03d", index)).Replace(pattern)
+}
+
+func fallback(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
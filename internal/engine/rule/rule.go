@@ -0,0 +1,168 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/download"
+	"github.com/xiaorui77/monker-king/internal/engine/item"
+	"github.com/xiaorui77/monker-king/internal/engine/sitemap"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ActionVisit    = "visit"    // 访问链接
+	ActionPaging   = "paging"   // 下一页, 等同于visit并重置深度
+	ActionDownload = "download" // 下载资源
+	ActionExtract  = "extract"  // 提取字段
+	ActionSubmit   = "submit"   // 提交元素所在的表单
+)
+
+// File 规则文件, 描述一个站点的爬取方式
+type File struct {
+	Name  string   `yaml:"name" json:"name"`
+	Seeds []string `yaml:"seeds" json:"seeds"` // 起始URL
+	// Sitemaps 从sitemap中发现起始URL
+	Sitemaps []*sitemap.Options `yaml:"sitemaps" json:"sitemaps"`
+	Output   string             `yaml:"output" json:"output"` // 输出根目录, 默认为配置中的output
+	Rules    []*Rule            `yaml:"rules" json:"rules"`
+
+	Items     []*item.Schema `yaml:"items" json:"items"`         // extract使用的结构化数据
+	Exporters []*Exporter    `yaml:"exporters" json:"exporters"` // 为空时输出到<output>/{item}.jsonl
+
+	// Retry 命名的重试策略, 未设置的字段使用配置中默认策略的值, 与配置中同名时覆盖
+	Retry map[string]config.RetryPolicy `yaml:"retry" json:"retry"`
+	// RetryDomains 域名使用的重试策略名称
+	RetryDomains map[string]string `yaml:"retry_domains" json:"retry_domains"`
+}
+
+// Exporter Item的输出方式
+type Exporter struct {
+	Type string `yaml:"type" json:"type"` // jsonl, csv, sql
+	Path string `yaml:"path" json:"path"` // 文件路径, 支持{item}, sql忽略
+}
+
+// Rule 匹配到Selector的每个元素执行Action
+type Rule struct {
+	Selector string `yaml:"selector" json:"selector"`
+	Action   string `yaml:"action" json:"action"`
+
+	// Attr 链接所在的属性, visit/paging默认href, download默认src
+	Attr string `yaml:"attr" json:"attr"`
+	// Name 任务名称, download时作为文件名和目录的{name}
+	Name Value `yaml:"name" json:"name"`
+	// Fetcher 新任务获取页面的方式, http或render, 为空时按域名配置
+	Fetcher string `yaml:"fetcher" json:"fetcher"`
+	// ResetDepth 新任务的深度置为0
+	ResetDepth bool `yaml:"reset_depth" json:"reset_depth"`
+	// Retry 新任务使用的重试策略名称, 在retry或配置中声明, 为空时按域名选择
+	Retry string `yaml:"retry" json:"retry"`
+
+	// File 下载保存的文件名, 支持{name}和{index}, 默认"{name}-{index}"
+	File string `yaml:"file" json:"file"`
+	// Path 下载保存的目录, 相对于Output, 支持{name}, 默认"{name}"
+	Path string `yaml:"path" json:"path"`
+
+	// Item extract提取的结构化数据名称, 在items中声明
+	Item string `yaml:"item" json:"item"`
+
+	// Form submit时覆盖表单中的字段
+	Form map[string]string `yaml:"form" json:"form"`
+}
+
+// Value 描述如何从元素中取值
+type Value struct {
+	Selector string `yaml:"selector" json:"selector"` // 在整个页面中查找, 为空时取当前元素
+	Attr     string `yaml:"attr" json:"attr"`         // 为空时取文本
+	Default  string `yaml:"default" json:"default"`
+}
+
+// Load 加载规则文件, 以.json结尾的按JSON解析, 其他按YAML解析.
+// output为规则文件未设置输出目录时使用的默认值.
+func Load(path, output string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rule file %v failed: %v", path, err)
+	}
+	f := &File{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, f)
+	} else {
+		err = yaml.UnmarshalStrict(data, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse rule file %v failed: %v", path, err)
+	}
+	if f.Name == "" {
+		f.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if f.Output == "" {
+		f.Output = output
+	}
+	if err := f.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rule file %v: %v", path, err)
+	}
+	return f, nil
+}
+
+// Validate 校验并填充默认值
+func (f *File) Validate() error {
+	if f.Output == "" {
+		return fmt.Errorf("output is required")
+	}
+	items := make(map[string]bool, len(f.Items))
+	for _, s := range f.Items {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		items[s.Name] = true
+	}
+	for i, e := range f.Exporters {
+		switch e.Type {
+		case item.ExporterJSONLines, item.ExporterCSV:
+			if e.Path == "" {
+				e.Path = fmt.Sprintf("%v/{item}.%v", f.Output, e.Type)
+			}
+		case item.ExporterSQL:
+		default:
+			return fmt.Errorf("exporters[%d]: unknown type %q", i, e.Type)
+		}
+	}
+	for i, r := range f.Rules {
+		if r == nil || r.Selector == "" {
+			return fmt.Errorf("rules[%d]: selector is required", i)
+		}
+		switch r.Fetcher {
+		case "", download.FetcherHTTP, download.FetcherRender:
+		default:
+			return fmt.Errorf("rules[%d]: unknown fetcher %q", i, r.Fetcher)
+		}
+		switch r.Action {
+		case ActionVisit, ActionPaging:
+			if r.Attr == "" {
+				r.Attr = "href"
+			}
+		case ActionDownload:
+			if r.Attr == "" {
+				r.Attr = "src"
+			}
+			if r.File == "" {
+				r.File = "{name}-{index}"
+			}
+			if r.Path == "" {
+				r.Path = "{name}"
+			}
+		case ActionSubmit:
+		case ActionExtract:
+			if !items[r.Item] {
+				return fmt.Errorf("rules[%d]: item %q is not declared", i, r.Item)
+			}
+		default:
+			return fmt.Errorf("rules[%d]: unknown action %q", i, r.Action)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package rule
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/xiaorui77/monker-king/internal/engine/collector"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+)
+
+func TestLoad(t *testing.T) {
+	f, err := Load("../../../rules/example.yaml", "./data")
+	if err != nil {
+		t.Fatalf("load example rule failed: %v", err)
+	}
+	if len(f.Rules) != 3 || f.Rules[1].Attr != "href" || f.Rules[2].File != "{name}-{index}" {
+		t.Errorf("unexpected rules: %+v", f.Rules)
+	}
+}
+
+func TestLoad_JSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.json")
+	data := `{"seeds": ["https://example.com"], "rules": [{"selector": "a", "action": "visit"}]}`
+	_ = os.WriteFile(path, []byte(data), 0644)
+
+	f, err := Load(path, "./out")
+	if err != nil {
+		t.Fatalf("load json rule failed: %v", err)
+	}
+	if f.Name != "site" || f.Output != "./out" || f.Rules[0].Attr != "href" {
+		t.Errorf("unexpected defaults: %+v", f)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []*File{
+		{Rules: []*Rule{{Selector: "a", Action: ActionVisit}}},
+		{Output: "./data", Rules: []*Rule{{Action: ActionVisit}}},
+		{Output: "./data", Rules: []*Rule{{Selector: "a", Action: "unknown"}}},
+		{Output: "./data", Rules: []*Rule{{Selector: "a", Action: ActionExtract, Item: "book"}}},
+		{Output: "./data", Exporters: []*Exporter{{Type: "xml"}}},
+	}
+	for i, f := range cases {
+		if err := f.Validate(); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	if s := expand("{name}/{name}-{index}", "a", 7); s != "a/a-007" {
+		t.Errorf("unexpected expand result: %s", s)
+	}
+}
+
+func TestRule_Download(t *testing.T) {
+	page, _ := url.Parse("https://example.com/gallery/1.html")
+	resp := &types.ResponseWarp{Request: &types.RequestWrap{URL: page}}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<img src="/a.jpg" alt="cover"><img alt="empty"><img src="b.jpg">`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Rule{Selector: "img", Action: ActionDownload, Attr: "src", Name: Value{Attr: "alt"}, File: "{name}-{index}", Path: "{name}"}
+	var got []string
+	doc.Find(r.Selector).Each(func(i int, s *goquery.Selection) {
+		e := collector.NewHTMLElement(nil, nil, resp, doc, s, s.Nodes[0], i)
+		if u, file, path, ok := r.download(e); ok {
+			got = append(got, u+" "+path+"/"+file)
+		}
+	})
+	// 没有src的元素不下载页面本身, 没有名称时使用默认名称
+	expect := []string{
+		"https://example.com/a.jpg cover/cover-000",
+		"https://example.com/gallery/b.jpg download/download-002",
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("unexpected downloads: %q", got)
+	}
+}
@@ -1,7 +1,28 @@
 package api
 
+import (
+	"encoding/json"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/cluster"
+	"github.com/xiaorui77/monker-king/internal/engine/download"
+)
+
 type TaskManage interface {
 	SetProcess(domain string, num int)
+	SetRateLimit(domain string, conf config.RateLimitConfig) error
+	GetRateLimit(domain string) (config.RateLimitConfig, bool)
+	GetTask(domain string, id uint64) (json.RawMessage, error)
+	CancelTask(domain string, id uint64) error
 	DeleteTask(domain string, id uint64) bool
+	RetryTask(domain string, id uint64) error
+	SetPriority(domain string, id uint64, priority int) error
+	PauseBrowser(domain string) error
+	ResumeBrowser(domain string) error
+	CrawlState() string
+	PauseCrawl() error
+	ResumeCrawl() error
+	DrainCrawl() error
 	GetTree(domain string) interface{}
+	Cluster() (*cluster.Status, error)
+	Proxies() []download.ProxyStatus
 }
@@ -3,171 +3,517 @@ package schedule
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/xiaorui77/goutils/logx"
 	timeutil "github.com/xiaorui77/goutils/time"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/download"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/metrics"
 	"github.com/xiaorui77/monker-king/internal/utils/fileutil"
+	"github.com/xiaorui77/monker-king/pkg/model"
 	"gorm.io/gorm"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Browser的生命周期
+const (
+	BrowserCreated  = iota // 已创建, 等待Scheduler启动
+	BrowserRunning         // 有任务在运行
+	BrowserIdle            // 所有Process都在等待新任务
+	BrowserStopped         // 已停止, 不再接收任务
+	BrowserPaused          // 已暂停, 接收任务但不再调度, 运行中的任务不受影响
+	BrowserDraining        // 等待运行中的任务结束后停止, 不再调度新任务
+)
+
+var browserStates = map[int]string{
+	BrowserCreated:  "created",
+	BrowserRunning:  "running",
+	BrowserIdle:     "idle",
+	BrowserStopped:  "stopped",
+	BrowserPaused:   "paused",
+	BrowserDraining: "draining",
+}
+
+// execution 一个已被Process领取的任务, 由Browser.mu保护
+type execution struct {
+	cancel      context.CancelFunc // 取消Process中该任务的上下文, 开始运行后有效
+	cancelled   bool               // 被手动取消, 失败时记录为ErrCancelled
+	deleted     bool               // 已被删除, 结束后不再保存
+	interrupted bool               // 停止时超时被中断, 重新等待调度
+}
+
 // Browser 在同一个域名下的调度器
 // 1. 处理同一个Domain下的优先级关系
-// 2. 管理cookie等
+// 2. 通过session管理cookie, 请求头和登录
+//
+// mu保护Browser的状态和taskList中所有任务的字段, Process在修改任务前需要持有mu.
 type Browser struct {
 	scheduler *Scheduler
+	domain    string
+	interval  int64 // 每个Process两次任务之间的间隔, 单位: ns
+	robots    *robots
+	limiter   *limiter
+	session   *download.Session
 
-	mu    sync.Mutex
-	wg    sync.WaitGroup
-	numCh chan int
-
-	domain     string
-	processNum int32
-	processes  []*Process
+	mu          sync.Mutex
+	wg          sync.WaitGroup // 运行中的Process
+	ctx         context.Context
+	state       int
+	idleSince   time.Time
+	parallelism int           // 期望的Process数量
+	processes   []*Process    // 运行中的Process
+	waiting     int           // 等待新任务的Process数量
+	wake        chan struct{} // 有新任务时关闭, 唤醒等待中的Process
+	running     map[uint64]*execution
+	executing   sync.WaitGroup // 已被领取的任务, 与running一致
+	retrying    int            // 等待重试的任务数, 大于0时不会因空闲而停止
 
 	MaxDepth int        // 最大层级, 包括下一页等
 	taskList *task.List // 存储结构
 }
 
 func NewBrowser(s *Scheduler, domain string) *Browser {
-	return &Browser{
-		scheduler: s,
-		domain:    domain,
-		processes: make([]*Process, 0, 5),
+	b := &Browser{
+		scheduler:   s,
+		domain:      domain,
+		interval:    int64(s.config.TaskInterval),
+		limiter:     newLimiter(s.config.RateLimit),
+		session:     s.session(domain),
+		parallelism: s.config.Parallelism,
+		processes:   make([]*Process, 0, 5),
+		wake:        make(chan struct{}),
+		running:     map[uint64]*execution{},
 
 		taskList: task.NewTaskList(),
-		MaxDepth: MaxDepth,
+		MaxDepth: s.config.MaxDepth,
 	}
+	b.robots = newRobots(b)
+	return b
 }
 
-// schedule all tasks by multi-thread.
-func (b *Browser) boot(ctx context.Context) {
-	logx.Debugf("[scheduler] The Browser[%s] boot, processNum: %d", b.domain, Parallelism)
-	b.setProcess(ctx, Parallelism)
+// run 启动Process并阻塞, 直到ctx结束或空闲超过IdleTimeout
+func (b *Browser) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b.mu.Lock()
+	logx.Debugf("[scheduler] The Browser[%s] boot, processNum: %d", b.domain, b.parallelism)
+	b.ctx = ctx
+	if b.state == BrowserCreated {
+		b.state = BrowserRunning
+	}
+	b.setProcess(b.parallelism)
+	b.mu.Unlock()
+
+	// 未设置IdleTimeout时不会因空闲而停止
+	var idle <-chan time.Time
+	if timeout := b.scheduler.config.IdleTimeout; timeout > 0 {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			logx.Debugf("[scheduler] The Browser[%s] ctx.done, waiting all process stop", b.domain)
-			b.wg.Wait()
-			logx.Debugf("[scheduler] The Browser[%s] all process has been stopped", b.domain)
-			b.close()
-			logx.Infof("[scheduler] The Browser[%s] has been stopped", b.domain)
+			b.stop()
 			return
-		case num := <-b.numCh:
-			b.setProcess(ctx, num)
-		case <-time.Tick(time.Second * 60):
-			logx.Debugf("[scheduler] The Browser[%s] run retryFailed", b.domain)
-			b.retryFailed()
+		case <-idle:
+			if b.stopIfIdle(b.scheduler.config.IdleTimeout) {
+				logx.Infof("[scheduler] The Browser[%s] has been idle for %v", b.domain, b.scheduler.config.IdleTimeout)
+				cancel()
+				b.wait()
+				return
+			}
 		}
 	}
 }
 
-func (b *Browser) setProcess(ctx context.Context, num int) {
+// stop 不再接收任务, 等待所有Process退出后持久化任务树
+func (b *Browser) stop() {
+	b.mu.Lock()
+	b.state = BrowserStopped
+	b.mu.Unlock()
+	logx.Debugf("[scheduler] The Browser[%s] ctx.done, waiting all process stop", b.domain)
+	b.wait()
+	b.persist()
+}
+
+// persist 保存整个任务树, 包括运行中修改的meta
+func (b *Browser) persist() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	logx.Infof("[scheduler] Browser[%s] set processNum: %d to %d", b.domain, b.processNum, num)
-	if b.processNum < int32(num) {
-		for index := b.processNum; index < int32(num); index++ {
-			processCtx, cancelFn := context.WithCancel(ctx)
-			p := &Process{
-				browser: b, index: int(index), cancelFn: cancelFn,
-				logger: logx.WithFields(logx.Fields{"catalog": "scheduler", "browser": b.domain, "process": index}),
-			}
-			b.processes = append(b.processes, p)
-			b.wg.Add(1)
-			go func() {
-				defer func() {
-					p.cancelFn()
-					b.wg.Done()
-					atomic.AddInt32(&b.processNum, -1)
-				}()
-				p.run(processCtx)
-			}()
+	db := b.scheduler.store.GetDB().Session(&gorm.Session{FullSaveAssociations: true})
+	for _, t := range b.taskList.Tasks {
+		if err := db.Save(t).Error; err != nil {
+			logx.Errorf("[storage] save tasks of Browser[%s] error: %v", b.domain, err)
 		}
-	} else if b.processNum > int32(num) {
-		// 调用cancel函数结束running
-		for index := b.processNum - 1; index >= int32(num); index-- {
-			b.processes[index].cancelFn()
+	}
+}
+
+// drain 不再调度新任务, 之后通过executing等待运行中的任务结束
+func (b *Browser) drain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BrowserStopped {
+		b.state = BrowserDraining
+	}
+}
+
+// interrupt 中断所有运行中的任务, 这些任务会重新等待调度
+func (b *Browser) interrupt() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, e := range b.running {
+		logx.Warnf("[scheduler] Browser[%s] Task[%08x] interrupted", b.domain, id)
+		e.interrupted = true
+		if e.cancel != nil {
+			e.cancel()
 		}
 	}
-	b.processNum = int32(num)
+}
+
+func (b *Browser) wait() {
+	b.wg.Wait()
+	logx.Infof("[scheduler] The Browser[%s] has been stopped", b.domain)
+}
+
+// stopIfIdle 空闲超过timeout时标记为停止, 之后push会失败, 由Scheduler创建新的Browser
+func (b *Browser) stopIfIdle(timeout time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BrowserIdle || b.retrying > 0 || time.Since(b.idleSince) < timeout {
+		return false
+	}
+	b.state = BrowserStopped
+	return true
+}
+
+// setProcess 调整Process的数量, 需要持有mu
+func (b *Browser) setProcess(num int) {
+	b.parallelism = num
+	if b.ctx == nil || b.state == BrowserStopped {
+		// 尚未启动, 启动时按parallelism创建
+		return
+	}
+	logx.Infof("[scheduler] Browser[%s] set processNum: %d to %d", b.domain, len(b.processes), num)
+	for index := len(b.processes); index < num; index++ {
+		processCtx, cancelFn := context.WithCancel(b.ctx)
+		p := &Process{browser: b, index: index, cancelFn: cancelFn}
+		b.processes = append(b.processes, p)
+		b.wg.Add(1)
+		metrics.Processes.WithLabelValues(b.domain).Inc()
+		go func() {
+			defer func() {
+				p.cancelFn()
+				metrics.Processes.WithLabelValues(b.domain).Dec()
+				b.wg.Done()
+			}()
+			p.run(processCtx)
+		}()
+	}
+	// 调用cancel函数结束多余的Process
+	for index := len(b.processes) - 1; index >= num; index-- {
+		b.processes[index].cancelFn()
+		b.processes[index] = nil
+	}
+	if num < len(b.processes) {
+		b.processes = b.processes[:num]
+	}
 }
 
 func (b *Browser) SetProcess(num int) {
-	b.numCh <- num
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setProcess(num)
+}
+
+// ProcessNum 运行中的Process数量
+func (b *Browser) ProcessNum() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.processes)
+}
+
+// State 返回生命周期状态的名称
+func (b *Browser) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return browserStates[b.state]
+}
+
+func (b *Browser) getInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.interval))
+}
+
+// adjustInterval 根据Crawl-delay调整限速器, 使所有Process合计的请求间隔不小于Crawl-delay
+func (b *Browser) adjustInterval(delay time.Duration) {
+	b.limiter.SetFloor(delay)
+	logx.Infof("[scheduler] Browser[%s] min request delay: %v", b.domain, delay)
+}
+
+func (b *Browser) SetRateLimit(conf config.RateLimitConfig) {
+	logx.Infof("[scheduler] Browser[%s] set rate limit: %+v", b.domain, conf)
+	b.limiter.SetLimit(conf)
 }
 
 func (b *Browser) recordErr(t *task.Task, code int, msg string) {
+	b.mu.Lock()
+	if e := b.finish(t); e.deleted {
+		b.mu.Unlock()
+		b.scheduler.done(t)
+		return
+	} else if e.interrupted {
+		t.SetState(task.StateInit)
+		if err := b.scheduler.store.GetDB().Save(t).Error; err != nil {
+			logx.Errorf("[storage] update task[%08x] error: %v", t.ID, err)
+		}
+		b.mu.Unlock()
+		return
+	} else if e.cancelled {
+		code, msg = task.ErrCancelled, "cancelled: "+msg
+	}
+	retrying := b.fail(t, code, msg)
+	b.mu.Unlock()
+	if !retrying {
+		b.scheduler.done(t)
+	}
+}
+
+// finish 移除任务的运行记录, 需要持有mu
+func (b *Browser) finish(t *task.Task) *execution {
+	e, ok := b.running[t.ID]
+	if !ok {
+		return &execution{}
+	}
+	delete(b.running, t.ID)
+	b.executing.Done()
+	return e
+}
+
+// aborted 领取后运行前被取消或删除时结束任务, 返回true时需要调用scheduler.done; 需要持有mu
+func (b *Browser) aborted(t *task.Task) bool {
+	e, ok := b.running[t.ID]
+	if !ok || !(e.cancelled || e.deleted) {
+		return false
+	}
+	b.finish(t)
+	if !e.deleted {
+		t.SetState(task.StateRunning)
+		b.fail(t, task.ErrCancelled, "cancelled before running")
+	}
+	return true
+}
+
+// reject 任务未运行即失败, 如被robots.txt禁止
+func (b *Browser) reject(t *task.Task, code int, msg string) {
+	b.mu.Lock()
+	retrying := false
+	if !b.aborted(t) {
+		b.finish(t)
+		t.SetState(task.StateRunning)
+		retrying = b.fail(t, code, msg)
+	}
+	b.mu.Unlock()
+	if !retrying {
+		b.scheduler.done(t)
+	}
+}
+
+// fail 记录错误, 按重试策略决定是否在等待后重试, 返回是否会重试; 需要持有mu.
+// 会重试时任务尚未结束, 集群模式下不能调用scheduler.done, 否则worker在重试前失效时任务会丢失.
+func (b *Browser) fail(t *task.Task, code int, msg string) bool {
 	t.SetState(task.StateFailed)
 	t.RecordErr(code, msg)
-	if err := b.scheduler.store.GetDB().Save(t).UpdateColumn("err_num", len(t.ErrDetails)).Error; err != nil {
-		logx.Errorf("[storage] update task[08x] state error: %v", t.ID, err)
+	delay, retrying := nextAttempt(b.scheduler.retry.get(t), t)
+	if retrying {
+		t.NextAttempt = time.Now().Add(delay)
+		b.scheduleRetry(t)
+	} else {
+		t.NextAttempt = time.Time{}
 	}
+	if err := b.scheduler.store.GetDB().Save(t).Error; err != nil {
+		logx.Errorf("[storage] update task[%08x] state error: %v", t.ID, err)
+	}
+	return retrying
+}
+
+// scheduleRetry 到NextAttempt时重新调度失败的任务, 需要持有mu
+func (b *Browser) scheduleRetry(t *task.Task) {
+	at := t.NextAttempt
+	b.retrying++
+	time.AfterFunc(time.Until(at), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.retrying--
+		// 期间已被手动重试、删除或再次失败
+		if !t.NextAttempt.Equal(at) || !t.Retry() {
+			return
+		}
+		logx.Infof("[scheduler] Browser[%s] Task[%08x] retry, attempts: %d", b.domain, t.ID, len(t.ErrDetails)+1)
+		if err := b.scheduler.store.GetDB().Model(t).Updates(map[string]interface{}{"state": t.State, "next_attempt": t.NextAttempt}).Error; err != nil {
+			logx.Errorf("[storage] update task[%08x] error: %v", t.ID, err)
+		}
+		b.notify()
+	})
 }
 
-func (b *Browser) recordStart(t *task.Task) {
+// requeue 任务未运行, 重新等待调度
+func (b *Browser) requeue(t *task.Task) {
+	b.mu.Lock()
+	if b.aborted(t) {
+		b.mu.Unlock()
+		b.scheduler.done(t)
+		return
+	}
+	b.finish(t)
+	t.SetState(task.StateInit)
+	b.mu.Unlock()
+}
+
+// recordStart 标记为运行中, 返回用于获取的副本. Fetcher只修改副本的meta, 由recordFetched合并,
+// 避免与读取任务树的goroutine竞争. cancel用于取消运行中的任务, 运行前已被取消或删除时返回nil.
+func (b *Browser) recordStart(t *task.Task, cancel context.CancelFunc) *task.Task {
+	b.mu.Lock()
+	if b.aborted(t) {
+		b.mu.Unlock()
+		b.scheduler.done(t)
+		return nil
+	}
+	defer b.mu.Unlock()
+	if b.state == BrowserDraining {
+		// 领取后开始停止, 重新等待调度
+		b.finish(t)
+		t.SetState(task.StateInit)
+		return nil
+	}
+	if e, ok := b.running[t.ID]; ok {
+		e.cancel = cancel
+	}
 	t.SetState(task.StateRunning)
 	if err := b.scheduler.store.GetDB().Save(t).Error; err != nil {
 		logx.Errorf("[storage] update task[%08x] error: %v", t.ID, err)
 	}
+	c := *t
+	c.Meta = make(task.Meta, len(t.Meta))
+	for k, v := range t.Meta {
+		c.Meta[k] = v
+	}
+	return &c
+}
+
+// recordFetched 合并获取时对meta的修改
+func (b *Browser) recordFetched(t, fetched *task.Task) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t.Meta = fetched.Meta
 }
 
 func (b *Browser) recordSuccess(t *task.Task) {
+	b.mu.Lock()
+	if b.finish(t).deleted {
+		b.mu.Unlock()
+		b.scheduler.done(t)
+		return
+	}
 	t.SetState(task.StateSuccessful)
 	if err := b.scheduler.store.GetDB().Save(t).Error; err != nil {
 		logx.Errorf("[storage] update task[%08x] error: %v", t.ID, err)
 	}
+	b.mu.Unlock()
+	b.scheduler.done(t)
 }
 
 func (b *Browser) timeout(t *task.Task) (tt time.Duration) {
+	defaultTimeout, maxTimeout := b.scheduler.config.DefaultTimeout, b.scheduler.download.MaxTimeout()
 	defer func() {
 		// defer + func() {} 的形式是可以将返回值传进来的, 如果是defer直接+t.SetMeta(), 则tt=0
 		t.SetMeta(task.MetaTimeout, int64(tt.Seconds()))
 	}()
 	if len(t.ErrDetails) == 0 {
-		return DefaultTimeout
+		return defaultTimeout
 	}
 	// 基于上次reader的情况计算超时时间
 	lastTimeout, ltOk := t.Meta[task.MetaTimeout].(int64)
 	reader, rOk := t.Meta[task.MetaReader].(*fileutil.VisualReader)
-	if ltOk && rOk && lastTimeout > 0 && reader.Cur > 0 && reader.Total > 0 {
-		timeout := lastTimeout * reader.Total / reader.Cur * int64(len(t.ErrDetails)+1)
-		return timeutil.Min(DefaultTimeout+time.Second*time.Duration(timeout), MaxTimeout)
+	if ltOk && rOk && lastTimeout > 0 {
+		if cur, total := reader.Progress(); cur > 0 && total > 0 {
+			timeout := lastTimeout * total / cur * int64(len(t.ErrDetails)+1)
+			return timeutil.Min(defaultTimeout+time.Second*time.Duration(timeout), maxTimeout)
+		}
 	}
-	return timeutil.Min(DefaultTimeout+time.Second*45*time.Duration(len(t.ErrDetails)), MaxTimeout)
-}
-
-func (b *Browser) close() {
-	// todo: close all task queue of the domain
-
-	// 自我清理
-	delete(b.scheduler.browsers, b.domain)
-	b.scheduler = nil
+	step := b.scheduler.retry.get(t).TimeoutStep
+	return timeutil.Min(defaultTimeout+step*time.Duration(len(t.ErrDetails)), maxTimeout)
 }
 
-func (b *Browser) next() *task.Task {
+// next 返回下一个可运行的任务; 没有时返回nil和有新任务时会被关闭的channel
+func (b *Browser) next() (*task.Task, <-chan struct{}) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if b.state == BrowserPaused || b.state == BrowserDraining {
+		b.waiting++
+		return nil, b.wake
+	}
 	t := b.taskList.Next()
 	if t == nil {
-		return nil
+		b.waiting++
+		if b.waiting >= len(b.processes) && b.state == BrowserRunning {
+			b.state, b.idleSince = BrowserIdle, time.Now()
+		}
+		return nil, b.wake
 	}
+	b.running[t.ID] = &execution{}
+	b.executing.Add(1)
 	if err := b.scheduler.store.GetDB().Model(t).UpdateColumn("state", t.State).Error; err != nil {
 		logx.Errorf("[storage] update task[%08x] error: %v", t.ID, err)
 	}
-	return t
+	return t, nil
 }
 
-func (b *Browser) push(t *task.Task) {
-	if t == nil || t.Depth > b.MaxDepth {
-		return
-	}
+// awake 一个等待中的Process被唤醒或退出
+func (b *Browser) awake() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	b.waiting--
+}
+
+// notify 唤醒所有等待中的Process, 需要持有mu
+func (b *Browser) notify() {
+	close(b.wake)
+	b.wake = make(chan struct{})
+	if b.state == BrowserIdle {
+		b.state = BrowserRunning
+	}
+}
+
+// push 添加任务, Browser已停止时返回false
+func (b *Browser) push(t *task.Task) bool {
+	if t == nil {
+		return true
+	}
+	if t.Depth > b.MaxDepth {
+		// 集群模式下生产者可能没有该域名的Browser而未检查深度, 丢弃时需要确认
+		logx.Debugf("[scheduler] Browser[%s] Task[%08x] depth %d exceeds max_depth %d, dropped", b.domain, t.ID, t.Depth, b.MaxDepth)
+		b.scheduler.done(t)
+		return true
+	}
+	b.mu.Lock()
+	if b.state == BrowserStopped {
+		b.mu.Unlock()
+		return false
+	}
+	// 在队列中等待时失去了域名的租约, 已交给其他worker
+	if c := b.scheduler.cluster; c != nil && !c.Taken(t) {
+		b.mu.Unlock()
+		logx.Debugf("[scheduler] Browser[%s] Task[%08x] is no longer owned, dropped", b.domain, t.ID)
+		return true
+	}
 	if t.Parent != nil {
 		t.Parent.Push(t)
 	} else {
@@ -177,42 +523,254 @@ func (b *Browser) push(t *task.Task) {
 	if err := b.scheduler.store.GetDB().Create(t).Error; err != nil {
 		logx.Errorf("[storage] save task[%08x] to db error: %v", t.ID, err)
 	}
+	// 已缓存robots.txt且匹配Disallow时直接拒绝, 否则在运行前检查
+	if b.robots.test(t.Url) == robotsDisallowed {
+		logx.Infof("[scheduler] Browser[%s] Task[%08x] disallowed by robots.txt: %s", b.domain, t.ID, t.Url)
+		t.SetState(task.StateRunning)
+		retrying := b.fail(t, task.ErrRobotsDisallowed, "disallowed by robots.txt")
+		b.mu.Unlock()
+		if !retrying {
+			b.scheduler.done(t)
+		}
+		return true
+	}
+	b.notify()
+	b.mu.Unlock()
+	return true
 }
 
-// todo: 需要替换
-func (b *Browser) delete(id uint64) *task.Task {
-	return nil
+// revoke 集群中失去了域名的租约, 任务会由coordinator交给新的持有者:
+// 丢弃所有任务并取消运行中的任务, 避免重复获取和两个worker同时访问同一域名. 运行中的任务结束后不再保存.
+func (b *Browser) revoke() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range b.running {
+		e.deleted = true
+		if e.cancel != nil {
+			e.cancel()
+		}
+	}
+	n := len(b.taskList.Tasks)
+	b.taskList = task.NewTaskList()
+	logx.Infof("[scheduler] Browser[%s] lease lost, %d tasks dropped", b.domain, n)
+}
+
+// restore 添加从存储中恢复的任务树, 不会再次持久化. 等待重试的任务按NextAttempt重新调度.
+func (b *Browser) restore(root *task.Task) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.taskList.Push(root)
+	for _, t := range root.ListAll() {
+		if t.State == task.StateFailed && !t.NextAttempt.IsZero() {
+			b.scheduleRetry(t)
+		}
+	}
 }
 
-// todo: 需要替换
-func (b *Browser) query(name string) *task.Task {
+// has 任务是否属于该Browser
+func (b *Browser) has(id uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.taskList.Find(id) != nil
+}
+
+// get 在mu下序列化任务及其子树
+func (b *Browser) get(id uint64) (json.RawMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.taskList.Find(id)
+	if t == nil {
+		return nil, fmt.Errorf("task[%x] not found", id)
+	}
+	return json.Marshal(t)
+}
+
+// cancel 取消任务: 运行中的取消其上下文, 等待调度的直接标记为失败, 均不会被自动重试
+func (b *Browser) cancel(id uint64) error {
+	b.mu.Lock()
+	t := b.taskList.Find(id)
+	if t == nil {
+		b.mu.Unlock()
+		return fmt.Errorf("task[%x] not found", id)
+	}
+	switch t.State {
+	case task.StateScheduling, task.StateRunning:
+		if e, ok := b.running[id]; ok {
+			e.cancelled = true
+			if e.cancel != nil {
+				e.cancel()
+			}
+		}
+		b.mu.Unlock()
+	case task.StateInit:
+		logx.Infof("[scheduler] Browser[%s] Task[%08x] cancelled before running", b.domain, t.ID)
+		t.SetState(task.StateRunning)
+		retrying := b.fail(t, task.ErrCancelled, "cancelled before running")
+		b.mu.Unlock()
+		if !retrying {
+			b.scheduler.done(t)
+		}
+	default:
+		state := t.GetState()
+		b.mu.Unlock()
+		return fmt.Errorf("task[%x] is %s, can not be cancelled", id, state)
+	}
 	return nil
 }
 
-func (b *Browser) retryFailed() {
+// delete 删除任务及其子树, 运行中的会被取消
+func (b *Browser) delete(id uint64) *task.Task {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	t := b.taskList.Find(id)
+	if t == nil {
+		return nil
+	}
+	if t.Parent != nil {
+		t.Detach()
+	} else {
+		b.taskList.Remove(t)
+	}
 
-	if t := b.taskList.RetryFailed(); t != nil {
-		if err := b.scheduler.store.GetDB().Session(&gorm.Session{FullSaveAssociations: true}).Updates(t).Error; err != nil {
-			logx.Errorf("[storage] update tasks state error: %v", err)
+	ids := make([]uint64, 0, 1)
+	for _, c := range t.ListAll() {
+		if e, ok := b.running[c.ID]; ok {
+			e.deleted = true
+			if e.cancel != nil {
+				e.cancel()
+			}
+		} else if c.State < task.StateSuccessful {
+			// 运行中的在结束时确认; 等待调度或重试的在此确认
+			b.scheduler.done(c)
 		}
+		ids = append(ids, c.ID)
+	}
+	db := b.scheduler.store.GetDB()
+	if err := db.Where("task_id IN ?", ids).Delete(&task.ErrDetail{}).Error; err != nil {
+		logx.Errorf("[storage] delete err details of task[%08x] error: %v", t.ID, err)
 	}
+	if err := db.Delete(&task.Task{}, ids).Error; err != nil {
+		logx.Errorf("[storage] delete task[%08x] error: %v", t.ID, err)
+	}
+	logx.Infof("[scheduler] Browser[%s] Task[%08x] deleted with %d tasks", b.domain, t.ID, len(ids))
+	return t
 }
 
-func (b *Browser) list() []*task.Task {
-	return b.taskList.ListAll()
+// retry 强制重试失败的任务
+func (b *Browser) retry(id uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.taskList.Find(id)
+	if t == nil {
+		return fmt.Errorf("task[%x] not found", id)
+	}
+	if !t.Retry() {
+		return fmt.Errorf("task[%x] is %s, only failed task can be retried", id, t.GetState())
+	}
+	if err := b.scheduler.store.GetDB().Model(t).UpdateColumn("state", t.State).Error; err != nil {
+		logx.Errorf("[storage] update task[%08x] error: %v", t.ID, err)
+	}
+	b.notify()
+	return nil
 }
 
-func (b *Browser) tree() *Browser {
-	return b
+// setPriority 修改任务的优先级, 在同级任务中重新排序
+func (b *Browser) setPriority(id uint64, priority int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.taskList.Find(id)
+	if t == nil {
+		return fmt.Errorf("task[%x] not found", id)
+	}
+	l := b.taskList
+	if t.Parent != nil {
+		l = t.Parent.Children
+	}
+	l.Reprioritize(t, priority)
+	if err := b.scheduler.store.GetDB().Model(t).UpdateColumn("priority", t.Priority).Error; err != nil {
+		logx.Errorf("[storage] update task[%08x] error: %v", t.ID, err)
+	}
+	return nil
+}
+
+// pause 暂停调度新任务, 运行中的任务会继续执行
+func (b *Browser) pause() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BrowserStopped || b.state == BrowserDraining {
+		return fmt.Errorf("browser %s is %s", b.domain, browserStates[b.state])
+	}
+	b.state = BrowserPaused
+	logx.Infof("[scheduler] Browser[%s] paused", b.domain)
+	return nil
+}
+
+// resume 恢复调度
+func (b *Browser) resume() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BrowserPaused {
+		return fmt.Errorf("browser %s is %s, not paused", b.domain, browserStates[b.state])
+	}
+	b.state = BrowserRunning
+	if b.ctx == nil {
+		b.state = BrowserCreated
+	}
+	b.notify()
+	logx.Infof("[scheduler] Browser[%s] resumed", b.domain)
+	return nil
 }
 
-func (b *Browser) MarshalJSON() ([]byte, error) {
+// rows 在mu下生成任务列表的快照
+func (b *Browser) rows(now time.Time) []*model.TaskRow {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ls := b.taskList.ListAll()
+	// 默认排序: state,time
+	sort.SliceStable(ls, func(i, j int) bool {
+		if ls[i].State == ls[j].State {
+			return ls[i].CreateTime.Unix() > ls[j].CreateTime.Unix()
+		}
+		return ls[i].State < ls[j].State
+	})
+	rows := make([]*model.TaskRow, 0, len(ls))
+	for _, t := range ls {
+		row := &model.TaskRow{
+			ID:     strconv.FormatUint(t.ID, 16),
+			Name:   t.Name,
+			Domain: b.domain,
+			State:  t.GetState(),
+			URL:    t.Url,
+		}
+		if t.State == task.StateFailed && len(t.ErrDetails) > 0 {
+			row.LastError = strconv.Itoa(t.ErrDetails[len(t.ErrDetails)-1].ErrCode)
+		}
+		if !t.StartTime.IsZero() {
+			if t.EndTime.IsZero() {
+				row.Age = fmt.Sprintf("%0.1fs", now.Sub(t.StartTime).Seconds())
+			} else {
+				row.Age = fmt.Sprintf("%0.1fs", t.EndTime.Sub(t.StartTime).Seconds())
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// tree 在mu下序列化任务树
+func (b *Browser) tree() (json.RawMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var worker string
+	if b.scheduler.cluster != nil {
+		worker = b.scheduler.cluster.ID()
+	}
 	return json.Marshal(struct {
 		Id         uint64     `json:"id"`
 		Name       string     `json:"name"`
+		State      string     `json:"state"`
+		Worker     string     `json:"worker,omitempty"` // 集群模式下调度该域名的worker
 		ProcessNum int        `json:"processNum"`
 		Children   *task.List `json:"children"`
-	}{Id: 0, Name: b.domain, ProcessNum: int(b.processNum), Children: b.taskList})
+	}{Id: 0, Name: b.domain, State: browserStates[b.state], Worker: worker, ProcessNum: len(b.processes), Children: b.taskList})
 }
@@ -0,0 +1,200 @@
+package schedule
+
+import (
+	"context"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute * 5
+)
+
+// limiter Browser级别的令牌桶限速器, 所有Process共享.
+// 相邻两次请求的间隔不小于 max(MinDelay, Crawl-delay, 退避时间) + 随机抖动.
+type limiter struct {
+	mu sync.Mutex
+
+	conf  config.RateLimitConfig
+	floor time.Duration // robots.txt中的Crawl-delay
+
+	tokens   float64
+	refilled time.Time
+	lastReq  time.Time
+	jitter   time.Duration // 本次间隔的随机抖动
+
+	backoff    time.Duration // 自适应退避
+	pauseUntil time.Time     // Retry-After
+}
+
+func newLimiter(conf config.RateLimitConfig) *limiter {
+	return &limiter{
+		conf:   conf,
+		tokens: float64(conf.Burst),
+	}
+}
+
+// Wait 阻塞直到可以发起请求
+func (l *limiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		d := l.reserve(time.Now())
+		l.mu.Unlock()
+		if d <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve 尝试获取令牌, 成功返回0, 否则返回需要等待的时间
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.refill(now)
+
+	var wait time.Duration
+	if now.Before(l.pauseUntil) {
+		wait = l.pauseUntil.Sub(now)
+	}
+	if !l.lastReq.IsZero() {
+		if w := l.lastReq.Add(l.gap() + l.jitter).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	if l.conf.Rate > 0 && l.tokens < 1 {
+		if w := time.Duration((1 - l.tokens) / l.conf.Rate * float64(time.Second)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	if l.conf.Rate > 0 {
+		l.tokens--
+	}
+	l.lastReq = now
+	l.jitter = 0
+	if l.conf.Jitter > 0 {
+		l.jitter = time.Duration(rand.Int63n(int64(l.conf.Jitter)))
+	}
+	return 0
+}
+
+func (l *limiter) refill(now time.Time) {
+	if l.refilled.IsZero() {
+		l.refilled = now
+		return
+	}
+	if elapsed := now.Sub(l.refilled); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.conf.Rate
+		if burst := float64(l.burst()); l.tokens > burst {
+			l.tokens = burst
+		}
+		l.refilled = now
+	}
+}
+
+func (l *limiter) burst() int {
+	if l.conf.Burst < 1 {
+		return 1
+	}
+	return l.conf.Burst
+}
+
+// gap 相邻两次请求的最小间隔
+func (l *limiter) gap() time.Duration {
+	gap := l.conf.MinDelay
+	if l.floor > gap {
+		gap = l.floor
+	}
+	if l.backoff > gap {
+		gap = l.backoff
+	}
+	return gap
+}
+
+// Observe 根据响应调整退避: 429/503时加倍退避并遵守Retry-After, 其他响应逐步恢复
+func (l *limiter) Observe(status int, header http.Header) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		l.backoff /= 2
+		if l.backoff < minBackoff {
+			l.backoff = 0
+		}
+		return
+	}
+
+	l.backoff *= 2
+	if l.backoff < minBackoff {
+		l.backoff = minBackoff
+	} else if l.backoff > maxBackoff {
+		l.backoff = maxBackoff
+	}
+	pause := l.backoff
+	if d, ok := parseRetryAfter(header.Get("Retry-After"), now); ok {
+		pause = d
+	}
+	if until := now.Add(pause); until.After(l.pauseUntil) {
+		l.pauseUntil = until
+	}
+}
+
+// Backoff 返回当前的退避时间
+func (l *limiter) Backoff() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.backoff
+}
+
+func (l *limiter) SetLimit(conf config.RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conf = conf
+	if burst := float64(l.burst()); l.tokens > burst {
+		l.tokens = burst
+	}
+}
+
+func (l *limiter) Limit() config.RateLimitConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conf
+}
+
+// SetFloor 设置最小间隔的下限, 用于robots.txt的Crawl-delay, 为0时取消
+func (l *limiter) SetFloor(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.floor = d
+}
+
+// parseRetryAfter 支持秒数和HTTP-date两种格式
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
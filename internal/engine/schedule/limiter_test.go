@@ -0,0 +1,90 @@
+package schedule
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+)
+
+func TestLimiter_Burst(t *testing.T) {
+	l := newLimiter(config.RateLimitConfig{Rate: 2, Burst: 3})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if d := l.reserve(now); d != 0 {
+			t.Fatalf("request %d should pass in burst, but wait %v", i, d)
+		}
+	}
+	if d := l.reserve(now); d != time.Millisecond*500 {
+		t.Errorf("expect wait 500ms after burst, but %v", d)
+	}
+	if d := l.reserve(now.Add(time.Millisecond * 500)); d != 0 {
+		t.Errorf("token should be refilled, but wait %v", d)
+	}
+}
+
+func TestLimiter_MinDelay(t *testing.T) {
+	l := newLimiter(config.RateLimitConfig{Burst: 10, MinDelay: time.Second})
+	now := time.Now()
+	if d := l.reserve(now); d != 0 {
+		t.Fatalf("first request should pass, but wait %v", d)
+	}
+	if d := l.reserve(now.Add(time.Millisecond * 300)); d != time.Millisecond*700 {
+		t.Errorf("expect wait 700ms, but %v", d)
+	}
+	// Crawl-delay大于MinDelay时以Crawl-delay为准
+	l.SetFloor(time.Second * 2)
+	if d := l.reserve(now.Add(time.Second)); d != time.Second {
+		t.Errorf("expect wait 1s by crawl-delay, but %v", d)
+	}
+	// Crawl-delay被删除后恢复为MinDelay
+	l.SetFloor(0)
+	if d := l.reserve(now.Add(time.Second * 3)); d != 0 {
+		t.Errorf("expect no wait after crawl-delay removed, but %v", d)
+	}
+	if d := l.reserve(now.Add(time.Second * 3).Add(time.Millisecond * 500)); d != time.Millisecond*500 {
+		t.Errorf("expect wait 500ms by min delay, but %v", d)
+	}
+}
+
+func TestLimiter_Backoff(t *testing.T) {
+	l := newLimiter(config.RateLimitConfig{})
+	l.Observe(http.StatusTooManyRequests, http.Header{})
+	if b := l.Backoff(); b != minBackoff {
+		t.Errorf("expect backoff %v, but %v", minBackoff, b)
+	}
+	l.Observe(http.StatusServiceUnavailable, http.Header{})
+	if b := l.Backoff(); b != minBackoff*2 {
+		t.Errorf("expect backoff %v, but %v", minBackoff*2, b)
+	}
+	for i := 0; i < 20; i++ {
+		l.Observe(http.StatusTooManyRequests, http.Header{})
+	}
+	if b := l.Backoff(); b != maxBackoff {
+		t.Errorf("backoff should be capped at %v, but %v", maxBackoff, b)
+	}
+	for i := 0; i < 20; i++ {
+		l.Observe(http.StatusOK, http.Header{})
+	}
+	if b := l.Backoff(); b != 0 {
+		t.Errorf("backoff should recover, but %v", b)
+	}
+}
+
+func TestLimiter_RetryAfter(t *testing.T) {
+	l := newLimiter(config.RateLimitConfig{})
+	l.Observe(http.StatusTooManyRequests, http.Header{"Retry-After": {"30"}})
+	if d := l.reserve(time.Now()); d < time.Second*29 || d > time.Second*30 {
+		t.Errorf("expect wait about 30s, but %v", d)
+	}
+
+	now := time.Now()
+	date := now.Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(date, now); !ok || d < time.Second*59 || d > time.Minute {
+		t.Errorf("unexpected retry-after of http-date: %v, %v", d, ok)
+	}
+	if _, ok := parseRetryAfter("soon", now); ok {
+		t.Errorf("invalid retry-after should be ignored")
+	}
+}
@@ -3,7 +3,12 @@ package schedule
 import (
 	"context"
 	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/download"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"github.com/xiaorui77/monker-king/internal/metrics"
+	"github.com/xiaorui77/monker-king/pkg/error"
+	"strconv"
 	"time"
 )
 
@@ -12,8 +17,6 @@ type Process struct {
 	browser  *Browser
 	index    int                // 计数
 	cancelFn context.CancelFunc // 停止函数
-
-	logger *logx.Entry
 }
 
 func (p *Process) run(ctx context.Context) {
@@ -25,54 +28,120 @@ func (p *Process) run(ctx context.Context) {
 
 	logx.Infof("[scheduler] Browser[%s] Process[%d] has already started...", p.browser.domain, p.index)
 	for {
-		select {
-		case <-ctx.Done():
-			p.logger.Infof("[scheduler] Browser[%s] Process[%d] has been stopped", p.browser.domain, p.index)
+		if wake := p.process(ctx); wake != nil {
+			// 没有可运行的任务, 等待新任务或重试
+			select {
+			case <-ctx.Done():
+			case <-wake:
+			}
+			p.browser.awake()
+		} else {
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.browser.getInterval()):
+			}
+		}
+		if ctx.Err() != nil {
+			logx.Infof("[scheduler] Browser[%s] Process[%d] has been stopped", p.browser.domain, p.index)
 			return
-		default:
-			p.process(ctx)
 		}
-		time.Sleep(time.Second * TaskInterval)
 	}
 }
 
-// process a task
-func (p *Process) process(ctx context.Context) {
-	logger := p.logger.WithField("index", p.index)
-	t := p.browser.next()
+// process a task, 没有可运行的任务时返回等待用的channel
+func (p *Process) process(ctx context.Context) <-chan struct{} {
+	t, wake := p.browser.next()
 	if t == nil {
-		logger.Debugf("[scheduler] Browser[%s] [process-%d] no found tasks", p.browser.domain, p.index)
-		return
+		logx.Debugf("[scheduler] Browser[%s] [process-%d] no found tasks", p.browser.domain, p.index)
+		return wake
+	}
+	switch p.browser.robots.check(ctx, t.Url) {
+	case robotsDisallowed:
+		logx.Infof("[scheduler] Browser[%s] [process-%d] Task[%x] disallowed by robots.txt: %s", p.browser.domain, p.index, t.ID, t.Url)
+		p.browser.reject(t, task.ErrRobotsDisallowed, "disallowed by robots.txt")
+		return nil
+	case robotsUnavailable:
+		p.browser.reject(t, task.ErrRobotsUnavailable, "robots.txt is unavailable")
+		return nil
 	}
-	timeout := p.browser.timeout(t)
-	logger.Infof("[scheduler] Browser[%s] [process-%d] Task[%x] begin run, timeout: %0.1fs, url: %s", p.browser.domain, p.index, t.ID, timeout.Seconds(), t.Url)
-	p.browser.recordStart(t)
+	if err := p.browser.limiter.Wait(ctx); err != nil {
+		// 已停止, 归还任务
+		p.browser.requeue(t)
+		return nil
+	}
+	// 任务可以被手动取消
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	fetching := p.browser.recordStart(t, cancelRun)
+	if fetching == nil {
+		logx.Infof("[scheduler] Browser[%s] [process-%d] Task[%x] aborted before running", p.browser.domain, p.index, t.ID)
+		return nil
+	}
+	timeout := p.browser.timeout(fetching)
+	logx.Infof("[scheduler] Browser[%s] [process-%d] Task[%x] begin run, timeout: %0.1fs, url: %s", p.browser.domain, p.index, t.ID, timeout.Seconds(), t.Url)
 
-	// 设置超时并使用GET进行请求
-	tCtx, cancelFunc := context.WithTimeout(ctx, timeout)
+	// 设置超时并使用GET进行请求, 请求使用Browser的会话
+	tCtx, cancelFunc := context.WithTimeout(download.WithSession(runCtx, p.browser.session), timeout)
 	defer cancelFunc()
-	resp, err := p.browser.scheduler.download.Get(tCtx, t)
+	if err := p.login(tCtx); err != nil {
+		logx.Errorf("[process-%d] Task[%x] run failed, login failed: %v", p.index, t.ID, err)
+		p.browser.recordErr(t, err.ErrCode(), err.Error())
+		return nil
+	}
+	name, fetcher := p.browser.scheduler.fetcher(fetching)
+	resp, err := fetcher.Get(tCtx, fetching)
+	p.browser.recordFetched(t, fetching)
+	metrics.FetchDuration.WithLabelValues(p.browser.domain, name).Observe(time.Since(fetching.StartTime).Seconds())
 	if err != nil {
-		cost := time.Now().Sub(t.StartTime).Truncate(time.Millisecond * 100).Seconds()
-		logx.Errorf("[process-%d] Task[%x] run failed, cost: %0.1fs, request(GET) fail: %v", p.index, t.ID, cost, err)
+		metrics.Requests.WithLabelValues(p.browser.domain, "error").Inc()
+		cost := time.Since(fetching.StartTime).Truncate(time.Millisecond * 100).Seconds()
+		logx.Errorf("[process-%d] Task[%x] run failed, cost: %0.1fs, request(%s) fail: %v", p.index, t.ID, cost, fetching.Request.GetMethod(), err)
 		p.browser.recordErr(t, err.ErrCode(), err.Error())
-		return
+		return nil
 	}
+	metrics.Requests.WithLabelValues(p.browser.domain, strconv.Itoa(resp.StatusCode)).Inc()
+	metrics.DownloadedBytes.WithLabelValues(p.browser.domain).Add(float64(resp.Size))
+	metrics.WireBytes.WithLabelValues(p.browser.domain).Add(float64(resp.Wire))
 
-	cost := time.Now().Sub(t.StartTime).Truncate(time.Millisecond * 100).Seconds()
+	p.browser.limiter.Observe(resp.StatusCode, resp.Header)
+	cost := time.Since(fetching.StartTime).Truncate(time.Millisecond * 100).Seconds()
 	logx.Infof("[process-%d] Task[%x] request finish, cost: %0.1fs, will handle Callbacks", p.index, t.ID, cost)
+	begin := time.Now()
+	err = p.callback(t, resp)
+	metrics.CallbackDuration.WithLabelValues(p.browser.domain).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		p.browser.recordErr(t, err.ErrCode(), err.Error())
+		return nil
+	}
+
+	p.browser.recordSuccess(t)
+	p.browser.scheduler.recrawl.observe(t, resp)
+	logx.Infof("[process-%d] Task[%x] run success, total cost: %0.1fs", p.index, t.ID, time.Since(fetching.StartTime).Seconds())
+	return nil
+}
+
+// login 在域名的第一个任务之前登录, 成功后立即保存cookie
+func (p *Process) login(ctx context.Context) error.Error {
+	session := p.browser.session
+	if !session.NeedLogin() {
+		return nil
+	}
+	if err := session.Login(ctx); err != nil {
+		return &error.Err{Code: task.ErrLogin, Err: err}
+	}
+	p.browser.scheduler.saveSession(session)
+	return nil
+}
+
+// callback 执行响应的处理函数和任务的回调
+func (p *Process) callback(t *task.Task, resp *types.ResponseWarp) error.Error {
 	if err := p.browser.scheduler.parsing.HandleOnResponse(resp); err != nil {
 		logx.Errorf("[process-%d] Task[%x] run failed, handle ResponseCallback failed: %v", p.index, t.ID, err)
-		p.browser.recordErr(t, err.ErrCode(), err.Error())
-		return
+		return err
 	}
 	if err := t.Callback(t, resp); err != nil {
 		logx.Errorf("[process-%d] Task[%x] run failed, handle task.Callback failed: %v", p.index, t.ID, err)
-		p.browser.recordErr(t, task.ErrCallbackTask, err.Error())
-		return
+		return &error.Err{Code: task.ErrCallbackTask, Err: err}
 	}
-
-	p.browser.recordSuccess(t)
-	totalCost := t.EndTime.Sub(t.StartTime).Seconds()
-	logx.Infof("[process-%d] Task[%x] run success, total cost: %0.1fs", p.index, t.ID, totalCost)
+	return nil
 }
@@ -0,0 +1,233 @@
+package schedule
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/cluster"
+	"github.com/xiaorui77/monker-king/internal/engine/dedup"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"gorm.io/gorm"
+	"regexp"
+	"time"
+)
+
+// Revisit 增量重爬中定期重新访问的URL, 在第一次成功获取后记录
+type Revisit struct {
+	ID       string `gorm:"primaryKey;size:40"` // 规范化URL的哈希
+	URL      string
+	Domain   string `gorm:"index;size:255"`
+	Name     string
+	Callback string // 任务的MetaCallback, 重新加入时用于绑定回调
+	Policy   string
+	Interval time.Duration // 当前的间隔, adaptive策略下随内容变化调整
+	NextAt   time.Time     `gorm:"index"`
+	LastAt   time.Time     // 上次成功获取的时间
+	Hash     string        `gorm:"size:40"` // 上次获取的内容的哈希
+	Visits   int
+	Changes  int // 内容变化的次数
+}
+
+func (Revisit) TableName() string {
+	return "revisits"
+}
+
+type revisitRule struct {
+	config.RevisitRule
+	re *regexp.Regexp
+}
+
+// next 按策略计算下次的间隔, changed表示内容是否变化
+func (r *revisitRule) next(interval time.Duration, changed bool) time.Duration {
+	if r.Policy != config.RevisitAdaptive || interval <= 0 {
+		return r.Interval
+	}
+	if changed {
+		interval /= 2
+	} else {
+		interval += interval / 2
+	}
+	if interval < r.MinInterval {
+		return r.MinInterval
+	}
+	if interval > r.MaxInterval {
+		return r.MaxInterval
+	}
+	return interval
+}
+
+// Recrawler 记录匹配规则的URL的访问情况, 定期将到期的URL重新加入调度
+type Recrawler struct {
+	scheduler *Scheduler
+	conf      config.RecrawlConfig
+	rules     []*revisitRule
+	canon     *dedup.Canonicalizer
+	// requeue 集群模式下只由coordinator重新加入, 避免重复
+	requeue bool
+}
+
+// newRecrawler 未启用或无法创建revisits表时返回nil
+func newRecrawler(s *Scheduler, conf *config.Config) *Recrawler {
+	rc := conf.Scheduler.Recrawl
+	if !rc.Enabled {
+		return nil
+	}
+	if err := s.store.GetDB().AutoMigrate(&Revisit{}); err != nil {
+		logx.Errorf("[recrawl] migrate revisits failed, recrawl disabled: %v", err)
+		return nil
+	}
+	r := &Recrawler{
+		scheduler: s,
+		conf:      rc,
+		rules:     make([]*revisitRule, 0, len(rc.Rules)),
+		canon:     dedup.NewCanonicalizer(conf.Dedup.StripParams),
+		requeue:   conf.Cluster.Mode != cluster.ModeWorker,
+	}
+	for _, rule := range rc.Rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			logx.Errorf("[recrawl] invalid pattern %q: %v", rule.Pattern, err)
+			continue
+		}
+		r.rules = append(r.rules, &revisitRule{RevisitRule: rule, re: re})
+	}
+	return r
+}
+
+// rule 返回URL匹配的第一个规则, 带请求体的请求不会重新访问
+func (r *Recrawler) rule(rawUrl, sig string) *revisitRule {
+	if sig != "" {
+		return nil
+	}
+	for _, rule := range r.rules {
+		if rule.re.MatchString(rawUrl) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *Recrawler) key(rawUrl string) string {
+	canonical, err := r.canon.Canonical(rawUrl)
+	if err != nil {
+		canonical = rawUrl
+	}
+	sum := sha1.Sum([]byte(canonical))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tracked 请求是否按规则定期重新访问, 未启用时为false
+func (r *Recrawler) Tracked(rawUrl, sig string) bool {
+	return r != nil && r.rule(rawUrl, sig) != nil
+}
+
+// Due URL是否到期, 没有记录(从未成功获取)时为true
+func (r *Recrawler) Due(rawUrl string) bool {
+	rv := &Revisit{}
+	err := r.scheduler.store.GetDB().Select("next_at").Where("id = ?", r.key(rawUrl)).Take(rv).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logx.Warnf("[recrawl] query revisit of %s failed: %v", rawUrl, err)
+		}
+		return true
+	}
+	return !rv.NextAt.After(time.Now())
+}
+
+// observe 任务成功后记录内容的哈希, 按策略计算下次访问的时间.
+// 下载任务(设置了MetaSavePath)不重新访问, 重新加入时无法恢复保存的文件名和目录
+func (r *Recrawler) observe(t *task.Task, resp *types.ResponseWarp) {
+	if _, saving := t.Meta[task.MetaSavePath]; r == nil || saving || resp.File != "" {
+		return
+	}
+	rule := r.rule(t.Url, t.Request.Signature())
+	if rule == nil {
+		return
+	}
+	db := r.scheduler.store.GetDB()
+	now := time.Now()
+	sum := sha1.Sum(resp.Body)
+	hash := hex.EncodeToString(sum[:])
+
+	rv := &Revisit{}
+	err := db.Where("id = ?", r.key(t.Url)).Take(rv).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		callback, _ := t.Meta[task.MetaCallback].(string)
+		rv = &Revisit{ID: r.key(t.Url), URL: t.Url, Domain: t.Domain, Name: t.Name, Callback: callback, Interval: rule.Interval}
+	case err != nil:
+		logx.Warnf("[recrawl] query revisit of %s failed: %v", t.Url, err)
+		return
+	default:
+		changed := rv.Hash != hash
+		if changed {
+			rv.Changes++
+		}
+		rv.Interval = rule.next(rv.Interval, changed)
+	}
+	rv.Policy, rv.Hash, rv.LastAt, rv.NextAt = rule.Policy, hash, now, now.Add(rv.Interval)
+	rv.Visits++
+	if err := db.Save(rv).Error; err != nil {
+		logx.Warnf("[recrawl] save revisit of %s failed: %v", t.Url, err)
+		return
+	}
+	logx.Debugf("[recrawl] Task[%08x] will be revisited after %v, changes: %d/%d", t.ID, rv.Interval, rv.Changes, rv.Visits)
+}
+
+// run 每CheckInterval将到期的URL重新加入调度, 直到ctx结束
+func (r *Recrawler) run(ctx context.Context) {
+	if !r.requeue {
+		return
+	}
+	ticker := time.NewTicker(r.conf.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if r.scheduler.CrawlState() == crawlStates[CrawlRunning] {
+				r.requeueDue(now)
+			}
+		}
+	}
+}
+
+// requeueDue 将最多Batch个到期的URL作为新的根任务加入调度, 返回加入的数量.
+// 加入时推迟下次访问的时间, 避免在获取之前重复加入; 获取成功后由observe重新计算.
+func (r *Recrawler) requeueDue(now time.Time) int {
+	db := r.scheduler.store.GetDB()
+	var due []*Revisit
+	if err := db.Where("next_at <= ?", now).Order("next_at").Limit(r.conf.Batch).Find(&due).Error; err != nil {
+		logx.Errorf("[recrawl] query due revisits failed: %v", err)
+		return 0
+	}
+	n := 0
+	for _, rv := range due {
+		if err := db.Model(rv).Update("next_at", now.Add(rv.Interval)).Error; err != nil {
+			logx.Warnf("[recrawl] update revisit of %s failed: %v", rv.URL, err)
+			continue
+		}
+		t := task.NewTask(rv.Name, nil, rv.URL, nil)
+		t.Domain = rv.Domain
+		t.SetMeta(task.MetaCallback, rv.Callback)
+		// 重新绑定回调, 并记录为本次爬取中已访问
+		if err := r.scheduler.parsing.RestoreTask(t); err != nil {
+			logx.Warnf("[recrawl] restore Task[%08x] of %s failed: %v", t.ID, rv.URL, err)
+			continue
+		}
+		if err := r.scheduler.AddTask(t); err != nil {
+			logx.Warnf("[recrawl] add Task[%08x] of %s failed: %v", t.ID, rv.URL, err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		logx.Infof("[recrawl] %d due urls have been requeued", n)
+	}
+	return n
+}
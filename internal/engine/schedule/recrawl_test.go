@@ -0,0 +1,112 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	error2 "github.com/xiaorui77/monker-king/pkg/error"
+)
+
+func TestRevisitRule_Next(t *testing.T) {
+	adaptive := &revisitRule{RevisitRule: config.RevisitRule{
+		Policy: config.RevisitAdaptive, Interval: time.Hour, MinInterval: time.Minute * 20, MaxInterval: time.Hour * 2,
+	}}
+	fixed := &revisitRule{RevisitRule: config.RevisitRule{Policy: config.RevisitFixed, Interval: time.Hour}}
+	cases := []struct {
+		rule     *revisitRule
+		interval time.Duration
+		changed  bool
+		expect   time.Duration
+	}{
+		{adaptive, time.Hour, true, time.Minute * 30},
+		{adaptive, time.Hour, false, time.Minute * 90},
+		{adaptive, time.Minute * 30, true, time.Minute * 20},
+		{adaptive, time.Minute * 90, false, time.Hour * 2},
+		{adaptive, 0, false, time.Hour},
+		{fixed, time.Minute * 30, true, time.Hour},
+	}
+	for i, c := range cases {
+		if got := c.rule.next(c.interval, c.changed); got != c.expect {
+			t.Errorf("case %d: expect %v, got %v", i, c.expect, got)
+		}
+	}
+}
+
+// restoreParsing 记录恢复的任务
+type restoreParsing struct {
+	restored []*task.Task
+}
+
+func (p *restoreParsing) HandleOnResponse(*types.ResponseWarp) error2.Error { return nil }
+func (p *restoreParsing) RestoreTask(t *task.Task) error {
+	p.restored = append(p.restored, t)
+	return nil
+}
+
+func TestRecrawler(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	parsing := &restoreParsing{}
+	s.parsing = parsing
+	conf := config.Default()
+	conf.Scheduler.Recrawl.Enabled = true
+	conf.Scheduler.Recrawl.Rules = []config.RevisitRule{
+		{Pattern: `^https://a\.com/list`, Policy: config.RevisitAdaptive, Interval: time.Hour, MinInterval: time.Minute, MaxInterval: time.Hour * 24},
+	}
+	s.recrawl = newRecrawler(s, conf)
+	r := s.Recrawler()
+
+	const list = "https://a.com/list?page=1"
+	if !r.Tracked(list, "") || r.Tracked("https://a.com/detail/1", "") || r.Tracked(list, "POST") {
+		t.Fatalf("only GET of urls matching rules should be tracked")
+	}
+	if !r.Due(list) {
+		t.Errorf("url never fetched should be due")
+	}
+
+	tk := task.NewTask("list", nil, list, nil)
+	tk.Domain = "a.com"
+	tk.SetMeta(task.MetaCallback, "parsing")
+	revisit := func() *Revisit {
+		rv := &Revisit{}
+		if err := s.store.GetDB().Where("id = ?", r.key(list)).Take(rv).Error; err != nil {
+			t.Fatal(err)
+		}
+		return rv
+	}
+	for i, body := range []string{"v1", "v1", "v2"} {
+		r.observe(tk, &types.ResponseWarp{Body: []byte(body)})
+		expect := []time.Duration{time.Hour, time.Minute * 90, time.Minute * 45}[i]
+		if rv := revisit(); rv.Interval != expect || rv.Visits != i+1 {
+			t.Errorf("visit %d: expect interval %v, got %v after %d visits", i, expect, rv.Interval, rv.Visits)
+		}
+	}
+	if rv := revisit(); rv.Changes != 1 || rv.Callback != "parsing" {
+		t.Errorf("unexpected revisit: %+v", rv)
+	}
+	if r.Due(list) {
+		t.Errorf("url should not be due before next_at")
+	}
+	// 下载任务不记录, 重新加入时没有保存的文件名和目录
+	const file = "https://a.com/list?page=2"
+	saving := task.NewTask("file", nil, file, nil)
+	saving.SetMeta(task.MetaSavePath, "./data").SetMeta(task.MetaSaveName, "file").SetMeta(task.MetaCallback, "save")
+	r.observe(saving, &types.ResponseWarp{Body: []byte("v1")})
+	if !r.Due(file) {
+		t.Errorf("download task should not be recorded")
+	}
+
+	// 到期后作为新的根任务加入调度, 在获取之前不会重复加入
+	if n := r.requeueDue(time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("expect 1 due url, got %d", n)
+	}
+	requeued := <-s.taskQueue
+	if requeued.Url != list || requeued.Domain != "a.com" || requeued.Meta[task.MetaCallback] != "parsing" || len(parsing.restored) != 1 {
+		t.Errorf("unexpected requeued task: %v", requeued)
+	}
+	if n := r.requeueDue(time.Now().Add(time.Hour)); n != 0 {
+		t.Errorf("requeued url should not be due again, got %d", n)
+	}
+}
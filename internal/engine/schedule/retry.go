@@ -0,0 +1,139 @@
+package schedule
+
+import (
+	"fmt"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicies 按 任务meta中的名称 > 域名 > 默认 的顺序选择重试策略, 规则文件可以在运行时添加
+type RetryPolicies struct {
+	mu sync.RWMutex
+
+	base    config.RetryPolicy
+	named   map[string]config.RetryPolicy
+	domains map[string]string
+}
+
+func newRetryPolicies(conf config.RetryConfig) *RetryPolicies {
+	r := &RetryPolicies{
+		base:    conf.RetryPolicy,
+		named:   make(map[string]config.RetryPolicy, len(conf.Policies)),
+		domains: make(map[string]string, len(conf.Domains)),
+	}
+	for name, p := range conf.Policies {
+		r.named[name] = p.Inherit(conf.RetryPolicy)
+	}
+	for domain, name := range conf.Domains {
+		r.domains[domain] = name
+	}
+	return r
+}
+
+// Set 添加或覆盖命名的策略, 未设置的字段使用默认策略的值
+func (r *RetryPolicies) Set(name string, p config.RetryPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p = p.Inherit(r.base)
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("retry policy %s: %v", name, err)
+	}
+	r.named[name] = p
+	return nil
+}
+
+// SetDomain 设置域名使用的策略
+func (r *RetryPolicies) SetDomain(domain, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.named[name]; !ok {
+		return fmt.Errorf("retry policy %q not found", name)
+	}
+	r.domains[domain] = name
+	return nil
+}
+
+// Has 是否存在命名的策略
+func (r *RetryPolicies) Has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.named[name]
+	return ok
+}
+
+// get 返回任务使用的策略
+func (r *RetryPolicies) get(t *task.Task) config.RetryPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, _ := t.Meta[task.MetaRetry].(string)
+	if name == "" {
+		name = r.domains[t.Domain]
+	}
+	if p, ok := r.named[name]; ok {
+		return p
+	}
+	return r.base
+}
+
+// nextAttempt 根据最后一次错误判断失败的任务是否重试, 返回重试前等待的时间.
+// robots.txt暂时不可用时任务没有被获取, 不计入MaxAttempts, 总是重试, 等待时间不超过robotsFailedTTL
+func nextAttempt(p config.RetryPolicy, t *task.Task) (time.Duration, bool) {
+	if len(t.ErrDetails) == 0 {
+		return 0, false
+	}
+	var attempts, unavailable int
+	for _, d := range t.ErrDetails {
+		if d.ErrCode == task.ErrRobotsUnavailable {
+			unavailable++
+		} else {
+			attempts, unavailable = attempts+1, 0
+		}
+	}
+	if unavailable > 0 {
+		limit := robotsFailedTTL
+		if p.MaxBackoff > 0 && p.MaxBackoff < limit {
+			limit = p.MaxBackoff
+		}
+		return backoff(p, unavailable, limit), true
+	}
+	if attempts >= p.MaxAttempts || !retryable(p, t.ErrDetails[len(t.ErrDetails)-1].ErrCode) {
+		return 0, false
+	}
+	return backoff(p, attempts, p.MaxBackoff), true
+}
+
+// backoff 第n次重试前等待的时间, limit大于0时为上限
+func backoff(p config.RetryPolicy, n int, limit time.Duration) time.Duration {
+	b := float64(p.Backoff) * math.Pow(p.Multiplier, float64(n-1))
+	if limit > 0 && b > float64(limit) {
+		b = float64(limit)
+	}
+	return time.Duration(b * (1 + p.Jitter*rand.Float64()))
+}
+
+// retryable HTTP错误按Statuses判断, 其他按Codes判断
+func retryable(p config.RetryPolicy, code int) bool {
+	switch {
+	case code == task.ErrCancelled || code == task.ErrRobotsDisallowed || code == task.ErrBodyTooLarge:
+		return false
+	case code == task.ErrRobotsUnavailable:
+		return true
+	case code >= task.ErrHttpUnknown:
+		return len(p.Statuses) == 0 || contains(p.Statuses, code-task.ErrHttpUnknown)
+	default:
+		return len(p.Codes) == 0 || contains(p.Codes, code)
+	}
+}
+
+func contains(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
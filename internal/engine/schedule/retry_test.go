@@ -0,0 +1,81 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+)
+
+func TestNextAttempt(t *testing.T) {
+	p := config.RetryPolicy{
+		MaxAttempts: 3,
+		Codes:       []int{task.ErrDoRequest},
+		Statuses:    []int{503},
+		Backoff:     time.Second,
+		MaxBackoff:  time.Second * 3,
+		Multiplier:  4,
+	}
+	cases := []struct {
+		codes []int
+		delay time.Duration
+		retry bool
+	}{
+		{[]int{task.ErrDoRequest}, time.Second, true},
+		{[]int{task.ErrDoRequest, task.ErrHttpUnknown + 503}, time.Second * 3, true}, // 不超过MaxBackoff
+		{[]int{task.ErrDoRequest, task.ErrDoRequest, task.ErrDoRequest}, 0, false},   // 超过MaxAttempts
+		{[]int{task.ErrHttpNotFount}, 0, false},
+		{[]int{task.ErrReadRespBody}, 0, false},
+		{[]int{task.ErrCancelled}, 0, false},
+		// robots.txt不可用时不计入MaxAttempts
+		{[]int{task.ErrRobotsUnavailable, task.ErrRobotsUnavailable, task.ErrRobotsUnavailable, task.ErrRobotsUnavailable}, time.Second * 3, true},
+		{[]int{task.ErrDoRequest, task.ErrDoRequest, task.ErrRobotsUnavailable}, time.Second, true},
+		{[]int{task.ErrDoRequest, task.ErrDoRequest, task.ErrRobotsUnavailable, task.ErrDoRequest}, 0, false},
+	}
+	for i, c := range cases {
+		tk := task.NewTask("", nil, "https://a.com", nil)
+		for _, code := range c.codes {
+			tk.RecordErr(code, "")
+		}
+		delay, retry := nextAttempt(p, tk)
+		if delay != c.delay || retry != c.retry {
+			t.Errorf("case %d: expect (%v, %v), got (%v, %v)", i, c.delay, c.retry, delay, retry)
+		}
+	}
+
+	p.Jitter = 0.5
+	tk := task.NewTask("", nil, "https://a.com", nil)
+	tk.RecordErr(task.ErrDoRequest, "")
+	if delay, _ := nextAttempt(p, tk); delay < time.Second || delay > time.Second*3/2 {
+		t.Errorf("delay with jitter out of range: %v", delay)
+	}
+}
+
+func TestRetryPolicies(t *testing.T) {
+	conf := config.Default().Scheduler.Retry
+	conf.Policies = map[string]config.RetryPolicy{"slow": {MaxAttempts: 10}}
+	conf.Domains = map[string]string{"slow.com": "slow"}
+	r := newRetryPolicies(conf)
+	if err := r.Set("once", config.RetryPolicy{MaxAttempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetDomain("a.com", "unknown"); err == nil {
+		t.Error("unknown policy should not be set to domain")
+	}
+
+	tk := task.NewTask("", nil, "https://slow.com", nil)
+	tk.Domain = "slow.com"
+	if p := r.get(tk); p.MaxAttempts != 10 || p.Backoff != conf.Backoff {
+		t.Errorf("domain policy should inherit default: %+v", p)
+	}
+	tk.SetMeta(task.MetaRetry, "once")
+	if p := r.get(tk); p.MaxAttempts != 1 {
+		t.Errorf("task policy should take precedence: %+v", p)
+	}
+	tk.Domain = "a.com"
+	tk.SetMeta(task.MetaRetry, "")
+	if p := r.get(tk); p.MaxAttempts != conf.MaxAttempts {
+		t.Errorf("default policy expected: %+v", p)
+	}
+}
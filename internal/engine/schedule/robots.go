@@ -0,0 +1,151 @@
+package schedule
+
+import (
+	"context"
+	"github.com/temoto/robotstxt"
+	"github.com/xiaorui77/goutils/logx"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	robotsTTL       = time.Hour * 24
+	robotsFailedTTL = time.Minute * 10 // 获取失败或5xx时的缓存时间
+	robotsTimeout   = time.Second * 15
+	robotsMaxSize   = 512 * 1024
+)
+
+// robots.txt对URL的判断结果
+const (
+	robotsUnknown     = iota // 尚未获取或已过期
+	robotsAllowed            // 允许, 或robots.txt不存在(4xx)
+	robotsDisallowed         // 匹配Disallow规则
+	robotsUnavailable        // 获取失败或5xx, 暂时无法判断, robotsFailedTTL后重新获取
+)
+
+type robotsEntry struct {
+	data        *robotstxt.RobotsData // unavailable时为nil
+	unavailable bool
+	expires     time.Time
+}
+
+func (e *robotsEntry) test(u *url.URL, agent string) int {
+	switch {
+	case e.unavailable:
+		return robotsUnavailable
+	case e.data.TestAgent(pathOf(u), agent):
+		return robotsAllowed
+	default:
+		return robotsDisallowed
+	}
+}
+
+// robots 缓存Browser下各host的robots.txt
+type robots struct {
+	browser *Browser
+	agent   string
+	enabled bool
+
+	mu    sync.Mutex
+	hosts map[string]*robotsEntry
+}
+
+func newRobots(b *Browser) *robots {
+	conf := b.scheduler.config.Robots
+	return &robots{
+		browser: b,
+		agent:   conf.UserAgent,
+		enabled: conf.Enabled,
+		hosts:   map[string]*robotsEntry{},
+	}
+}
+
+// test 使用已缓存的robots.txt判断是否允许访问, 未缓存或已过期时返回robotsUnknown
+func (r *robots) test(rawUrl string) int {
+	if !r.enabled {
+		return robotsAllowed
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return robotsUnknown
+	}
+	r.mu.Lock()
+	e, ok := r.hosts[u.Host]
+	r.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		return robotsUnknown
+	}
+	return e.test(u, r.agent)
+}
+
+// check 判断是否允许访问, 未缓存或已过期时会先获取robots.txt
+func (r *robots) check(ctx context.Context, rawUrl string) int {
+	if result := r.test(rawUrl); result != robotsUnknown {
+		return result
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return robotsAllowed
+	}
+	return r.load(ctx, u).test(u, r.agent)
+}
+
+// load 获取并缓存host的robots.txt. 请求失败或5xx时在robotsFailedTTL内视为暂时不可用, 4xx时允许所有
+func (r *robots) load(ctx context.Context, u *url.URL) *robotsEntry {
+	r.mu.Lock()
+	if e, ok := r.hosts[u.Host]; ok && time.Now().Before(e.expires) {
+		r.mu.Unlock()
+		return e
+	}
+	r.mu.Unlock()
+
+	robotsUrl := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}).String()
+	fCtx, cancel := context.WithTimeout(ctx, robotsTimeout)
+	defer cancel()
+
+	e := &robotsEntry{expires: time.Now().Add(robotsTTL)}
+	resp, fErr := r.browser.scheduler.download.Fetch(fCtx, robotsUrl, robotsMaxSize)
+	switch {
+	case fErr != nil:
+		logx.Warnf("[robots] Browser[%s] fetch %s failed, retry later: %v", r.browser.domain, robotsUrl, fErr)
+		e.unavailable = true
+	case resp.StatusCode >= 500:
+		logx.Warnf("[robots] Browser[%s] fetch %s got status %d, retry later", r.browser.domain, robotsUrl, resp.StatusCode)
+		e.unavailable = true
+	default:
+		var err error
+		if e.data, err = robotstxt.FromStatusAndBytes(resp.StatusCode, resp.Body); err != nil {
+			logx.Warnf("[robots] Browser[%s] parse %s failed, allow all: %v", r.browser.domain, robotsUrl, err)
+			e.data, _ = robotstxt.FromStatusAndBytes(404, nil)
+		}
+	}
+	if e.unavailable {
+		e.expires = time.Now().Add(robotsFailedTTL)
+	}
+
+	r.mu.Lock()
+	r.hosts[u.Host] = e
+	r.mu.Unlock()
+
+	// 获取成功时总是更新, Crawl-delay被修改或删除后不再使用之前的值
+	if e.data != nil {
+		delay := e.data.FindGroup(r.agent).CrawlDelay
+		if delay > 0 {
+			logx.Infof("[robots] Browser[%s] host %s has Crawl-delay: %v", r.browser.domain, u.Host, delay)
+		}
+		r.browser.adjustInterval(delay)
+	}
+	return e
+}
+
+func pathOf(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	return p
+}
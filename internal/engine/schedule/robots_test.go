@@ -0,0 +1,81 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRobots(t *testing.T) {
+	var fetched int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(&fetched, 1)
+			_, _ = fmt.Fprint(w, "User-agent: *\nDisallow: /\n\nUser-agent: monkey-king\nDisallow: /private\nAllow: /private/open\nCrawl-delay: 2\n")
+		}
+	}))
+	defer srv.Close()
+
+	conf := config.Default()
+	b := NewBrowser(NewRunner(conf, nil, nil), "127.0.0.1")
+	if b.robots.test(srv.URL+"/a") != robotsUnknown {
+		t.Fatalf("robots.txt should not be known before loading")
+	}
+
+	cases := map[string]int{
+		"/":                robotsAllowed,
+		"/a/b?c=1":         robotsAllowed,
+		"/private":         robotsDisallowed,
+		"/private/x":       robotsDisallowed,
+		"/private/open/1":  robotsAllowed,
+		"/private?q=1":     robotsDisallowed,
+		"/other/private/x": robotsAllowed,
+	}
+	for path, expect := range cases {
+		if result := b.robots.check(context.Background(), srv.URL+path); result != expect {
+			t.Errorf("%s: expect %d, got %d", path, expect, result)
+		}
+	}
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Errorf("robots.txt should be fetched once, but %d", n)
+	}
+	if b.robots.test(srv.URL+"/private") != robotsDisallowed {
+		t.Errorf("cached robots.txt should disallow /private")
+	}
+	// Crawl-delay作为Browser级别的最小请求间隔
+	if floor := b.limiter.floor; floor != time.Second*2 {
+		t.Errorf("unexpected min delay: %v", floor)
+	}
+}
+
+func TestRobots_Unavailable(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	b := NewBrowser(NewRunner(config.Default(), nil, nil), "127.0.0.1")
+	if result := b.robots.check(context.Background(), srv.URL+"/a"); result != robotsUnavailable {
+		t.Errorf("5xx robots.txt should be unavailable, got %d", result)
+	}
+	if !retryable(config.RetryPolicy{Codes: []int{task.ErrDoRequest}}, task.ErrRobotsUnavailable) {
+		t.Errorf("tasks failed by unavailable robots.txt should be retryable")
+	}
+	status = http.StatusNotFound
+	b.robots.hosts = map[string]*robotsEntry{}
+	if result := b.robots.check(context.Background(), srv.URL+"/a"); result != robotsAllowed {
+		t.Errorf("missing robots.txt should allow all, got %d", result)
+	}
+	srv.Close()
+	b.robots.hosts = map[string]*robotsEntry{}
+	if result := b.robots.check(context.Background(), srv.URL+"/a"); result != robotsUnavailable {
+		t.Errorf("unreachable robots.txt should be unavailable, got %d", result)
+	}
+}
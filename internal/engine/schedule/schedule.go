@@ -2,80 +2,290 @@ package schedule
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/xiaorui77/goutils/logx"
-	"github.com/xiaorui77/goutils/wait"
+	"github.com/xiaorui77/monker-king/internal/config"
 	"github.com/xiaorui77/monker-king/internal/engine/api"
+	"github.com/xiaorui77/monker-king/internal/engine/cluster"
 	"github.com/xiaorui77/monker-king/internal/engine/download"
 	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/metrics"
 	"github.com/xiaorui77/monker-king/internal/storage"
 	"github.com/xiaorui77/monker-king/internal/utils/domainutil"
-	"github.com/xiaorui77/monker-king/pkg/model"
-	"sort"
-	"strconv"
+	"sync"
 	"time"
 )
 
+// 爬取的状态
 const (
-	// Parallelism is maximum concurrent number of the same domain.
-	Parallelism = 4
-
-	// MaxDepth is max exploit depth of task
-	MaxDepth = 3
-
-	taskQueueSize = 100
-
-	// TaskInterval task run interval
-	TaskInterval = 1
-
-	// DefaultTimeout is task default timeout
-	DefaultTimeout = time.Second * 15
-	MaxTimeout     = download.MaxTimeout
+	CrawlRunning  = iota
+	CrawlPaused   // 所有Browser暂停调度, 仍接收任务
+	CrawlDraining // 不再调度新任务, 等待运行中的任务结束后停止
+	CrawlStopped
 )
 
+var crawlStates = map[int]string{
+	CrawlRunning:  "running",
+	CrawlPaused:   "paused",
+	CrawlDraining: "draining",
+	CrawlStopped:  "stopped",
+}
+
 type Scheduler struct {
+	config   *config.SchedulerConfig
 	parsing  api.Parsing
 	download *download.Downloader
+	render   *download.Renderer
 	store    storage.Storage
+	retry    *RetryPolicies
+
+	// 按名称区分的Fetcher, 以及默认使用render的域名
+	fetchers      map[string]download.Fetcher
+	renderDomains map[string]bool
+	// 配置了Warc.Replay时所有任务从WARC文件中重放
+	replay bool
+
+	// 按域名保存的会话, Browser因空闲停止后重新创建时继续使用
+	sessionMu      sync.Mutex
+	sessions       map[string]*download.Session
+	persistCookies bool
 
 	taskQueue chan *task.Task
-	// browser divide by domain
+
+	// browser divide by domain, 由mu保护; Browser停止后自行从中移除
+	mu       sync.RWMutex
+	ctx      context.Context // Run之后有效, 排空后才会结束
+	state    int
+	drained  chan struct{} // 排空结束后关闭
 	browsers map[string]*Browser
+	running  sync.WaitGroup // 运行中的Browser
+
+	// 集群模式下任务经过共享队列, 为nil时为单机模式
+	cluster *cluster.Node
+
+	// 增量重爬, 未启用时为nil
+	recrawl *Recrawler
 }
 
-func NewRunner(parsing api.Parsing, store storage.Storage) *Scheduler {
-	return &Scheduler{
+func NewRunner(conf *config.Config, parsing api.Parsing, store storage.Storage) *Scheduler {
+	s := &Scheduler{
+		config:    &conf.Scheduler,
 		parsing:   parsing,
-		download:  download.NewDownloader(),
-		taskQueue: make(chan *task.Task, taskQueueSize),
+		download:  download.NewDownloader(conf.Download),
+		render:    download.NewRenderer(conf.Download.Render),
+		taskQueue: make(chan *task.Task, conf.Scheduler.TaskQueueSize),
 		browsers:  map[string]*Browser{},
+		drained:   make(chan struct{}),
 		store:     store,
+		retry:     newRetryPolicies(conf.Scheduler.Retry),
+
+		renderDomains: map[string]bool{},
+		sessions:      map[string]*download.Session{},
+	}
+	if conf.Download.Session.Persist {
+		if err := store.GetDB().AutoMigrate(&download.SavedCookie{}); err != nil {
+			logx.Errorf("[scheduler] migrate cookies failed, cookies will not be saved: %v", err)
+		} else {
+			s.persistCookies = true
+		}
+	}
+	s.recrawl = newRecrawler(s, conf)
+	s.fetchers = map[string]download.Fetcher{
+		download.FetcherHTTP:   s.download,
+		download.FetcherRender: s.render,
+	}
+	if len(conf.Download.Warc.Replay) > 0 {
+		if replayer, err := download.NewReplayer(conf.Download); err != nil {
+			logx.Errorf("[scheduler] load warc files failed, replay disabled: %v", err)
+		} else {
+			s.fetchers[download.FetcherReplay] = replayer
+			s.replay = true
+		}
+	}
+	for _, domain := range conf.Download.Render.Domains {
+		s.renderDomains[domain] = true
+	}
+	return s
+}
+
+// RetryPolicies 返回重试策略, 可在Run之前添加规则文件中的策略
+func (s *Scheduler) RetryPolicies() *RetryPolicies {
+	return s.retry
+}
+
+// Recrawler 返回增量重爬的记录, 未启用时为nil
+func (s *Scheduler) Recrawler() *Recrawler {
+	return s.recrawl
+}
+
+// Join 加入集群, 需要在Run之前调用
+func (s *Scheduler) Join(n *cluster.Node) {
+	s.cluster = n
+}
+
+// fetcher 选择任务使用的Fetcher: 重放时总是replay; 否则优先使用任务meta中指定的, 其次按域名配置, 默认为http
+func (s *Scheduler) fetcher(t *task.Task) (string, download.Fetcher) {
+	if s.replay {
+		return download.FetcherReplay, s.fetchers[download.FetcherReplay]
+	}
+	name, _ := t.Meta[task.MetaFetcher].(string)
+	// 下载任务需要流式写入文件, 带请求体的任务无法渲染, 默认不使用render
+	_, saving := t.Meta[task.MetaSavePath]
+	if name == "" && !saving && t.Request.Signature() == "" && s.renderDomains[t.Domain] {
+		name = download.FetcherRender
+	}
+	if f, ok := s.fetchers[name]; ok {
+		return name, f
 	}
+	if name != "" {
+		logx.Warnf("[scheduler] Task[%08x] unknown fetcher %q, use http instead", t.ID, name)
+	}
+	return download.FetcherHTTP, s.download
 }
 
-// Run in Blocking mode
+// Restore 从存储中重建每个Browser的任务树, 中断时处于调度或运行中的任务会被重新调度.
+// 需要在Run之前调用.
+func (s *Scheduler) Restore() error {
+	var tasks []*task.Task
+	if err := s.store.GetDB().Preload("ErrDetails").Find(&tasks).Error; err != nil {
+		logx.Errorf("[scheduler] load tasks from storage failed: %v", err)
+		return fmt.Errorf("load tasks failed: %v", err)
+	}
+
+	restored := make([]*task.Task, 0, len(tasks))
+	requeue := 0
+	for _, t := range tasks {
+		if err := s.parsing.RestoreTask(t); err != nil {
+			logx.Warnf("[scheduler] restore Task[%08x] failed: %v", t.ID, err)
+			continue
+		}
+		switch t.State {
+		case task.StateUnknown, task.StateScheduling, task.StateRunning:
+			t.SetState(task.StateInit)
+			requeue++
+		}
+		restored = append(restored, t)
+	}
+
+	for _, root := range task.BuildTree(restored) {
+		if root.Domain == "" {
+			root.Domain = domainutil.CalDomain(root.Url)
+		}
+		s.browser(root.Domain).restore(root)
+	}
+	logx.Infof("[scheduler] restored %d tasks of %d browsers, %d tasks will be rescheduled", len(restored), len(s.browserList()), requeue)
+	return nil
+}
+
+// Run in Blocking mode, ctx结束或DrainCrawl后排空运行中的任务再停止
 func (s *Scheduler) Run(ctx context.Context) {
+	// Browser使用独立的ctx, 使运行中的任务在ctx结束后仍可以完成
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 启动恢复的Browser
+	s.mu.Lock()
+	s.ctx = runCtx
+	for _, b := range s.browsers {
+		s.start(b)
+	}
+	s.mu.Unlock()
+	if s.cluster != nil {
+		go s.cluster.Run(runCtx, func(t *task.Task) { s.deliver(runCtx, t) }, s.revoke)
+	}
+	if s.recrawl != nil {
+		go s.recrawl.run(ctx)
+	}
+	stopping := ctx.Done()
 	for {
 		select {
-		case <-ctx.Done():
+		case <-stopping:
+			stopping = nil
+			logx.Infof("[scheduler] ctx.done draining running tasks before stop")
+			_ = s.DrainCrawl()
+		case <-s.drained:
 			// Wait for all browsers to exit by themselves
-			logx.Infof("[scheduler] ctx.done waiting for all browsers to stop")
-			wait.WaitUntil(func() bool { return len(s.browsers) == 0 })
+			cancel()
+			logx.Infof("[scheduler] drained, waiting for all browsers to stop")
+			s.running.Wait()
 			logx.Debugf("[scheduler] all browsers has been stopped")
 			s.close()
+			s.mu.Lock()
+			s.state = CrawlStopped
+			s.mu.Unlock()
 			logx.Infof("[scheduler] The scheduler has been stopped")
 			return
 		case t := <-s.taskQueue:
+			metrics.TaskQueueDepth.Set(float64(len(s.taskQueue)))
 			t.SetState(task.StateInit)
-			if _, ok := s.browsers[t.Domain]; !ok {
-				s.browsers[t.Domain] = NewBrowser(s, t.Domain)
-				go s.browsers[t.Domain].boot(ctx)
+			// Browser因空闲停止时重新创建
+			for !s.browser(t.Domain).push(t) {
 			}
-			s.browsers[t.Domain].push(t)
 		}
 	}
 }
 
+// browser 返回域名对应的Browser, 不存在或已停止时创建, Run之后创建的会立即启动
+func (s *Scheduler) browser(domain string) *Browser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.browsers[domain]; ok && b.State() != browserStates[BrowserStopped] {
+		return b
+	}
+	b := NewBrowser(s, domain)
+	switch s.state {
+	case CrawlPaused:
+		b.state = BrowserPaused
+	case CrawlDraining, CrawlStopped:
+		b.state = BrowserDraining
+	}
+	s.browsers[domain] = b
+	if s.ctx != nil {
+		s.start(b)
+	}
+	return b
+}
+
+// start 需要持有mu
+func (s *Scheduler) start(b *Browser) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		b.run(s.ctx)
+		s.saveSession(b.session)
+		s.remove(b)
+	}()
+}
+
+// remove 从注册表中移除已停止的Browser, 同名的新Browser不受影响
+func (s *Scheduler) remove(b *Browser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.browsers[b.domain] == b {
+		delete(s.browsers, b.domain)
+	}
+}
+
+// lookup 查找域名对应的Browser
+func (s *Scheduler) lookup(domain string) (*Browser, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.browsers[domain]
+	return b, ok
+}
+
+// browserList 所有Browser的快照
+func (s *Scheduler) browserList() []*Browser {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]*Browser, 0, len(s.browsers))
+	for _, b := range s.browsers {
+		res = append(res, b)
+	}
+	return res
+}
+
 func (s *Scheduler) AddTask(t *task.Task) error {
 	if t == nil {
 		return fmt.Errorf("task can not nil")
@@ -83,86 +293,307 @@ func (s *Scheduler) AddTask(t *task.Task) error {
 	if t.Domain == "" {
 		t.Domain = domainutil.CalDomain(t.Url)
 	}
-	if b, ok := s.browsers[t.Domain]; ok {
+	if b, ok := s.lookup(t.Domain); ok {
 		if t.Depth > b.MaxDepth {
 			return fmt.Errorf("browser[%s] max_depth is %d, but this task.depth is %d", t.Domain, b.MaxDepth, t.Depth)
 		}
 	}
+	if s.cluster != nil {
+		return s.cluster.Push(t)
+	}
+	if state := s.CrawlState(); state == crawlStates[CrawlDraining] || state == crawlStates[CrawlStopped] {
+		// 不再调度, 保存后在恢复时调度
+		return s.persist(t)
+	}
 	s.taskQueue <- t
+	metrics.TaskQueueDepth.Set(float64(len(s.taskQueue)))
+	return nil
+}
+
+// persist 保存尚未交给Browser的任务
+func (s *Scheduler) persist(t *task.Task) error {
+	t.State = task.StateInit
+	if err := s.store.GetDB().Create(t).Error; err != nil {
+		logx.Errorf("[storage] save task[%08x] to db error: %v", t.ID, err)
+		return fmt.Errorf("save task failed: %v", err)
+	}
 	return nil
 }
 
+// deliver 接收从共享队列领取的任务, 重新绑定Callback后交给对应的Browser
+func (s *Scheduler) deliver(ctx context.Context, t *task.Task) {
+	if err := s.parsing.RestoreTask(t); err != nil {
+		logx.Warnf("[scheduler] restore Task[%08x] from shared queue failed: %v", t.ID, err)
+		s.cluster.Ack(t)
+		return
+	}
+	select {
+	case s.taskQueue <- t:
+	case <-ctx.Done():
+	}
+}
+
+// revoke 集群中失去域名的租约, 丢弃该域名的Browser中的任务
+func (s *Scheduler) revoke(domain string) {
+	if b, ok := s.lookup(domain); ok {
+		b.revoke()
+	}
+}
+
+// done 任务结束, 集群模式下从共享队列的执行中移除
+func (s *Scheduler) done(t *task.Task) {
+	if s.cluster != nil {
+		s.cluster.Ack(t)
+	}
+}
+
+// Fetch 直接获取URL的内容, 不经过Browser的调度和限速, 用于sitemap等辅助资源
+func (s *Scheduler) Fetch(ctx context.Context, rawUrl string, limit int64) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.download.MaxTimeout())
+	defer cancel()
+	resp, err := s.download.Fetch(ctx, rawUrl, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, resp.Body, nil
+}
+
 func (s *Scheduler) GetRows() []interface{} {
 	now := time.Now()
-	rows := make([]interface{}, 0, len(s.browsers))
-	for _, domain := range s.browsers {
-		ls := domain.list()
-		// 默认排序: state,time
-		sort.SliceStable(ls, func(i, j int) bool {
-			if ls[i].State == ls[j].State {
-				return ls[i].CreateTime.Unix() > ls[j].CreateTime.Unix()
-			}
-			return ls[i].State < ls[j].State
-		})
-
-		for _, t := range ls {
-			row := &model.TaskRow{
-				ID:     strconv.FormatUint(t.ID, 16),
-				Name:   t.Name,
-				Domain: domain.domain,
-				State:  t.GetState(),
-				URL:    t.Url,
-			}
-			if t.State == task.StateFailed && len(t.ErrDetails) > 0 {
-				row.LastError = strconv.Itoa(t.ErrDetails[len(t.ErrDetails)-1].ErrCode)
-			}
-			if !t.StartTime.IsZero() {
-				if t.EndTime.IsZero() {
-					row.Age = fmt.Sprintf("%0.1fs", now.Sub(t.StartTime).Seconds())
-				} else {
-					row.Age = fmt.Sprintf("%0.1fs", t.EndTime.Sub(t.StartTime).Seconds())
-				}
-			}
+	var rows []interface{}
+	for _, b := range s.browserList() {
+		for _, row := range b.rows(now) {
 			rows = append(rows, row)
 		}
 	}
 	return rows
 }
 
+// close 保存队列中的任务, Browser的任务树在各自停止时保存.
+// 集群模式下队列中的任务仍在共享队列的执行中, 由coordinator放回.
 func (s *Scheduler) close() {
-	// todo: 保存状态
+	for s.cluster == nil && len(s.taskQueue) > 0 {
+		_ = s.persist(<-s.taskQueue)
+	}
+	metrics.TaskQueueDepth.Set(float64(len(s.taskQueue)))
+	s.render.Close()
+	s.download.Close()
 }
 
-func (s *Scheduler) GetTask(domain, task string) *task.Task {
-	if b, ok := s.browsers[domain]; ok {
-		return b.query(task)
+// CrawlState 返回爬取状态的名称
+func (s *Scheduler) CrawlState() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return crawlStates[s.state]
+}
+
+// PauseCrawl 暂停所有Browser, 之后创建的Browser也处于暂停状态
+func (s *Scheduler) PauseCrawl() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != CrawlRunning {
+		return fmt.Errorf("crawl is %s, not running", crawlStates[s.state])
 	}
+	s.state = CrawlPaused
+	for _, b := range s.browsers {
+		_ = b.pause()
+	}
+	logx.Infof("[scheduler] crawl paused")
 	return nil
 }
 
-func (s *Scheduler) DeleteTask(domain string, id uint64) bool {
-	if b, ok := s.browsers[domain]; ok {
-		if t := b.delete(id); t != nil {
-			return true
-		}
+// ResumeCrawl 恢复所有暂停的Browser
+func (s *Scheduler) ResumeCrawl() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != CrawlPaused {
+		return fmt.Errorf("crawl is %s, not paused", crawlStates[s.state])
 	}
+	s.state = CrawlRunning
 	for _, b := range s.browsers {
-		if t := b.delete(id); t != nil {
-			return true
+		_ = b.resume()
+	}
+	logx.Infof("[scheduler] crawl resumed")
+	return nil
+}
+
+// DrainCrawl 不再调度新任务, 在DrainTimeout内等待运行中的任务结束, 超时则中断.
+// 不会阻塞, 排空后Run保存任务并返回.
+func (s *Scheduler) DrainCrawl() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == CrawlDraining || s.state == CrawlStopped {
+		return fmt.Errorf("crawl is already %s", crawlStates[s.state])
+	}
+	s.state = CrawlDraining
+	browsers := make([]*Browser, 0, len(s.browsers))
+	for _, b := range s.browsers {
+		b.drain()
+		browsers = append(browsers, b)
+	}
+	logx.Infof("[scheduler] crawl draining, timeout: %v", s.config.DrainTimeout)
+	go s.drain(browsers)
+	return nil
+}
+
+// drain 等待运行中的任务结束, 超时后中断剩余的任务
+func (s *Scheduler) drain(browsers []*Browser) {
+	done := make(chan struct{})
+	go func() {
+		for _, b := range browsers {
+			b.executing.Wait()
 		}
+		close(done)
+	}()
+	timer := time.NewTimer(s.config.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		logx.Warnf("[scheduler] drain timeout after %v, interrupt running tasks", s.config.DrainTimeout)
+		for _, b := range browsers {
+			b.interrupt()
+		}
+		<-done
+	}
+	close(s.drained)
+}
+
+// locate 查找任务所在的Browser, domain为空时在所有Browser中查找
+func (s *Scheduler) locate(domain string, id uint64) (*Browser, error) {
+	if domain != "" {
+		if b, ok := s.lookup(domain); ok && b.has(id) {
+			return b, nil
+		}
+		return nil, fmt.Errorf("task[%x] not found in browser %s", id, domain)
+	}
+	for _, b := range s.browserList() {
+		if b.has(id) {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("task[%x] not found", id)
+}
+
+// GetTask 返回任务及其子树
+func (s *Scheduler) GetTask(domain string, id uint64) (json.RawMessage, error) {
+	b, err := s.locate(domain, id)
+	if err != nil {
+		return nil, err
+	}
+	return b.get(id)
+}
+
+// CancelTask 取消运行中或等待调度的任务, 被取消的任务不会自动重试
+func (s *Scheduler) CancelTask(domain string, id uint64) error {
+	b, err := s.locate(domain, id)
+	if err != nil {
+		return err
+	}
+	return b.cancel(id)
+}
+
+// DeleteTask 删除任务及其子树
+func (s *Scheduler) DeleteTask(domain string, id uint64) bool {
+	b, err := s.locate(domain, id)
+	if err != nil {
+		return false
 	}
-	return false
+	return b.delete(id) != nil
+}
+
+// RetryTask 强制重试失败的任务, 不受自动重试的次数和错误类型限制
+func (s *Scheduler) RetryTask(domain string, id uint64) error {
+	b, err := s.locate(domain, id)
+	if err != nil {
+		return err
+	}
+	return b.retry(id)
+}
+
+// SetPriority 修改任务的优先级
+func (s *Scheduler) SetPriority(domain string, id uint64, priority int) error {
+	if priority < 0 {
+		return fmt.Errorf("priority must not be negative")
+	}
+	b, err := s.locate(domain, id)
+	if err != nil {
+		return err
+	}
+	return b.setPriority(id, priority)
+}
+
+// PauseBrowser 暂停调度指定Browser的任务
+func (s *Scheduler) PauseBrowser(domain string) error {
+	b, ok := s.lookup(domain)
+	if !ok {
+		return fmt.Errorf("browser %s not found", domain)
+	}
+	return b.pause()
+}
+
+// ResumeBrowser 恢复调度指定Browser的任务
+func (s *Scheduler) ResumeBrowser(domain string) error {
+	b, ok := s.lookup(domain)
+	if !ok {
+		return fmt.Errorf("browser %s not found", domain)
+	}
+	return b.resume()
 }
 
 func (s *Scheduler) SetProcess(domain string, num int) {
-	if b, ok := s.browsers[domain]; ok {
+	if b, ok := s.lookup(domain); ok {
 		b.SetProcess(num)
 	}
 }
 
-func (s *Scheduler) GetTree(domain string) interface{} {
-	if b, ok := s.browsers[domain]; ok {
-		return b.tree()
+// SetRateLimit 调整指定Browser的限速
+func (s *Scheduler) SetRateLimit(domain string, conf config.RateLimitConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
 	}
+	b, ok := s.lookup(domain)
+	if !ok {
+		return fmt.Errorf("browser %s not found", domain)
+	}
+	b.SetRateLimit(conf)
 	return nil
 }
+
+func (s *Scheduler) GetRateLimit(domain string) (config.RateLimitConfig, bool) {
+	if b, ok := s.lookup(domain); ok {
+		return b.limiter.Limit(), true
+	}
+	return config.RateLimitConfig{}, false
+}
+
+// Proxies 返回http下载使用的代理的健康状况
+func (s *Scheduler) Proxies() []download.ProxyStatus {
+	return s.download.Proxies()
+}
+
+// Cluster 返回集群的状态, 包括每个域名由哪个worker调度
+func (s *Scheduler) Cluster() (*cluster.Status, error) {
+	if s.cluster == nil {
+		browsers := s.browserList()
+		owners := make(map[string]string, len(browsers))
+		for _, b := range browsers {
+			owners[b.domain] = ""
+		}
+		return &cluster.Status{Mode: cluster.ModeStandalone, Owners: owners}, nil
+	}
+	return s.cluster.Status()
+}
+
+func (s *Scheduler) GetTree(domain string) interface{} {
+	b, ok := s.lookup(domain)
+	if !ok {
+		return nil
+	}
+	tree, err := b.tree()
+	if err != nil {
+		logx.Errorf("[scheduler] marshal tree of Browser[%s] failed: %v", domain, err)
+		return nil
+	}
+	return tree
+}
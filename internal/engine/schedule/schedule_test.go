@@ -0,0 +1,486 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/cluster"
+	"github.com/xiaorui77/monker-king/internal/engine/download"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"github.com/xiaorui77/monker-king/internal/storage"
+	error2 "github.com/xiaorui77/monker-king/pkg/error"
+)
+
+func TestScheduler_Fetcher(t *testing.T) {
+	conf := config.Default()
+	conf.Download.Render.Domains = []string{"spa.com"}
+	s := NewRunner(conf, nil, nil)
+
+	cases := []struct {
+		domain  string
+		fetcher string
+		expect  download.Fetcher
+	}{
+		{"a.com", "", s.download},
+		{"spa.com", "", s.render},
+		{"a.com", download.FetcherRender, s.render},
+		{"spa.com", download.FetcherHTTP, s.download},
+		{"a.com", "unknown", s.download},
+	}
+	for _, c := range cases {
+		tk := task.NewTask("", nil, "https://"+c.domain, nil)
+		tk.Domain = c.domain
+		tk.SetMeta(task.MetaFetcher, c.fetcher)
+		if _, f := s.fetcher(tk); f != c.expect {
+			t.Errorf("domain %s with fetcher %q got unexpected fetcher %T", c.domain, c.fetcher, f)
+		}
+	}
+}
+
+type stubParsing struct{}
+
+func (stubParsing) HandleOnResponse(*types.ResponseWarp) error2.Error { return nil }
+func (stubParsing) RestoreTask(*task.Task) error                      { return nil }
+
+// stubFetcher 不发出请求, 直接返回200
+type stubFetcher struct{}
+
+func (stubFetcher) Get(ctx context.Context, t *task.Task) (*types.ResponseWarp, error2.Error) {
+	t.SetMeta("fetched", true)
+	return &types.ResponseWarp{StatusCode: http.StatusOK}, nil
+}
+
+func newTestScheduler(t *testing.T, idleTimeout time.Duration) *Scheduler {
+	conf := config.Default()
+	conf.Scheduler.Parallelism = 2
+	conf.Scheduler.TaskInterval = time.Millisecond
+	conf.Scheduler.IdleTimeout = idleTimeout
+	conf.Scheduler.Robots.Enabled = false
+	conf.Scheduler.RateLimit = config.RateLimitConfig{}
+	store, err := storage.NewStorage(config.StorageConfig{Driver: storage.DriverMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	s := NewRunner(conf, stubParsing{}, store)
+	s.fetchers["stub"] = stubFetcher{}
+	return s
+}
+
+func newStubTask(domain string, i int, wg *sync.WaitGroup) *task.Task {
+	wg.Add(1)
+	tk := task.NewTask(fmt.Sprintf("task-%d", i), nil, fmt.Sprintf("https://%s/%d", domain, i), func(*task.Task, *types.ResponseWarp) error {
+		wg.Done()
+		return nil
+	})
+	tk.Domain = domain
+	tk.SetMeta(task.MetaFetcher, "stub")
+	return tk
+}
+
+// TestScheduler_Concurrent 需要配合 -race 运行
+func TestScheduler_Concurrent(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+
+	domains := []string{"a.com", "b.com", "c.com"}
+	var tasks, workers sync.WaitGroup
+	for i, domain := range domains {
+		workers.Add(1)
+		go func(i int, domain string) {
+			defer workers.Done()
+			for j := 0; j < 20; j++ {
+				if err := s.AddTask(newStubTask(domain, i*100+j, &tasks)); err != nil {
+					t.Error(err)
+				}
+				s.GetRows()
+				s.GetTree(domain)
+				s.SetProcess(domain, j%3+1)
+				_ = s.SetRateLimit(domain, config.RateLimitConfig{})
+			}
+		}(i, domain)
+	}
+	workers.Wait()
+	waitTimeout(t, &tasks, time.Second*10)
+
+	if rows := s.GetRows(); len(rows) != len(domains)*20 {
+		t.Errorf("expect %d rows, got %d", len(domains)*20, len(rows))
+	}
+	for _, domain := range domains {
+		if tree, ok := s.GetTree(domain).(json.RawMessage); !ok || !strings.Contains(string(tree), `"fetched":true`) {
+			t.Errorf("tree of %s should contain meta set by fetcher: %v", domain, s.GetTree(domain))
+		}
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 10):
+		t.Fatal("scheduler should stop after ctx done")
+	}
+	if n := len(s.browserList()); n != 0 {
+		t.Errorf("all browsers should be removed after stopped, got %d", n)
+	}
+}
+
+func TestBrowser_SetProcess(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	b := NewBrowser(s, "a.com")
+	// 启动前只记录数量
+	b.SetProcess(3)
+	if n := b.ProcessNum(); n != 0 {
+		t.Fatalf("browser not started should have no process, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.run(ctx)
+		close(done)
+	}()
+	for _, n := range []int{3, 5, 1} {
+		if n != 3 {
+			b.SetProcess(n)
+		}
+		deadline := time.Now().Add(time.Second)
+		for b.ProcessNum() != n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := b.ProcessNum(); got != n {
+			t.Errorf("expect %d processes, got %d", n, got)
+		}
+	}
+	cancel()
+	<-done
+	if state := b.State(); state != browserStates[BrowserStopped] {
+		t.Errorf("expect stopped, got %s", state)
+	}
+	if b.push(task.NewTask("", nil, "https://a.com", nil)) {
+		t.Error("stopped browser should not accept tasks")
+	}
+}
+
+func TestScheduler_IdleStop(t *testing.T) {
+	s := newTestScheduler(t, time.Millisecond*20)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	var tasks sync.WaitGroup
+	if err := s.AddTask(newStubTask("a.com", 1, &tasks)); err != nil {
+		t.Fatal(err)
+	}
+	waitTimeout(t, &tasks, time.Second*5)
+	first, _ := s.lookup("a.com")
+
+	// 空闲超时后停止并从注册表移除
+	deadline := time.Now().Add(time.Second * 5)
+	for _, ok := s.lookup("a.com"); ok && time.Now().Before(deadline); _, ok = s.lookup("a.com") {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if _, ok := s.lookup("a.com"); ok {
+		t.Fatal("idle browser should be removed")
+	}
+	if state := first.State(); state != browserStates[BrowserStopped] {
+		t.Errorf("expect stopped, got %s", state)
+	}
+
+	// 新任务会重新创建Browser
+	if err := s.AddTask(newStubTask("a.com", 2, &tasks)); err != nil {
+		t.Fatal(err)
+	}
+	waitTimeout(t, &tasks, time.Second*5)
+}
+
+func waitTimeout(t *testing.T, wg *sync.WaitGroup, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("tasks should finish in time")
+	}
+}
+
+// blockFetcher 阻塞直到任务被取消
+type blockFetcher struct {
+	started chan uint64
+}
+
+func (f blockFetcher) Get(ctx context.Context, t *task.Task) (*types.ResponseWarp, error2.Error) {
+	f.started <- t.ID
+	<-ctx.Done()
+	return nil, &error2.Err{Code: task.ErrDoRequest, Err: ctx.Err()}
+}
+
+func TestScheduler_TaskControl(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	started := make(chan uint64, 1)
+	s.fetchers["block"] = blockFetcher{started: started}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	blocked := task.NewTask("block", nil, "https://a.com/block", nil)
+	blocked.Domain = "a.com"
+	blocked.SetMeta(task.MetaFetcher, "block")
+	if err := s.AddTask(blocked); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, started, blocked.ID)
+	b, _ := s.lookup("a.com")
+
+	// 取消运行中的任务, 不会被自动重试
+	if err := s.CancelTask("", blocked.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, b, blocked, task.StateFailed)
+	b.mu.Lock()
+	code, pending := blocked.ErrDetails[len(blocked.ErrDetails)-1].ErrCode, !blocked.NextAttempt.IsZero()
+	b.mu.Unlock()
+	if code != task.ErrCancelled || pending {
+		t.Errorf("cancelled task should not be retried automatically, got code %d", code)
+	}
+
+	// 强制重试后删除运行中的任务
+	if err := s.RetryTask("a.com", blocked.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, started, blocked.ID)
+	if !s.DeleteTask("", blocked.ID) {
+		t.Fatal("task should be deleted")
+	}
+	if _, err := s.GetTask("", blocked.ID); err == nil {
+		t.Error("deleted task should not be found")
+	}
+
+	// 暂停时不调度新任务
+	if err := s.PauseBrowser("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	var tasks sync.WaitGroup
+	if err := s.AddTask(newStubTask("a.com", 1, &tasks)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if state := b.State(); state != browserStates[BrowserPaused] {
+		t.Errorf("expect paused, got %s", state)
+	}
+	if err := s.ResumeBrowser("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	waitTimeout(t, &tasks, time.Second*5)
+
+	if err := s.SetPriority("", blocked.ID, 1); err == nil {
+		t.Error("set priority of deleted task should fail")
+	}
+}
+
+func waitStarted(t *testing.T, started <-chan uint64, id uint64) {
+	t.Helper()
+	select {
+	case got := <-started:
+		if got != id {
+			t.Fatalf("expect task[%x] started, got task[%x]", id, got)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("task should start in time")
+	}
+}
+
+func waitState(t *testing.T, b *Browser, tk *task.Task, state int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		got := tk.State
+		b.mu.Unlock()
+		if got == state {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("task[%x] should be %s", tk.ID, task.StateStatus[state])
+}
+
+func TestScheduler_Drain(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	s.config.DrainTimeout = time.Millisecond * 50
+	started := make(chan uint64, 1)
+	s.fetchers["block"] = blockFetcher{started: started}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+
+	if err := s.PauseCrawl(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResumeCrawl(); err != nil || s.CrawlState() != crawlStates[CrawlRunning] {
+		t.Fatalf("crawl should be resumed, got %s: %v", s.CrawlState(), err)
+	}
+
+	blocked := task.NewTask("block", nil, "https://a.com/block", nil)
+	blocked.Domain = "a.com"
+	blocked.SetMeta(task.MetaFetcher, "block")
+	if err := s.AddTask(blocked); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, started, blocked.ID)
+
+	// 模拟SIGTERM, 超时后中断运行中的任务
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("scheduler should stop after drained")
+	}
+	if state := s.CrawlState(); state != crawlStates[CrawlStopped] {
+		t.Errorf("expect stopped, got %s", state)
+	}
+
+	// 停止后的任务只保存, 恢复时调度
+	var tasks sync.WaitGroup
+	later := newStubTask("b.com", 1, &tasks)
+	if err := s.AddTask(later); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{blocked.ID, later.ID} {
+		got := &task.Task{}
+		if err := s.store.GetDB().First(got, id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if got.State != task.StateInit {
+			t.Errorf("task[%x] should be saved as init, got %s", id, got.GetState())
+		}
+	}
+}
+
+// flakyFetcher 前failures次请求失败
+type flakyFetcher struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (f *flakyFetcher) Get(ctx context.Context, t *task.Task) (*types.ResponseWarp, error2.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return nil, &error2.Err{Code: task.ErrHttpUnknown + http.StatusServiceUnavailable, Err: fmt.Errorf("unavailable")}
+	}
+	return &types.ResponseWarp{StatusCode: http.StatusOK}, nil
+}
+
+func TestScheduler_RetryPolicy(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	s.config.Retry.Backoff = time.Millisecond
+	s.retry = newRetryPolicies(s.config.Retry)
+	s.fetchers["flaky"] = &flakyFetcher{failures: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	var tasks sync.WaitGroup
+	tk := newStubTask("a.com", 1, &tasks)
+	tk.SetMeta(task.MetaFetcher, "flaky")
+	if err := s.AddTask(tk); err != nil {
+		t.Fatal(err)
+	}
+	waitTimeout(t, &tasks, time.Second*5)
+	b, _ := s.lookup("a.com")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(tk.ErrDetails) != 2 || !tk.NextAttempt.IsZero() {
+		t.Errorf("task should succeed after 2 failures, got %d failures, next attempt %v", len(tk.ErrDetails), tk.NextAttempt)
+	}
+}
+
+// TestBrowser_PushTooDeep 集群模式下超过最大深度而丢弃的任务也需要确认, 否则不会再领取该域名的任务
+func TestBrowser_PushTooDeep(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	node := cluster.NewNode(config.ClusterConfig{
+		Mode: cluster.ModeCoordinator, WorkerID: "w1", LeaseTTL: time.Millisecond * 30, Prefetch: 1,
+	}, cluster.NewMemoryBackend())
+	s.Join(node)
+	for i := 0; i < 2; i++ {
+		tk := task.NewTask("", nil, fmt.Sprintf("https://a.com/%d", i), nil)
+		tk.Domain, tk.Depth = "a.com", s.config.MaxDepth+1
+		if err := node.Push(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delivered := make(chan *task.Task, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go node.Run(ctx, func(t *task.Task) { delivered <- t }, s.revoke)
+
+	b := NewBrowser(s, "a.com")
+	for i := 0; i < 2; i++ {
+		select {
+		case tk := <-delivered:
+			b.push(tk)
+		case <-time.After(time.Second):
+			t.Fatalf("task %d is not delivered", i)
+		}
+	}
+}
+
+// TestBrowser_RetryNotAcked 集群模式下等待重试的任务不能确认, worker失效时由coordinator放回队列
+func TestBrowser_RetryNotAcked(t *testing.T) {
+	s := newTestScheduler(t, 0)
+	node := cluster.NewNode(config.ClusterConfig{
+		Mode: cluster.ModeCoordinator, WorkerID: "w1", LeaseTTL: time.Millisecond * 30, Prefetch: 2,
+	}, cluster.NewMemoryBackend())
+	s.Join(node)
+	for i := 0; i < 2; i++ {
+		tk := task.NewTask("", nil, fmt.Sprintf("https://a.com/%d", i), nil)
+		tk.Domain = "a.com"
+		if err := node.Push(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delivered := make(chan *task.Task, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go node.Run(ctx, func(t *task.Task) { delivered <- t }, s.revoke)
+
+	b := NewBrowser(s, "a.com")
+	var tasks []*task.Task
+	for i := 0; i < 2; i++ {
+		select {
+		case tk := <-delivered:
+			b.push(tk)
+			tasks = append(tasks, tk)
+		case <-time.After(time.Second):
+			t.Fatalf("task %d is not delivered", i)
+		}
+	}
+	b.reject(tasks[0], task.ErrDoRequest, "connection refused")
+	if !node.Taken(tasks[0]) {
+		t.Errorf("task waiting for retry should not be acked")
+	}
+	b.reject(tasks[1], task.ErrRobotsDisallowed, "disallowed by robots.txt")
+	if node.Taken(tasks[1]) {
+		t.Errorf("task failed permanently should be acked")
+	}
+}
@@ -0,0 +1,50 @@
+package schedule
+
+import (
+	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/engine/download"
+	"gorm.io/gorm"
+)
+
+// session 返回域名的会话, 不存在时创建并恢复保存的cookie
+func (s *Scheduler) session(domain string) *download.Session {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	if sess, ok := s.sessions[domain]; ok {
+		return sess
+	}
+	sess := s.download.NewSession(domain)
+	if s.persistCookies {
+		var cookies []*download.SavedCookie
+		if err := s.store.GetDB().Where("session = ?", domain).Find(&cookies).Error; err != nil {
+			logx.Errorf("[storage] load cookies of Browser[%s] error: %v", domain, err)
+		} else {
+			sess.Restore(cookies)
+		}
+	}
+	s.sessions[domain] = sess
+	return sess
+}
+
+// saveSession 保存会话中有修改的cookie
+func (s *Scheduler) saveSession(sess *download.Session) {
+	if !s.persistCookies {
+		return
+	}
+	cookies, changed := sess.Saved()
+	if !changed {
+		return
+	}
+	err := s.store.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session = ?", sess.Domain()).Delete(&download.SavedCookie{}).Error; err != nil {
+			return err
+		}
+		if len(cookies) == 0 {
+			return nil
+		}
+		return tx.Create(cookies).Error
+	})
+	if err != nil {
+		logx.Errorf("[storage] save cookies of Browser[%s] error: %v", sess.Domain(), err)
+	}
+}
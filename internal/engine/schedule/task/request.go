@@ -0,0 +1,170 @@
+package task
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Request 任务的HTTP请求, 零值为不带请求体的GET.
+// 请求体最多设置Form, JSON, Multipart中的一种, 设置了请求体但未设置Method时使用POST.
+type Request struct {
+	Method    string          `json:"method,omitempty"`
+	Header    http.Header     `json:"header,omitempty"`
+	Form      url.Values      `json:"form,omitempty"` // application/x-www-form-urlencoded
+	JSON      json.RawMessage `json:"json,omitempty"` // application/json
+	Multipart *Multipart      `json:"multipart,omitempty"`
+}
+
+// Multipart multipart/form-data的请求体, 文件在每次请求时读取
+type Multipart struct {
+	Fields url.Values        `json:"fields,omitempty"`
+	Files  map[string]string `json:"files,omitempty"` // 字段名 -> 本地文件路径
+}
+
+// GetMethod 返回请求方法, 默认为GET, 有请求体时为POST
+func (r *Request) GetMethod() string {
+	if r.Method != "" {
+		return strings.ToUpper(r.Method)
+	}
+	if r.HasBody() {
+		return http.MethodPost
+	}
+	return http.MethodGet
+}
+
+// HasBody 是否设置了请求体
+func (r *Request) HasBody() bool {
+	return r.Form != nil || r.JSON != nil || r.Multipart != nil
+}
+
+// IsZero 不带请求头和请求体的GET
+func (r *Request) IsZero() bool {
+	return r.GetMethod() == http.MethodGet && len(r.Header) == 0 && !r.HasBody()
+}
+
+// Signature 区分相同URL的不同请求, 由请求方法和请求体决定, 不带请求体的GET为空
+func (r *Request) Signature() string {
+	method := r.GetMethod()
+	if method == http.MethodGet && !r.HasBody() {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(method)
+	switch {
+	case r.Form != nil:
+		b.WriteString("\nform:" + r.Form.Encode())
+	case r.JSON != nil:
+		var compact bytes.Buffer
+		if json.Compact(&compact, r.JSON) == nil {
+			b.WriteString("\njson:" + compact.String())
+		} else {
+			b.WriteString("\njson:" + string(r.JSON))
+		}
+	case r.Multipart != nil:
+		b.WriteString("\nmultipart:" + r.Multipart.Fields.Encode())
+		names := make([]string, 0, len(r.Multipart.Files))
+		for name := range r.Multipart.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			b.WriteString("&" + name + "@" + r.Multipart.Files[name])
+		}
+	}
+	return b.String()
+}
+
+// Value implement driver.Valuer for gorm, 零值保存为NULL
+func (r Request) Value() (driver.Value, error) {
+	if r.IsZero() {
+		return nil, nil
+	}
+	return json.Marshal(r)
+}
+
+// Scan implement sql.Scanner for gorm.
+func (r *Request) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported request type: %T", value)
+	}
+	*r = Request{}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, r)
+}
+
+// WithRequest 设置完整的请求
+func WithRequest(r Request) Option {
+	return func(task *Task) {
+		task.Request = r
+	}
+}
+
+// WithMethod 设置请求方法
+func WithMethod(method string) Option {
+	return func(task *Task) {
+		task.Request.Method = strings.ToUpper(method)
+	}
+}
+
+// WithHeader 设置请求头, 覆盖会话中的默认值
+func WithHeader(key, value string) Option {
+	return func(task *Task) {
+		if task.Request.Header == nil {
+			task.Request.Header = http.Header{}
+		}
+		task.Request.Header.Set(key, value)
+	}
+}
+
+// WithQuery 将查询参数合并到任务的URL中, 同名参数被覆盖
+func WithQuery(query url.Values) Option {
+	return func(task *Task) {
+		u, err := url.Parse(task.Url)
+		if err != nil {
+			return
+		}
+		q := u.Query()
+		for k, v := range query {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+		task.Url = u.String()
+	}
+}
+
+// WithForm 使用application/x-www-form-urlencoded的请求体
+func WithForm(form url.Values) Option {
+	return func(task *Task) {
+		task.Request.Form, task.Request.JSON, task.Request.Multipart = form, nil, nil
+	}
+}
+
+// WithJSON 使用已编码的JSON作为请求体
+func WithJSON(body []byte) Option {
+	return func(task *Task) {
+		task.Request.Form, task.Request.JSON, task.Request.Multipart = nil, body, nil
+	}
+}
+
+// WithMultipart 使用multipart/form-data的请求体, files为字段名到本地文件路径
+func WithMultipart(fields url.Values, files map[string]string) Option {
+	return func(task *Task) {
+		task.Request.Form, task.Request.JSON = nil, nil
+		task.Request.Multipart = &Multipart{Fields: fields, Files: files}
+	}
+}
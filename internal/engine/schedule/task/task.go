@@ -5,6 +5,7 @@ import (
 	"fmt"
 	timeutil "github.com/xiaorui77/goutils/time"
 	"github.com/xiaorui77/monker-king/internal/engine/types"
+	"github.com/xiaorui77/monker-king/internal/metrics"
 	"math/rand"
 	"time"
 )
@@ -40,7 +41,9 @@ var StateStatus = map[int]string{
 	3: "Init",
 	4: "Failed",
 	5: "Successful",
-	6: "SuccessfulAll",
+	6: "SuccessfulNoall",
+	7: "CompleteNoall",
+	8: "SuccessfulAll",
 }
 
 type Task struct {
@@ -53,6 +56,8 @@ type Task struct {
 	Url      string `json:"url"`
 	Domain   string `json:"domain"`
 	Meta     Meta   `json:"meta" gorm:"type:string"`
+	// 请求方法, 请求头和请求体, 零值为GET
+	Request Request `json:"request" gorm:"type:string"`
 	// 优先级: [0, MAX_INT), 值越大优先级越高
 	Priority int `json:"priority"`
 
@@ -60,6 +65,8 @@ type Task struct {
 	StartTime  time.Time   `json:"startTime,omitempty"` // 运行开始时间, 重试时会重置
 	EndTime    time.Time   `json:"endTime,omitempty"`   // 运行结束时间(保护成功和失败), 重试时会重置
 	ErrDetails []ErrDetail `json:"errDetails,omitempty"`
+	// 失败后按重试策略下一次运行的时间, 为零值时不会自动重试
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
 
 	Children *List `json:"children" gorm:"embedded"`
 
@@ -117,6 +124,7 @@ func (t *Task) GetState() string {
 
 func (t *Task) SetState(state int) {
 	t.State = state
+	metrics.TaskTransitions.WithLabelValues(t.GetState()).Inc()
 	switch t.State {
 	case StateRunning:
 		t.StartTime = time.Now()
@@ -127,7 +135,7 @@ func (t *Task) SetState(state int) {
 		}
 		p := t.Parent
 		if p != nil && p.Children != nil && p.Children.isSuccessfulAll() {
-			p.State = StateSuccessfulAll
+			p.SetState(StateSuccessfulAll)
 		}
 	case StateFailed:
 		t.EndTime = time.Now()
@@ -181,6 +189,32 @@ func (t *Task) Push(n *Task) {
 	t.Children.Push(n)
 }
 
+// Retry 重新调度失败的任务, 不检查重试策略
+func (t *Task) Retry() bool {
+	if t.State != StateFailed {
+		return false
+	}
+	t.NextAttempt = time.Time{}
+	t.SetState(StateInit)
+	metrics.TaskRetries.WithLabelValues(t.Domain).Inc()
+	if t.Parent != nil && t.Parent.Children != nil {
+		t.Parent.Children.offset = 0
+	}
+	return true
+}
+
+// Detach 将任务从父任务中移除, 父任务剩余的子任务均已成功时标记为SuccessfulAll
+func (t *Task) Detach() bool {
+	p := t.Parent
+	if p == nil || p.Children == nil || !p.Children.Remove(t) {
+		return false
+	}
+	if p.State == StateSuccessful && p.Children.isSuccessfulAll() {
+		p.SetState(StateSuccessfulAll)
+	}
+	return true
+}
+
 // 获取下一个子任务
 func (t *Task) nextSub() *Task {
 	if t.State == StateSuccessful && t.Children != nil {
@@ -201,9 +235,15 @@ func AddOnCreatedHandler(handler OnCreated) Option {
 	}
 }
 
+// WithMeta 创建任务时设置meta
+func WithMeta(key string, value interface{}) Option {
+	return func(task *Task) {
+		task.SetMeta(key, value)
+	}
+}
+
 func (t *Task) ListAll() []*Task {
-	res := make([]*Task, 0, len(t.Children.Tasks))
-	res = append(res, t)
+	res := []*Task{t}
 
 	for i := 0; i < len(res); i++ {
 		task := res[i]
@@ -1,7 +1,10 @@
 package task
 
 import (
+	"net/url"
 	"testing"
+
+	"github.com/xiaorui77/monker-king/internal/utils/fileutil"
 )
 
 var root *Task
@@ -62,3 +65,104 @@ func TestNext(t *testing.T) {
 		t.Logf("%dth: %v", i, ta)
 	}
 }
+
+func TestBuildTree(t *testing.T) {
+	u := "https://example.com"
+	r := NewTask("r", nil, u, nil)
+	a := NewTask("a", r, u, nil)
+	b := NewTask("b", a, u, nil)
+	orphan := NewTask("orphan", nil, u, nil)
+	orphan.ParentId = 1 // 父任务不存在
+	a.SetState(StateSuccessful)
+
+	// 打乱顺序模拟从存储中读取
+	roots := BuildTree([]*Task{b, orphan, a, r})
+	if len(roots) != 2 {
+		t.Fatalf("expect 2 roots, but got %d", len(roots))
+	}
+	if r.Children == nil || len(r.Children.Tasks) != 1 || r.Children.Tasks[0] != a {
+		t.Fatalf("task a should be child of r")
+	}
+	if b.Parent != a || a.State != StateSuccessful {
+		t.Errorf("task b should be child of a and a keeps its state")
+	}
+}
+
+func TestList_Control(t *testing.T) {
+	setup()
+	a1, b2 := root.Children.Tasks[0], root.Children.Tasks[0].Children.Tasks[1]
+	l := NewTaskList()
+	l.Push(root)
+	if l.Find(b2.ID) != b2 || l.Find(0) != nil {
+		t.Fatalf("task b2 should be found")
+	}
+
+	a3 := root.Children.Tasks[2]
+	root.Children.Reprioritize(a3, 10)
+	if root.Children.Tasks[0] != a3 {
+		t.Errorf("task a3 should be first after reprioritized")
+	}
+
+	b2.SetState(StateFailed)
+	if !b2.Retry() || b2.State != StateInit {
+		t.Errorf("failed task should be retried, got %s", b2.GetState())
+	}
+	if b2.Retry() {
+		t.Errorf("only failed task can be retried")
+	}
+
+	if !a1.Detach() || l.Find(b2.ID) != nil || len(root.Children.Tasks) != 2 {
+		t.Errorf("task a1 and its children should be removed")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	get := NewTask("get", nil, "https://example.com/s?a=1", nil, WithQuery(url.Values{"q": {"monkey"}}))
+	if get.Url != "https://example.com/s?a=1&q=monkey" || get.Request.Signature() != "" || !get.Request.IsZero() {
+		t.Errorf("unexpected get task: %s %+v", get.Url, get.Request)
+	}
+	if v, err := get.Request.Value(); v != nil || err != nil {
+		t.Errorf("zero request should be saved as NULL, got %v", v)
+	}
+
+	post := NewTask("post", nil, "https://example.com/s", nil, WithForm(url.Values{"q": {"monkey"}}), WithHeader("X-Token", "t"))
+	if post.Request.GetMethod() != "POST" || post.Request.Signature() != "POST\nform:q=monkey" {
+		t.Errorf("unexpected post request: %+v", post.Request)
+	}
+	v, err := post.Request.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &Request{}
+	if err := restored.Scan(v); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Signature() != post.Request.Signature() || restored.Header.Get("X-Token") != "t" {
+		t.Errorf("request should be restored: %+v", restored)
+	}
+
+	a := NewTask("a", nil, "https://example.com/api", nil, WithJSON([]byte(`{"page": 1}`)))
+	b := NewTask("b", nil, "https://example.com/api", nil, WithJSON([]byte(`{"page":2}`)))
+	if a.Request.Signature() == b.Request.Signature() || a.Request.Signature() != "POST\njson:{\"page\":1}" {
+		t.Errorf("unexpected json signatures: %q, %q", a.Request.Signature(), b.Request.Signature())
+	}
+}
+
+func TestMeta_Scan(t *testing.T) {
+	m := Meta{MetaTimeout: int64(30), MetaReader: &fileutil.VisualReader{Total: 100, Cur: 40, Wire: 20}}
+	data, err := m.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := Meta{}
+	if err := restored.Scan(data); err != nil {
+		t.Fatal(err)
+	}
+	if timeout, ok := restored[MetaTimeout].(int64); !ok || timeout != 30 {
+		t.Errorf("unexpected timeout: %#v", restored[MetaTimeout])
+	}
+	reader, ok := restored[MetaReader].(*fileutil.VisualReader)
+	if !ok || reader.Total != 100 || reader.Cur != 40 || reader.Wire != 20 {
+		t.Errorf("unexpected reader: %#v", restored[MetaReader])
+	}
+}
@@ -2,7 +2,7 @@ package task
 
 import (
 	"encoding/json"
-	"github.com/xiaorui77/goutils/logx"
+	"sort"
 )
 
 type List struct {
@@ -52,53 +52,44 @@ func (l *List) Next() *Task {
 	return nil
 }
 
-func (l *List) RetryFailed() *Task {
-	if len(l.Tasks) == 0 || (l.Tasks[0].Parent != nil && l.Tasks[0].Parent.State == StateCompleteNoall) {
-		return nil
-	}
-	has := false
+// Find 在列表及所有子孙中查找任务
+func (l *List) Find(id uint64) *Task {
 	for _, t := range l.Tasks {
-		if t.State != StateFailed || len(t.ErrDetails) == 0 {
-			// 非错误或者错误无详情时调过分析
-			continue
+		if t.ID == id {
+			return t
 		}
-		if len(t.ErrDetails) > 5 {
-			logx.Warnf("[browser] Task[%x] failure more than 7 times, will no longer try again", t.ID)
-			continue // 超过5次不再重试
-		}
-		n := 0
-		for i := len(t.ErrDetails) - 1; i >= 0; i-- {
-			if t.ErrDetails[i].ErrCode == ErrHttpNotFount {
-				n++
-			} else {
-				break
-			}
-		}
-		if n < 2 {
-			// 连续的NotFound错误小于2次才重试
-			logx.Infof("[browser] Task[%x] can be retry, last err: %s", t.ID, t.ErrDetails[len(t.ErrDetails)-1].String())
-			t.SetState(StateInit)
-			has = true
-			if t.Parent != nil {
-				t.Parent.Children.offset = 0
+		if t.Children != nil {
+			if found := t.Children.Find(id); found != nil {
+				return found
 			}
 		}
 	}
-	if has {
-		if len(l.Tasks) > 0 {
-			return l.Tasks[0].Parent
+	return nil
+}
+
+// Remove 从列表中移除任务及其子树, 不查找子列表
+func (l *List) Remove(t *Task) bool {
+	for i, c := range l.Tasks {
+		if c != t {
+			continue
 		}
-		return nil
+		l.Tasks = append(l.Tasks[:i], l.Tasks[i+1:]...)
+		if l.offset > i {
+			l.offset--
+		}
+		return true
 	}
+	return false
+}
 
-	for _, t := range l.Tasks {
-		if t.Children != nil {
-			if p := t.Children.RetryFailed(); p != nil {
-				return p
-			}
-		}
+// Reprioritize 修改任务的优先级并重新排序
+func (l *List) Reprioritize(t *Task, priority int) bool {
+	if !l.Remove(t) {
+		return false
 	}
-	return nil
+	t.Priority = priority
+	l.Push(t)
+	return true
 }
 
 func (l *List) isSuccessfulAll() bool {
@@ -125,3 +116,33 @@ func (l *List) ListAll() []*Task {
 	}
 	return res
 }
+
+// BuildTree 根据ParentId将平铺的任务重建为树, 返回所有根任务.
+// 找不到父任务的任务会被当作根任务.
+func BuildTree(tasks []*Task) []*Task {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].CreateTime.Before(tasks[j].CreateTime)
+	})
+	index := make(map[uint64]*Task, len(tasks))
+	for _, t := range tasks {
+		t.Parent = nil
+		t.Children = nil
+		index[t.ID] = t
+	}
+
+	roots := make([]*Task, 0)
+	for _, t := range tasks {
+		p, ok := index[t.ParentId]
+		if t.ParentId == 0 || !ok || p == t {
+			roots = append(roots, t)
+			continue
+		}
+		t.Parent = p
+		if p.Children == nil {
+			p.Children = NewTaskList()
+		}
+		// 不使用p.Push, 以保留持久化时的状态
+		p.Children.Push(t)
+	}
+	return roots
+}
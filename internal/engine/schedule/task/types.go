@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	timeutil "github.com/xiaorui77/goutils/time"
+	"github.com/xiaorui77/monker-king/internal/utils/fileutil"
+	"strconv"
 	"time"
 )
 
@@ -13,6 +15,13 @@ const (
 	MetaReader   = "reader"  // record VisualReader
 	MetaSaveName = "save_name"
 	MetaSavePath = "save_path"
+	MetaCallback = "callback" // 回调函数名称, 用于恢复时重新绑定Callback
+	MetaFetcher  = "fetcher"  // 使用的Fetcher: http, render, 为空时按域名配置
+	MetaRetry    = "retry"    // 重试策略的名称, 为空时按域名配置
+	// MetaValidator 下载任务上次响应的强ETag或Last-Modified, 续传时作为If-Range
+	MetaValidator = "validator"
+	// MetaReferer 请求使用的Referer, 为空时按会话配置使用父任务的URL
+	MetaReferer = "referer"
 )
 
 type Meta map[string]interface{}
@@ -22,16 +31,62 @@ func (m Meta) Value() (driver.Value, error) {
 	return json.Marshal(m)
 }
 
+// Scan implement sql.Scanner for gorm.
+func (m *Meta) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported meta type: %T", value)
+	}
+	meta := Meta{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+	}
+	if meta == nil {
+		meta = Meta{}
+	}
+	meta.Normalize()
+	*m = meta
+	return nil
+}
+
+// Normalize 将从JSON还原的值转换为写入时的类型: MetaTimeout为int64, MetaReader为*fileutil.VisualReader
+func (m Meta) Normalize() {
+	if v, ok := m[MetaTimeout].(float64); ok {
+		m[MetaTimeout] = int64(v)
+	}
+	if v, ok := m[MetaReader].(map[string]interface{}); ok {
+		reader := &fileutil.VisualReader{}
+		if data, err := json.Marshal(v); err == nil && json.Unmarshal(data, reader) == nil {
+			m[MetaReader] = reader
+		}
+	}
+}
+
 const (
 	// ErrUnknown 0值
-	ErrUnknown      = iota
-	ErrNewRequest   = 512
-	ErrDoRequest    = 512 + 4
-	ErrReadRespBody = 1024
-	ErrCallback     = 1024 + 16
-	ErrCallbackTask = 1024 + 16 + 4
-	ErrHttpUnknown  = 10000 // 包装http错误码
-	ErrHttpNotFount = 10404 // 404页面
+	ErrUnknown           = iota
+	ErrCancelled         = 128     // 被手动取消, 不会自动重试
+	ErrRobotsDisallowed  = 256     // robots.txt禁止访问, 不会重试
+	ErrRobotsUnavailable = 256 + 4 // robots.txt请求失败或5xx, 总是可以重试
+	ErrNewRequest        = 512
+	ErrDoRequest         = 512 + 4
+	ErrRender            = 512 + 8  // 无头浏览器渲染失败
+	ErrLogin             = 512 + 12 // 会话登录失败
+	ErrReadRespBody      = 1024
+	ErrWriteFile         = 1024 + 4 // 写入下载的临时文件失败
+	ErrBodyTooLarge      = 1024 + 8 // 解压后的响应体超过download.maxDecodedSize, 不会重试
+	ErrCallback          = 1024 + 16
+	ErrCallbackTask      = 1024 + 16 + 4
+	ErrHttpUnknown       = 10000 // 包装http错误码
+	ErrHttpNotFount      = 10404 // 404页面
 )
 
 type Cost time.Duration
@@ -40,6 +95,27 @@ func (c Cost) Value() (driver.Value, error) {
 	return c.Seconds(), nil
 }
 
+// Scan implement sql.Scanner, 存储的单位为秒
+func (c *Cost) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*c = 0
+	case float64:
+		*c = Cost(v * float64(time.Second))
+	case int64:
+		*c = Cost(time.Duration(v) * time.Second)
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return err
+		}
+		*c = Cost(f * float64(time.Second))
+	default:
+		return fmt.Errorf("unsupported cost type: %T", value)
+	}
+	return nil
+}
+
 // Seconds 返回秒, 精确1位小数
 func (c Cost) Seconds() float64 {
 	return time.Duration(c).Truncate(time.Millisecond * 100).Seconds()
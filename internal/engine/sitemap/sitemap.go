@@ -0,0 +1,336 @@
+package sitemap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/temoto/robotstxt"
+	"github.com/xiaorui77/goutils/logx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxSize 单个sitemap解压后的最大长度, 与协议规定一致
+	MaxSize = 50 * 1024 * 1024
+	// DefaultPriority sitemap中未指定priority时的默认值
+	DefaultPriority = 0.5
+
+	maxNesting = 3 // sitemap index的最大嵌套层数
+)
+
+// conventional 未在robots.txt中声明时尝试的常见位置
+var conventional = []string{"/sitemap.xml", "/sitemap_index.xml"}
+
+// ErrSkip emit返回ErrSkip表示URL未被添加(如已访问过), 不计入数量, 继续处理
+var ErrSkip = errors.New("sitemap: skip url")
+
+// Options 描述从哪些sitemap中发现URL以及如何过滤
+type Options struct {
+	// Site 站点根地址, 用于从robots.txt和常见位置发现sitemap
+	Site string `yaml:"site" json:"site"`
+	// Sitemaps 直接指定的sitemap地址, 可以是sitemap index, 支持gzip
+	Sitemaps []string `yaml:"sitemaps" json:"sitemaps"`
+	// Include/Exclude URL需要匹配任一Include(为空时不限制), 且不匹配任何Exclude
+	Include []string `yaml:"include" json:"include"`
+	Exclude []string `yaml:"exclude" json:"exclude"`
+	// Since 只保留lastmod不早于该时间的URL, 格式为W3C Datetime, 如2022-01-02. 未设置lastmod的URL会保留
+	Since string `yaml:"since" json:"since"`
+	// MaxUrls 最多添加的URL数量, 0表示不限制
+	MaxUrls int `yaml:"max_urls" json:"max_urls"`
+}
+
+// Entry sitemap中的一条URL
+type Entry struct {
+	Loc      string
+	LastMod  time.Time
+	Priority float64
+}
+
+// Fetcher 获取指定URL的内容, 最多读取limit字节
+type Fetcher func(ctx context.Context, rawUrl string, limit int64) (status int, body []byte, err error)
+
+// Seeder 遍历sitemap并输出过滤后的URL
+type Seeder struct {
+	opts  *Options
+	fetch Fetcher
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	since   time.Time
+
+	visited map[string]bool // 已处理的sitemap
+	seen    map[string]bool // 已处理(输出或跳过)的URL
+	count   int
+}
+
+func NewSeeder(opts *Options, fetch Fetcher) (*Seeder, error) {
+	if opts.Site == "" && len(opts.Sitemaps) == 0 {
+		return nil, fmt.Errorf("site or sitemaps is required")
+	}
+	if opts.MaxUrls < 0 {
+		return nil, fmt.Errorf("max_urls must not be negative")
+	}
+	s := &Seeder{
+		opts:    opts,
+		fetch:   fetch,
+		visited: map[string]bool{},
+		seen:    map[string]bool{},
+	}
+	var err error
+	if s.include, err = compile(opts.Include); err != nil {
+		return nil, fmt.Errorf("include: %v", err)
+	}
+	if s.exclude, err = compile(opts.Exclude); err != nil {
+		return nil, fmt.Errorf("exclude: %v", err)
+	}
+	if opts.Since != "" {
+		if s.since, err = parseTime(opts.Since); err != nil {
+			return nil, fmt.Errorf("since: %v", err)
+		}
+	}
+	return s, nil
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Run 依次处理所有sitemap, 对每个符合条件的URL调用emit, 返回输出的URL数量.
+// 单个sitemap获取或解析失败时只记录日志, emit返回ErrSkip以外的错误时终止.
+func (s *Seeder) Run(ctx context.Context, emit func(e *Entry) error) (int, error) {
+	sitemaps := s.opts.Sitemaps
+	if len(sitemaps) == 0 {
+		var err error
+		if sitemaps, err = s.discover(ctx); err != nil {
+			return 0, err
+		}
+	}
+	for _, u := range sitemaps {
+		if err := s.walk(ctx, u, 0, emit); err != nil {
+			return s.count, err
+		}
+		if s.full() {
+			break
+		}
+	}
+	return s.count, nil
+}
+
+// discover 返回robots.txt中声明的sitemap, 以及常见位置的sitemap
+func (s *Seeder) discover(ctx context.Context) ([]string, error) {
+	base, err := url.Parse(s.opts.Site)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid site: %v", s.opts.Site)
+	}
+	if base.Scheme == "" {
+		base.Scheme = "https"
+	}
+	root := &url.URL{Scheme: base.Scheme, Host: base.Host}
+
+	var res []string
+	robotsUrl := root.ResolveReference(&url.URL{Path: "/robots.txt"}).String()
+	status, body, err := s.fetch(ctx, robotsUrl, MaxSize)
+	if err != nil {
+		logx.Warnf("[sitemap] fetch %s failed: %v", robotsUrl, err)
+	} else if data, err := robotstxt.FromStatusAndBytes(status, body); err == nil {
+		res = append(res, data.Sitemaps...)
+	}
+	for _, p := range conventional {
+		res = append(res, root.ResolveReference(&url.URL{Path: p}).String())
+	}
+	return res, nil
+}
+
+func (s *Seeder) walk(ctx context.Context, rawUrl string, depth int, emit func(e *Entry) error) error {
+	if s.visited[rawUrl] || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	s.visited[rawUrl] = true
+
+	status, body, err := s.fetch(ctx, rawUrl, MaxSize+1)
+	if err != nil {
+		logx.Warnf("[sitemap] fetch %s failed: %v", rawUrl, err)
+		return nil
+	}
+	if status != http.StatusOK {
+		logx.Debugf("[sitemap] fetch %s got status %d, skip", rawUrl, status)
+		return nil
+	}
+	doc, err := parse(body)
+	if err != nil {
+		logx.Warnf("[sitemap] parse %s failed: %v", rawUrl, err)
+		return nil
+	}
+	logx.Infof("[sitemap] %s has %d urls and %d sitemaps", rawUrl, len(doc.URLs), len(doc.Sitemaps))
+
+	for _, u := range doc.URLs {
+		if s.full() {
+			return nil
+		}
+		e := u.entry()
+		if !s.match(e) {
+			continue
+		}
+		s.seen[e.Loc] = true
+		if err := emit(e); err == ErrSkip {
+			continue
+		} else if err != nil {
+			return err
+		}
+		s.count++
+	}
+
+	if depth >= maxNesting {
+		if len(doc.Sitemaps) > 0 {
+			logx.Warnf("[sitemap] %s nested too deep, ignore %d sitemaps", rawUrl, len(doc.Sitemaps))
+		}
+		return nil
+	}
+	for _, sm := range doc.Sitemaps {
+		loc := strings.TrimSpace(sm.Loc)
+		// 子sitemap在since之前未修改过, 其中的URL也不会更新
+		if lastMod, err := parseTime(sm.LastMod); err == nil && !s.since.IsZero() && lastMod.Before(s.since) {
+			continue
+		}
+		if err := s.walk(ctx, loc, depth+1, emit); err != nil {
+			return err
+		}
+		if s.full() {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *Seeder) full() bool {
+	return s.opts.MaxUrls > 0 && s.count >= s.opts.MaxUrls
+}
+
+// match 判断URL是否符合过滤条件
+func (s *Seeder) match(e *Entry) bool {
+	if e.Loc == "" || s.seen[e.Loc] {
+		return false
+	}
+	if !s.since.IsZero() && !e.LastMod.IsZero() && e.LastMod.Before(s.since) {
+		return false
+	}
+	if len(s.include) > 0 {
+		matched := false
+		for _, re := range s.include {
+			if re.MatchString(e.Loc) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, re := range s.exclude {
+		if re.MatchString(e.Loc) {
+			return false
+		}
+	}
+	return true
+}
+
+// document urlset和sitemapindex共用的结构
+type document struct {
+	URLs     []xmlURL     `xml:"url"`
+	Sitemaps []xmlSitemap `xml:"sitemap"`
+}
+
+type xmlURL struct {
+	Loc      string `xml:"loc"`
+	LastMod  string `xml:"lastmod"`
+	Priority string `xml:"priority"`
+}
+
+type xmlSitemap struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+func (u *xmlURL) entry() *Entry {
+	e := &Entry{Loc: strings.TrimSpace(u.Loc), Priority: DefaultPriority}
+	if t, err := parseTime(u.LastMod); err == nil {
+		e.LastMod = t
+	}
+	if p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64); err == nil && p >= 0 && p <= 1 {
+		e.Priority = p
+	}
+	return e
+}
+
+// parse 解析sitemap, 支持gzip压缩的XML和每行一个URL的文本格式
+func parse(body []byte) (*document, error) {
+	if len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = ioutil.ReadAll(io.LimitReader(r, MaxSize+1)); err != nil {
+			return nil, err
+		}
+	}
+	if len(body) > MaxSize {
+		return nil, fmt.Errorf("sitemap exceeds %d bytes", MaxSize)
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] != '<' {
+		doc := &document{}
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" {
+				doc.URLs = append(doc.URLs, xmlURL{Loc: line})
+			}
+		}
+		return doc, sc.Err()
+	}
+
+	doc := &document{}
+	if err := xml.Unmarshal(body, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseTime 解析W3C Datetime格式的时间
+func parseTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
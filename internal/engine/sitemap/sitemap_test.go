@@ -0,0 +1,132 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testIndex = `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>{host}/posts.xml.gz</loc><lastmod>2022-03-01</lastmod></sitemap>
+  <sitemap><loc>{host}/old.xml</loc><lastmod>2020-01-01</lastmod></sitemap>
+</sitemapindex>`
+
+const testPosts = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>{host}/post/1</loc><lastmod>2022-02-10T08:00:00+08:00</lastmod><priority>0.8</priority></url>
+  <url><loc>{host}/post/2</loc><lastmod>2021-12-31</lastmod></url>
+  <url><loc>{host}/post/3</loc></url>
+  <url><loc>{host}/tag/go</loc><lastmod>2022-02-11</lastmod></url>
+  <url><loc>{host}/post/1</loc></url>
+</urlset>`
+
+func fetcher() Fetcher {
+	return func(ctx context.Context, rawUrl string, limit int64) (int, []byte, error) {
+		resp, err := http.Get(rawUrl)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body, err
+	}
+}
+
+func TestSeeder_Run(t *testing.T) {
+	var host string
+	fetched := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched[r.URL.Path]++
+		fill := func(s string) []byte { return bytes.ReplaceAll([]byte(s), []byte("{host}"), []byte(host)) }
+		switch r.URL.Path {
+		case "/robots.txt":
+			_, _ = w.Write(fill("User-agent: *\nDisallow:\nSitemap: {host}/index.xml\n"))
+		case "/index.xml":
+			_, _ = w.Write(fill(testIndex))
+		case "/posts.xml.gz":
+			zw := gzip.NewWriter(w)
+			_, _ = zw.Write(fill(testPosts))
+			_ = zw.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host = srv.URL
+
+	s, err := NewSeeder(&Options{Site: srv.URL, Include: []string{"/post/"}, Since: "2022-01-01"}, fetcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*Entry
+	n, err := s.Run(context.Background(), func(e *Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// post/2早于since, tag/go不匹配include, 重复的post/1被忽略, post/3没有lastmod被保留
+	if n != 2 || len(entries) != 2 {
+		t.Fatalf("expect 2 urls, but %d", n)
+	}
+	if entries[0].Loc != host+"/post/1" || entries[0].Priority != 0.8 {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+	if entries[1].Loc != host+"/post/3" || entries[1].Priority != DefaultPriority {
+		t.Errorf("unexpected entry: %+v", entries[1])
+	}
+	if fetched["/old.xml"] != 0 {
+		t.Errorf("sitemap not modified since should be skipped")
+	}
+	if fetched["/sitemap.xml"] != 1 || fetched["/sitemap_index.xml"] != 1 {
+		t.Errorf("conventional sitemaps should be tried: %v", fetched)
+	}
+}
+
+func TestSeeder_MaxUrls(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("https://a.com/1\nhttps://a.com/2\n\nhttps://a.com/3\n"))
+	}))
+	defer srv.Close()
+
+	s, err := NewSeeder(&Options{Sitemaps: []string{srv.URL + "/sitemap.txt"}, MaxUrls: 2}, fetcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.Run(context.Background(), func(e *Entry) error { return nil })
+	if err != nil || n != 2 {
+		t.Errorf("expect 2 urls, but %d: %v", n, err)
+	}
+
+	// 跳过的URL不计入MaxUrls
+	s, _ = NewSeeder(&Options{Sitemaps: []string{srv.URL + "/sitemap.txt"}, MaxUrls: 2}, fetcher())
+	var added []string
+	n, err = s.Run(context.Background(), func(e *Entry) error {
+		if e.Loc == "https://a.com/1" {
+			return ErrSkip
+		}
+		added = append(added, e.Loc)
+		return nil
+	})
+	if err != nil || n != 2 || len(added) != 2 || added[1] != "https://a.com/3" {
+		t.Errorf("skipped url should not be counted, got %d %v: %v", n, added, err)
+	}
+}
+
+func TestNewSeeder_Invalid(t *testing.T) {
+	for _, opts := range []*Options{
+		{},
+		{Site: "https://a.com", Include: []string{"("}},
+		{Site: "https://a.com", Since: "yesterday"},
+	} {
+		if _, err := NewSeeder(opts, fetcher()); err == nil {
+			t.Errorf("expect error of %+v", opts)
+		}
+	}
+}
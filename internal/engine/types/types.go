@@ -1,14 +1,26 @@
 package types
 
 import (
+	"net/http"
 	"net/url"
 	"strings"
 )
 
 type ResponseWarp struct {
 	StatusCode int
+	Header     http.Header
 	Body       []byte
-	Request    *RequestWrap
+	// File 流式下载时保存响应体的临时文件, 此时Body为空
+	File string
+	// Size 本次读取的响应体字节数, 续传时不包括之前已下载的部分; 压缩的响应为解压后的字节数
+	Size int64
+	// Wire 本次传输的响应体字节数, 未压缩时与Size相同; 无头浏览器渲染时未知, 为0
+	Wire int64
+	// Charset 检测到的页面原始字符集, 非UTF-8时Body已转换为UTF-8; 非文本内容为空
+	Charset string
+	// Cached 响应来自缓存: 未过期或服务器返回304
+	Cached  bool
+	Request *RequestWrap
 }
 
 type RequestWrap struct {
@@ -3,6 +3,9 @@ package manager
 import (
 	"fmt"
 	"github.com/xiaorui77/goutils/httpr"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"github.com/xiaorui77/monker-king/internal/engine/sitemap"
+	"strconv"
 )
 
 func (m *Manager) HandleAddTask(c *httpr.Context) {
@@ -12,7 +15,16 @@ func (m *Manager) HandleAddTask(c *httpr.Context) {
 		return
 	}
 
-	c.ResultMessage(fmt.Sprintf("add task success: %v", data.Url), m.collector.Visit(data.Url))
+	c.ResultMessage(fmt.Sprintf("add task success: %v", data.Url), m.collector.Visit(data.Url, task.WithRequest(data.Request)))
+}
+
+func (m *Manager) HandleAddSitemap(c *httpr.Context) {
+	data := &sitemap.Options{}
+	if err := c.ParseJSON(data); err != nil {
+		c.ResultError(err)
+		return
+	}
+	c.ResultMessage(fmt.Sprintf("visit sitemap of %v in background", data.Site), m.collector.VisitSitemap(data))
 }
 
 func (m *Manager) HandleDeleteTask(c *httpr.Context) {
@@ -29,6 +41,72 @@ func (m *Manager) HandleDeleteTask(c *httpr.Context) {
 	}
 }
 
+// taskID 解析路径中的任务ID, 与任务列表中的一致, 为十六进制
+func taskID(c *httpr.Context) (uint64, error) {
+	id, err := strconv.ParseUint(c.Params["id"], 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid task id: %v", c.Params["id"])
+	}
+	return id, nil
+}
+
+func (m *Manager) HandleGetTask(c *httpr.Context) {
+	id, err := taskID(c)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	c.ResultData(m.collector.TaskManager().GetTask(c.Query("domain"), id))
+}
+
+func (m *Manager) HandleRemoveTask(c *httpr.Context) {
+	id, err := taskID(c)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	if m.collector.TaskManager().DeleteTask(c.Query("domain"), id) {
+		c.ResultMessage(fmt.Sprintf("delete task success: %x", id), nil)
+	} else {
+		c.ResultError(fmt.Errorf("not found"))
+	}
+}
+
+func (m *Manager) HandleCancelTask(c *httpr.Context) {
+	id, err := taskID(c)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	err = m.collector.TaskManager().CancelTask(c.Query("domain"), id)
+	c.ResultMessage(fmt.Sprintf("cancel task: %x", id), err)
+}
+
+func (m *Manager) HandleRetryTask(c *httpr.Context) {
+	id, err := taskID(c)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	err = m.collector.TaskManager().RetryTask(c.Query("domain"), id)
+	c.ResultMessage(fmt.Sprintf("retry task: %x", id), err)
+}
+
+func (m *Manager) HandleSetPriority(c *httpr.Context) {
+	id, err := taskID(c)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	data := &PriorityRequest{}
+	if err := c.ParseJSON(data); err != nil {
+		c.ResultError(err)
+		return
+	}
+	err = m.collector.TaskManager().SetPriority(c.Query("domain"), id, data.Priority)
+	c.ResultMessage(fmt.Sprintf("set priority of task %x to %d", id, data.Priority), err)
+}
+
 func (m *Manager) HandleBrowserTree(c *httpr.Context) {
 	domain, ok := c.Params["domain"]
 	if !ok {
@@ -40,3 +118,73 @@ func (m *Manager) HandleBrowserTree(c *httpr.Context) {
 func (m *Manager) HandleListTask(c *httpr.Context) {
 	c.ResultData(m.collector.GetDataProducer().GetRows(), nil)
 }
+
+func (m *Manager) HandleSetProcess(c *httpr.Context) {
+	domain := c.Params["domain"]
+	data := &ProcessRequest{}
+	if err := c.ParseJSON(data); err != nil {
+		c.ResultError(err)
+		return
+	}
+	if data.Num < 0 {
+		c.ResultError(fmt.Errorf("num must not be negative"))
+		return
+	}
+	m.collector.TaskManager().SetProcess(domain, data.Num)
+	c.ResultMessage(fmt.Sprintf("set process of %s to %d", domain, data.Num), nil)
+}
+
+func (m *Manager) HandlePauseBrowser(c *httpr.Context) {
+	domain := c.Params["domain"]
+	c.ResultMessage(fmt.Sprintf("pause browser %s", domain), m.collector.TaskManager().PauseBrowser(domain))
+}
+
+func (m *Manager) HandleResumeBrowser(c *httpr.Context) {
+	domain := c.Params["domain"]
+	c.ResultMessage(fmt.Sprintf("resume browser %s", domain), m.collector.TaskManager().ResumeBrowser(domain))
+}
+
+func (m *Manager) HandleGetRateLimit(c *httpr.Context) {
+	conf, ok := m.collector.TaskManager().GetRateLimit(c.Params["domain"])
+	if !ok {
+		c.ResultError(fmt.Errorf("not found"))
+		return
+	}
+	c.ResultData(conf, nil)
+}
+
+func (m *Manager) HandleSetRateLimit(c *httpr.Context) {
+	domain := c.Params["domain"]
+	data, _ := m.collector.TaskManager().GetRateLimit(domain)
+	if err := c.ParseJSON(&data); err != nil {
+		c.ResultError(err)
+		return
+	}
+	err := m.collector.TaskManager().SetRateLimit(domain, data)
+	c.ResultMessage(fmt.Sprintf("set rate limit of %s: %+v", domain, data), err)
+}
+
+func (m *Manager) HandleCrawlState(c *httpr.Context) {
+	c.ResultData(map[string]string{"state": m.collector.TaskManager().CrawlState()}, nil)
+}
+
+func (m *Manager) HandlePauseCrawl(c *httpr.Context) {
+	c.ResultMessage("pause crawl", m.collector.TaskManager().PauseCrawl())
+}
+
+func (m *Manager) HandleResumeCrawl(c *httpr.Context) {
+	c.ResultMessage("resume crawl", m.collector.TaskManager().ResumeCrawl())
+}
+
+// HandleDrainCrawl 排空运行中的任务后停止
+func (m *Manager) HandleDrainCrawl(c *httpr.Context) {
+	c.ResultMessage("drain crawl, will stop after running tasks finished", m.collector.TaskManager().DrainCrawl())
+}
+
+func (m *Manager) HandleCluster(c *httpr.Context) {
+	c.ResultData(m.collector.TaskManager().Cluster())
+}
+
+func (m *Manager) HandleListProxies(c *httpr.Context) {
+	c.ResultData(m.collector.TaskManager().Proxies(), nil)
+}
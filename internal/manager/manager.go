@@ -4,7 +4,9 @@ import (
 	"context"
 	"github.com/xiaorui77/goutils/httpr"
 	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
 	"github.com/xiaorui77/monker-king/internal/engine/api"
+	"github.com/xiaorui77/monker-king/internal/metrics"
 	"net/http"
 	"time"
 )
@@ -17,26 +19,47 @@ type Manager struct {
 	runChan chan struct{}
 }
 
-func NewManager(c api.Collect) *Manager {
+func NewManager(conf config.ManagerConfig, c api.Collect) *Manager {
 	m := &Manager{
 		collector: c,
 		router:    httpr.NewEngine(),
 		runChan:   make(chan struct{}),
 	}
+	// /metrics 由Prometheus抓取, 其余交给router
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/", m.router)
 	m.server = &http.Server{
-		Addr:         ":8060",
+		Addr:         conf.Addr,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 		IdleTimeout:  15 * time.Second,
 
-		Handler: m.router,
+		Handler: mux,
 	}
 
 	m.router.POST("/api/v1/task", m.HandleAddTask)
 	m.router.DELETE("/api/v1/task", m.HandleDeleteTask)
+	m.router.GET("/api/v1/task/:id", m.HandleGetTask)
+	m.router.DELETE("/api/v1/task/:id", m.HandleRemoveTask)
+	m.router.POST("/api/v1/task/:id/cancel", m.HandleCancelTask)
+	m.router.POST("/api/v1/task/:id/retry", m.HandleRetryTask)
+	m.router.PUT("/api/v1/task/:id/priority", m.HandleSetPriority)
+	m.router.POST("/api/v1/sitemap", m.HandleAddSitemap)
 	m.router.GET("/api/v1/tasks", m.HandleListTask)
 	m.router.GET("/api/v1/browsers", m.HandleBrowserTree)
 	m.router.GET("/api/v1/browser/:domain/tree", m.HandleBrowserTree)
+	m.router.PUT("/api/v1/browser/:domain/process", m.HandleSetProcess)
+	m.router.POST("/api/v1/browser/:domain/pause", m.HandlePauseBrowser)
+	m.router.POST("/api/v1/browser/:domain/resume", m.HandleResumeBrowser)
+	m.router.GET("/api/v1/browser/:domain/ratelimit", m.HandleGetRateLimit)
+	m.router.PUT("/api/v1/browser/:domain/ratelimit", m.HandleSetRateLimit)
+	m.router.GET("/api/v1/cluster", m.HandleCluster)
+	m.router.GET("/api/v1/proxies", m.HandleListProxies)
+	m.router.GET("/api/v1/crawl", m.HandleCrawlState)
+	m.router.POST("/api/v1/crawl/pause", m.HandlePauseCrawl)
+	m.router.POST("/api/v1/crawl/resume", m.HandleResumeCrawl)
+	m.router.POST("/api/v1/crawl/drain", m.HandleDrainCrawl)
 
 	return m
 }
@@ -1,9 +1,21 @@
 package manager
 
+import "github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+
 type TaskRequest struct {
 	Id  uint64 `json:"id"`
 	Url string `json:"url"`
+	// Request 可选的请求方法, 请求头和请求体, 如 {"method": "POST", "form": {"q": ["monkey"]}}
+	Request task.Request `json:"request"`
 }
 
 type TaskList struct {
 }
+
+type ProcessRequest struct {
+	Num int `json:"num"`
+}
+
+type PriorityRequest struct {
+	Priority int `json:"priority"`
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "monkeyking"
+
+var (
+	// Requests 按域名和响应码统计的请求数, 请求失败时code为error
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests sent by processes, partitioned by domain and status code.",
+	}, []string{"domain", "code"})
+
+	// DownloadedBytes 解压后的响应体字节数
+	DownloadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes of response bodies read, partitioned by domain.",
+	}, []string{"domain"})
+
+	// WireBytes 传输的响应体字节数, 压缩的响应小于DownloadedBytes
+	WireBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wire_bytes_total",
+		Help:      "Bytes of response bodies received before decompression, partitioned by domain.",
+	}, []string{"domain"})
+
+	// FetchDuration 从发出请求到读取完响应体的耗时
+	FetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fetch_duration_seconds",
+		Help:      "Latency of fetching a task, partitioned by domain and fetcher.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"domain", "fetcher"})
+
+	CallbackDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "callback_duration_seconds",
+		Help:      "Duration of response handlers and task callbacks, partitioned by domain.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"domain"})
+
+	// TaskTransitions 任务进入每个状态的次数
+	TaskTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "task_state_transitions_total",
+		Help:      "Task state transitions, partitioned by the new state.",
+	}, []string{"state"})
+
+	TaskRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "task_retries_total",
+		Help:      "Failed tasks rescheduled for retry, partitioned by domain.",
+	}, []string{"domain"})
+
+	TaskQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "task_queue_depth",
+		Help:      "Tasks waiting in the queue of the scheduler.",
+	})
+
+	Processes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "processes",
+		Help:      "Active processes of each browser.",
+	}, []string{"domain"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests, DownloadedBytes, WireBytes, FetchDuration, CallbackDuration,
+		TaskTransitions, TaskRetries, TaskQueueDepth, Processes,
+	)
+}
+
+// Handler 以Prometheus格式输出所有指标
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	Requests.Reset()
+	TaskTransitions.Reset()
+	Requests.WithLabelValues("a.com", "200").Inc()
+	TaskTransitions.WithLabelValues("SuccessfulAll").Add(2)
+	TaskQueueDepth.Set(3)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, expect := range []string{
+		`monkeyking_requests_total{code="200",domain="a.com"} 1`,
+		`monkeyking_task_state_transitions_total{state="SuccessfulAll"} 2`,
+		`monkeyking_task_queue_depth 3`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), expect) {
+			t.Errorf("metrics output should contain %q", expect)
+		}
+	}
+}
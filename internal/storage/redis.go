@@ -5,12 +5,11 @@ import (
 	"fmt"
 	"github.com/go-redis/redis"
 	"github.com/xiaorui77/goutils/logx"
-	"hash/fnv"
-	"strconv"
 )
 
 const (
 	PersistenceTasksKey = "PersistenceTasks"
+	VisitedKey          = "visited"
 )
 
 type RedisStore struct {
@@ -34,26 +33,37 @@ func NewRedisStore(addr string) (s *RedisStore, err error) {
 	}, nil
 }
 
-func (s *RedisStore) Visit(url string) {
-	h := fnv.New64()
-	_, _ = h.Write([]byte(url))
-	hash := strconv.FormatUint(h.Sum64(), 16)
-
-	if err := s.client.Set(KeyPrefix+hash, "true", 0).Err(); err != nil {
-		logx.Warnf("[storage] set visit key[%s] url[%v] failed: %v", KeyPrefix+hash, url, err)
+// Visit 记录已访问的key(URL的哈希), 保存在同一个集合中
+func (s *RedisStore) Visit(key string) {
+	if err := s.client.SAdd(KeyPrefix+VisitedKey, key).Err(); err != nil {
+		logx.Warnf("[storage] record visited key[%s] failed: %v", key, err)
 	}
 }
 
-func (s *RedisStore) IsVisited(url string) bool {
-	h := fnv.New64()
-	_, _ = h.Write([]byte(url))
-	hash := strconv.FormatUint(h.Sum64(), 16)
-	res, err := s.client.Get(KeyPrefix + hash).Result()
+func (s *RedisStore) IsVisited(key string) bool {
+	res, err := s.client.SIsMember(KeyPrefix+VisitedKey, key).Result()
 	if err != nil {
-		logx.Warnf("[store] get visit key[%s] url[%v]  failed: %v", KeyPrefix+hash, url, err)
+		logx.Warnf("[store] query visited key[%s] failed: %v", key, err)
 		return false
 	}
-	return res == "true"
+	return res
+}
+
+// Visited 遍历所有已访问的key
+func (s *RedisStore) Visited(fn func(key string)) error {
+	var cursor uint64
+	for {
+		keys, next, err := s.client.SScan(KeyPrefix+VisitedKey, cursor, "", 1000).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fn(key)
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
 }
 
 // PersistenceTasks 持久化tasks，以host保存
@@ -3,27 +3,83 @@ package storage
 import (
 	"fmt"
 	"github.com/xiaorui77/goutils/logx"
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const (
+	DriverMySQL  = "mysql"
+	DriverSQLite = "sqlite" // 嵌入式的文件数据库
+	DriverMemory = "memory" // 内存数据库, 进程退出即丢失, 用于测试
 )
 
 type Storage interface {
 	GetDB() *gorm.DB
+	Close() error
 }
 
 type storage struct {
-	db *gorm.DB
+	driver string
+	db     *gorm.DB
 }
 
 func (s *storage) GetDB() *gorm.DB {
 	return s.db
 }
 
-func NewStorage(addr string) Storage {
-	dsn := fmt.Sprintf("root:123456@tcp(%s)/monkey-king?charset=utf8mb4&parseTime=True&loc=Local", addr)
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+func (s *storage) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// memorySeq 保证每个内存数据库互相独立
+var memorySeq int32
+
+// NewStorage 根据配置选择后端, 并自动迁移表结构
+func NewStorage(conf config.StorageConfig) (Storage, error) {
+	var dialector gorm.Dialector
+	switch conf.Driver {
+	case DriverMySQL:
+		if conf.DSN == "" {
+			return nil, fmt.Errorf("storage driver %s requires dsn", conf.Driver)
+		}
+		dialector = mysql.Open(conf.DSN)
+	case DriverSQLite, "":
+		path := conf.DSN
+		if path == "" {
+			path = config.DefaultSQLitePath
+		}
+		if dir := filepath.Dir(path); dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, fmt.Errorf("create storage dir %v failed: %v", dir, err)
+			}
+		}
+		dialector = sqlite.Open(path)
+	case DriverMemory:
+		dsn := fmt.Sprintf("file:monkey-king-%d?mode=memory&cache=shared", atomic.AddInt32(&memorySeq, 1))
+		dialector = sqlite.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unsupported storage driver: %s", conf.Driver)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		logx.Fatalf("connect DB failed: %v", err)
+		logx.Errorf("[storage] connect %s failed: %v", conf.Driver, err)
+		return nil, fmt.Errorf("connect storage failed: %v", err)
+	}
+	if err := db.AutoMigrate(&task.Task{}, &task.ErrDetail{}); err != nil {
+		logx.Errorf("[storage] auto migrate %s failed: %v", conf.Driver, err)
+		return nil, fmt.Errorf("migrate storage failed: %v", err)
 	}
-	return &storage{db: db}
+	logx.Infof("[storage] connect to %s storage successfully", conf.Driver)
+	return &storage{driver: conf.Driver, db: db}, nil
 }
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"github.com/xiaorui77/monker-king/internal/config"
+	"github.com/xiaorui77/monker-king/internal/engine/schedule/task"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewStorage_Memory(t *testing.T) {
+	s, err := NewStorage(config.StorageConfig{Driver: DriverMemory})
+	if err != nil {
+		t.Fatalf("new memory storage failed: %v", err)
+	}
+	defer s.Close()
+
+	tk := task.NewTask("root", nil, "https://example.com", nil)
+	if err := s.GetDB().Create(tk).Error; err != nil {
+		t.Fatalf("create task failed: %v", err)
+	}
+	var n int64
+	s.GetDB().Model(&task.Task{}).Count(&n)
+	if n != 1 {
+		t.Errorf("expect 1 task, but got %d", n)
+	}
+
+	// 不同实例互相隔离
+	other, _ := NewStorage(config.StorageConfig{Driver: DriverMemory})
+	defer other.Close()
+	other.GetDB().Model(&task.Task{}).Count(&n)
+	if n != 0 {
+		t.Errorf("expect isolated storage, but got %d tasks", n)
+	}
+}
+
+func TestNewStorage_SQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "mk.db")
+	s, err := NewStorage(config.StorageConfig{Driver: DriverSQLite, DSN: path})
+	if err != nil {
+		t.Fatalf("new sqlite storage failed: %v", err)
+	}
+	_ = s.Close()
+}
+
+func TestNewStorage_Unknown(t *testing.T) {
+	if _, err := NewStorage(config.StorageConfig{Driver: "oracle"}); err == nil {
+		t.Errorf("expect error for unknown driver")
+	}
+}
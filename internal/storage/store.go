@@ -5,8 +5,9 @@ const (
 )
 
 type Store interface {
-	Visit(url string)
-	IsVisited(url string) bool
+	Visit(key string)
+	IsVisited(key string) bool
+	Visited(fn func(key string)) error
 
 	PersistenceTasks(host string, tasks interface{}) error
 }
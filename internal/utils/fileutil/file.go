@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/xiaorui77/goutils/fileutils"
 	"github.com/xiaorui77/goutils/logx"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -20,16 +21,41 @@ func SaveImage(bytes []byte, path, name string) error {
 		}
 	}
 
-	switch http.DetectContentType(bytes) {
+	filePath := fmt.Sprintf("%v/%v%v", path, name, extension(bytes))
+	return ioutil.WriteFile(filePath, bytes, 0666)
+}
+
+// MoveFile 将下载完成的临时文件重命名到指定位置, 扩展名规则与SaveImage相同
+func MoveFile(src, path, name string) error {
+	name = fileutils.WindowsName(name)
+	if err := os.MkdirAll(path, 0711); err != nil {
+		return fmt.Errorf("create path %v failed: %v", path, err)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	_ = f.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	return os.Rename(src, fmt.Sprintf("%v/%v%v", path, name, extension(head[:n])))
+}
+
+// extension 根据内容判断文件扩展名
+func extension(data []byte) string {
+	switch http.DetectContentType(data) {
 	case "image/png":
-		name += ".png"
+		return ".png"
 	case "image/jpeg", "image/jpg":
-		name += ".jpg"
+		return ".jpg"
 	case "application/octet-stream":
+		return ""
 	default:
-		name += ".unknown"
+		return ".unknown"
 	}
-
-	filePath := fmt.Sprintf("%v/%v", path, name)
-	return ioutil.WriteFile(filePath, bytes, 0666)
 }
@@ -2,18 +2,42 @@ package fileutil
 
 import "io"
 
-// VisualReader 将普通包装为可查看进度的Reader
+// VisualReader 将普通包装为可查看进度的Reader.
+// 响应经过压缩时Reader为解压后的内容, Cur为解压后的字节数, Total和Wire为传输的字节数.
 type VisualReader struct {
+	io.Reader `json:"-"`
+	Total     int64
+	Cur       int64
+	Wire      int64 // 已读取的传输字节数, 由CountWire返回的Reader统计
+}
+
+// CountWire 包装传输层的Reader, 读取的字节数计入Wire
+func (r *VisualReader) CountWire(wire io.Reader) io.Reader {
+	return &wireReader{Reader: wire, r: r}
+}
+
+// Progress 按传输的字节数计算的进度
+func (r *VisualReader) Progress() (cur, total int64) {
+	return r.Wire, r.Total
+}
+
+type wireReader struct {
 	io.Reader
-	Total int64
-	Cur   int64
+	r *VisualReader
+}
+
+func (w *wireReader) Read(p []byte) (int, error) {
+	n, err := w.Reader.Read(p)
+	w.r.Wire += int64(n)
+	return n, err
 }
 
 func (r *VisualReader) ReadAll() ([]byte, error) {
-	if r.Total <= 0 {
-		r.Total = 512
+	size := r.Total
+	if size <= 0 {
+		size = 512
 	}
-	b := make([]byte, 0, r.Total)
+	b := make([]byte, 0, size)
 
 	for {
 		if len(b) == cap(b) {
@@ -27,8 +51,8 @@ func (r *VisualReader) ReadAll() ([]byte, error) {
 			if err == io.EOF {
 				err = nil
 			}
-			if r.Total < r.Cur {
-				r.Total = r.Cur
+			if r.Total < r.Wire {
+				r.Total = r.Wire
 			}
 			return b, err
 		}
@@ -88,7 +88,17 @@ func (i *InputWrap) OnComplete(key tcell.Key) {
 
 func (i *InputWrap) OnCompleteCmd() {
 	str := strings.TrimSpace(i.GetText())
-	i.app.content.ChangePage(str, true)
+	manager := i.collector.TaskManager()
+	switch str {
+	case "pause":
+		_ = manager.PauseCrawl()
+	case "resume":
+		_ = manager.ResumeCrawl()
+	case "drain":
+		_ = manager.DrainCrawl()
+	default:
+		i.app.content.ChangePage(str, true)
+	}
 	i.SetText("")
 	i.Active(false, ModeNode)
 }